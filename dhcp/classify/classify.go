@@ -0,0 +1,92 @@
+// Package classify assigns client classes to DHCP requests by evaluating
+// configured match expressions against the decoded packet.
+package classify
+
+import (
+	"dhcp/protocol"
+	"errors"
+	"fmt"
+	"time"
+)
+
+type Class struct {
+	Name string
+	// Test is the match expression, e.g. "option[60].text == 'PXEClient'".
+	Test string
+	// Options are added to replies, overriding the scope defaults.
+	Options map[byte][]byte
+	// Pools, when set, restricts clients in this class to the named pools.
+	Pools []string
+	// LeaseTime, when non-zero, overrides the scope lease time.
+	LeaseTime time.Duration
+	// MinLease and MaxLease, when non-zero, override the scope bounds on
+	// the lease time a client in this class may ask for.
+	MinLease time.Duration
+	MaxLease time.Duration
+}
+
+type compiledClass struct {
+	class *Class
+	test  node
+}
+
+type Classifier struct {
+	classes []compiledClass
+}
+
+// New compiles the match expressions of classes. Classes are evaluated in
+// order, so member() may only refer to classes listed earlier.
+func New(classes []Class) (*Classifier, error) {
+	classes = append([]Class(nil), classes...)
+	c := &Classifier{classes: make([]compiledClass, 0, len(classes))}
+	known := make(map[string]bool, len(classes))
+	for i := range classes {
+		class := &classes[i]
+		if class.Name == "" {
+			return nil, errors.New("class name must not be empty")
+		}
+		if known[class.Name] {
+			return nil, fmt.Errorf("duplicate class %q", class.Name)
+		}
+		if class.Test == "" {
+			return nil, fmt.Errorf("class %q has no test expression", class.Name)
+		}
+		test, err := parse(class.Test, known)
+		if err != nil {
+			return nil, fmt.Errorf("class %q: %w", class.Name, err)
+		}
+		known[class.Name] = true
+		c.classes = append(c.classes, compiledClass{class: class, test: test})
+	}
+	return c, nil
+}
+
+// Classify returns the classes whose test matches the packet, in
+// configuration order.
+func (c *Classifier) Classify(packet *protocol.Packet) []*Class {
+	if c == nil {
+		return nil
+	}
+	e := &env{
+		packet:  packet,
+		relay:   packet.GetOption(protocol.OptionDHCPAgentOptions),
+		matched: make(map[string]bool),
+	}
+	var result []*Class
+	for _, cc := range c.classes {
+		if cc.test.eval(e).ok {
+			e.matched[cc.class.Name] = true
+			result = append(result, cc.class)
+		}
+	}
+	return result
+}
+
+// Names returns the names of classes.
+func Names(classes []*Class) []string {
+	names := make([]string, len(classes))
+	for i, c := range classes {
+		names[i] = c.Name
+	}
+	return names
+}
@@ -0,0 +1,111 @@
+package classify
+
+import (
+	"dhcp/protocol"
+	"net"
+	"testing"
+)
+
+func testPacket() *protocol.Packet {
+	p := &protocol.Packet{
+		Op:     protocol.BOOTREQUEST,
+		HType:  1,
+		HLen:   6,
+		CIAddr: net.IPv4zero,
+		GIAddr: net.IP{10, 0, 0, 1},
+		CHAddr: net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+	}
+	p.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+	p.AddOption(protocol.OptionClassIdentifier, []byte("PXEClient:Arch:00007"))
+	p.AddOption(protocol.OptionUserClass, []byte("iPXE\x00"))
+	p.AddOption(protocol.OptionDHCPAgentOptions, []byte{1, 4, 'e', 't', 'h', '0', 2, 2, 0xab, 0xcd})
+	return p
+}
+
+func TestExpressions(t *testing.T) {
+	testCases := []struct {
+		expr string
+		want bool
+	}{
+		{"option[60].exists", true},
+		{"option[43].exists", false},
+		{"substring(option[60].hex, 0, 9) == 'PXEClient'", true},
+		{"substring(option[60].hex, 15, all) == '00007'", true},
+		{"substring(option[60].hex, 100, 3) == ''", true},
+		{"option[77].text == 'iPXE'", true},
+		{"option[77].hex == 'iPXE'", false},
+		{"substring(pkt4.mac, 0, 3) == 0x001122", true},
+		{"substring(pkt4.mac, 0, 3) != 0x001122", false},
+		{"pkt4.htype == 0x01", true},
+		{"pkt4.msgtype == 0x1", true},
+		{"pkt4.giaddr == 0x0a000001", true},
+		{"relay4[1].text == 'eth0'", true},
+		{"relay4[2].hex == 0xabcd", true},
+		{"relay4[5].exists", false},
+		{"hexstring(substring(pkt4.mac, 0, 3), ':') == '00:11:22'", true},
+		{"concat('PXE', 'Client') == substring(option[60].hex, 0, 9)", true},
+		{"option[60].exists and not option[43].exists", true},
+		{"option[43].exists or (pkt4.hlen == 0x06 and true)", true},
+		{"not (option[60].exists or false)", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.expr, func(t *testing.T) {
+			n, err := parse(tc.expr, nil)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			if got := n.eval(&env{packet: testPacket(), relay: testPacket().GetOption(protocol.OptionDHCPAgentOptions)}).ok; got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"option[60].hex",
+		"option[300].exists",
+		"option[60].bogus",
+		"substring(option[60].hex, 0) == 'x'",
+		"option[60].exists == 'x'",
+		"'abc",
+		"member('unknown')",
+		"option[60].exists and",
+		"not 'x'",
+	} {
+		if _, err := parse(expr, nil); err == nil {
+			t.Errorf("parse(%q) succeeded, want error", expr)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	c, err := New([]Class{
+		{Name: "pxe", Test: "substring(option[60].hex, 0, 9) == 'PXEClient'"},
+		{Name: "voip", Test: "substring(pkt4.mac, 0, 3) == 0x0004f2"},
+		{Name: "ipxe", Test: "member('pxe') and option[77].text == 'iPXE'"},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	got := Names(c.Classify(testPacket()))
+	if len(got) != 2 || got[0] != "pxe" || got[1] != "ipxe" {
+		t.Errorf("got classes %v, want [pxe ipxe]", got)
+	}
+}
+
+func TestNewRejectsInvalidClasses(t *testing.T) {
+	testCases := map[string][]Class{
+		"empty name":     {{Test: "true"}},
+		"empty test":     {{Name: "a"}},
+		"duplicate":      {{Name: "a", Test: "true"}, {Name: "a", Test: "true"}},
+		"forward member": {{Name: "a", Test: "member('b')"}, {Name: "b", Test: "true"}},
+	}
+	for name, classes := range testCases {
+		if _, err := New(classes); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,569 @@
+package classify
+
+import (
+	"bytes"
+	"dhcp/protocol"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Expressions follow a small subset of the Kea classification language:
+//
+//	option[60].text == 'PXEClient'
+//	substring(option[60].hex, 0, 9) == 'PXEClient'
+//	substring(pkt4.mac, 0, 3) == 0x001122
+//	relay4[1].exists and not member('guest')
+//
+// Values are either byte strings or booleans. Option and relay accessors
+// yield the raw option bytes (".hex" and ".text") or whether the option is
+// present (".exists"). Comparisons are byte-wise.
+
+type kind int
+
+const (
+	kindBytes kind = iota
+	kindBool
+)
+
+type env struct {
+	packet  *protocol.Packet
+	relay   []byte
+	matched map[string]bool
+}
+
+type node interface {
+	kind() kind
+	eval(e *env) value
+}
+
+type value struct {
+	b  []byte
+	ok bool
+}
+
+type literal struct{ b []byte }
+
+func (n *literal) kind() kind      { return kindBytes }
+func (n *literal) eval(*env) value { return value{b: n.b} }
+
+type boolLiteral struct{ v bool }
+
+func (n *boolLiteral) kind() kind      { return kindBool }
+func (n *boolLiteral) eval(*env) value { return value{ok: n.v} }
+
+type optionNode struct {
+	code  byte
+	relay bool
+	field string
+}
+
+func (n *optionNode) kind() kind {
+	if n.field == "exists" {
+		return kindBool
+	}
+	return kindBytes
+}
+
+func (n *optionNode) eval(e *env) value {
+	var data []byte
+	if n.relay {
+		data = getSubOption(e.relay, n.code)
+	} else {
+		data = e.packet.GetOption(n.code)
+	}
+	switch n.field {
+	case "exists":
+		return value{ok: data != nil}
+	case "text":
+		return value{b: bytes.TrimRight(data, "\x00")}
+	default:
+		return value{b: data}
+	}
+}
+
+type pktNode struct{ field string }
+
+func (n *pktNode) kind() kind { return kindBytes }
+
+func (n *pktNode) eval(e *env) value {
+	p := e.packet
+	switch n.field {
+	case "mac":
+		hlen := int(p.HLen)
+		if hlen > len(p.CHAddr) {
+			hlen = len(p.CHAddr)
+		}
+		return value{b: p.CHAddr[:hlen]}
+	case "htype":
+		return value{b: []byte{p.HType}}
+	case "hlen":
+		return value{b: []byte{p.HLen}}
+	case "msgtype":
+		return value{b: []byte{p.DHCPMessageType()}}
+	case "ciaddr":
+		return value{b: p.CIAddr.To4()}
+	case "giaddr":
+		return value{b: p.GIAddr.To4()}
+	}
+	return value{}
+}
+
+var pktFields = map[string]bool{
+	"mac": true, "htype": true, "hlen": true, "msgtype": true, "ciaddr": true, "giaddr": true,
+}
+
+type substringNode struct {
+	arg           node
+	start, length int // length < 0 means "all"
+}
+
+func (n *substringNode) kind() kind { return kindBytes }
+
+func (n *substringNode) eval(e *env) value {
+	b := n.arg.eval(e).b
+	if n.start >= len(b) {
+		return value{b: []byte{}}
+	}
+	end := len(b)
+	if n.length >= 0 && n.start+n.length < end {
+		end = n.start + n.length
+	}
+	return value{b: b[n.start:end]}
+}
+
+type concatNode struct{ left, right node }
+
+func (n *concatNode) kind() kind { return kindBytes }
+
+func (n *concatNode) eval(e *env) value {
+	l, r := n.left.eval(e).b, n.right.eval(e).b
+	b := make([]byte, 0, len(l)+len(r))
+	return value{b: append(append(b, l...), r...)}
+}
+
+type hexstringNode struct {
+	arg node
+	sep string
+}
+
+func (n *hexstringNode) kind() kind { return kindBytes }
+
+func (n *hexstringNode) eval(e *env) value {
+	b := n.arg.eval(e).b
+	parts := make([]string, len(b))
+	for i, c := range b {
+		parts[i] = fmt.Sprintf("%02x", c)
+	}
+	return value{b: []byte(strings.Join(parts, n.sep))}
+}
+
+type memberNode struct{ class string }
+
+func (n *memberNode) kind() kind        { return kindBool }
+func (n *memberNode) eval(e *env) value { return value{ok: e.matched[n.class]} }
+
+type compareNode struct {
+	left, right node
+	negate      bool
+}
+
+func (n *compareNode) kind() kind { return kindBool }
+
+func (n *compareNode) eval(e *env) value {
+	l, r := n.left.eval(e), n.right.eval(e)
+	var eq bool
+	if n.left.kind() == kindBool {
+		eq = l.ok == r.ok
+	} else {
+		eq = bytes.Equal(l.b, r.b)
+	}
+	return value{ok: eq != n.negate}
+}
+
+type logicNode struct {
+	op          string
+	left, right node
+}
+
+func (n *logicNode) kind() kind { return kindBool }
+
+func (n *logicNode) eval(e *env) value {
+	switch n.op {
+	case "and":
+		return value{ok: n.left.eval(e).ok && n.right.eval(e).ok}
+	case "or":
+		return value{ok: n.left.eval(e).ok || n.right.eval(e).ok}
+	default:
+		return value{ok: !n.left.eval(e).ok}
+	}
+}
+
+type token struct {
+	typ string // "ident", "int", "string", "hex", "op", "eof"
+	val string
+	pos int
+}
+
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, token{"string", s[i+1 : i+1+end], i})
+			i += end + 2
+		case c == '0' && i+1 < len(s) && (s[i+1] == 'x' || s[i+1] == 'X'):
+			j := i + 2
+			for j < len(s) && isHexDigit(s[j]) {
+				j++
+			}
+			tokens = append(tokens, token{"hex", s[i+2 : j], i})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+				j++
+			}
+			tokens = append(tokens, token{"int", s[i:j], i})
+			i = j
+		case isIdentChar(c):
+			j := i
+			for j < len(s) && (isIdentChar(s[j]) || s[j] >= '0' && s[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, token{"ident", s[i:j], i})
+			i = j
+		case c == '=' || c == '!':
+			if i+1 >= len(s) || s[i+1] != '=' {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			tokens = append(tokens, token{"op", s[i : i+2], i})
+			i += 2
+		case strings.IndexByte("()[],.", c) >= 0:
+			tokens = append(tokens, token{"op", string(c), i})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected %q at %d", c, i)
+		}
+	}
+	return append(tokens, token{typ: "eof", pos: len(s)}), nil
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func isIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '-'
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	known  map[string]bool
+}
+
+// parse compiles expr into a boolean expression tree. known holds the
+// class names that member() may refer to.
+func parse(expr string, known map[string]bool) (node, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, known: known}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != "eof" {
+		return nil, fmt.Errorf("unexpected %q at %d", t.val, t.pos)
+	}
+	if n.kind() != kindBool {
+		return nil, fmt.Errorf("expression does not evaluate to a boolean")
+	}
+	return n, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.typ != "eof" {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(typ, val string) bool {
+	if t := p.peek(); t.typ == typ && t.val == val {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(typ, val string) error {
+	if !p.accept(typ, val) {
+		t := p.peek()
+		return fmt.Errorf("expected %q at %d, got %q", val, t.pos, t.val)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	return p.parseLogic("or", p.parseAnd)
+}
+
+func (p *parser) parseAnd() (node, error) {
+	return p.parseLogic("and", p.parseUnary)
+}
+
+func (p *parser) parseLogic(op string, operand func() (node, error)) (node, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("ident", op) {
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		if left.kind() != kindBool || right.kind() != kindBool {
+			return nil, fmt.Errorf("operands of %q must be boolean", op)
+		}
+		left = &logicNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.accept("ident", "not") {
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if n.kind() != kindBool {
+			return nil, fmt.Errorf("operand of \"not\" must be boolean")
+		}
+		return &logicNode{op: "not", left: n}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *parser) parseCompare() (node, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	if t.typ != "op" || (t.val != "==" && t.val != "!=") {
+		return left, nil
+	}
+	p.next()
+	right, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	if left.kind() != right.kind() {
+		return nil, fmt.Errorf("mismatched operand types for %q at %d", t.val, t.pos)
+	}
+	return &compareNode{left: left, right: right, negate: t.val == "!="}, nil
+}
+
+func (p *parser) parseTerm() (node, error) {
+	t := p.next()
+	switch t.typ {
+	case "string":
+		return &literal{b: []byte(t.val)}, nil
+	case "hex":
+		s := t.val
+		if len(s)%2 == 1 {
+			s = "0" + s
+		}
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex literal at %d: %w", t.pos, err)
+		}
+		return &literal{b: b}, nil
+	case "op":
+		if t.val == "(" {
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect("op", ")")
+		}
+	case "ident":
+		switch t.val {
+		case "true", "false":
+			return &boolLiteral{v: t.val == "true"}, nil
+		case "option", "relay4":
+			return p.parseOption(t.val == "relay4")
+		case "pkt4":
+			if err := p.expect("op", "."); err != nil {
+				return nil, err
+			}
+			f := p.next()
+			if !pktFields[f.val] {
+				return nil, fmt.Errorf("unknown packet field %q at %d", f.val, f.pos)
+			}
+			return &pktNode{field: f.val}, nil
+		case "substring":
+			return p.parseSubstring()
+		case "concat":
+			return p.parseConcat()
+		case "hexstring":
+			return p.parseHexstring()
+		case "member":
+			return p.parseMember()
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", t.val, t.pos)
+}
+
+func (p *parser) parseInt() (int, error) {
+	t := p.next()
+	if t.typ != "int" {
+		return 0, fmt.Errorf("expected integer at %d, got %q", t.pos, t.val)
+	}
+	return strconv.Atoi(t.val)
+}
+
+func (p *parser) parseOption(relay bool) (node, error) {
+	if err := p.expect("op", "["); err != nil {
+		return nil, err
+	}
+	code, err := p.parseInt()
+	if err != nil {
+		return nil, err
+	}
+	if code < 1 || code > 254 {
+		return nil, fmt.Errorf("option code %d out of range", code)
+	}
+	if err := p.expect("op", "]"); err != nil {
+		return nil, err
+	}
+	if err := p.expect("op", "."); err != nil {
+		return nil, err
+	}
+	f := p.next()
+	switch f.val {
+	case "hex", "text", "exists":
+		return &optionNode{code: byte(code), relay: relay, field: f.val}, nil
+	}
+	return nil, fmt.Errorf("unknown option field %q at %d", f.val, f.pos)
+}
+
+func (p *parser) parseBytesArg() (node, error) {
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if n.kind() != kindBytes {
+		return nil, fmt.Errorf("expected a string argument")
+	}
+	return n, nil
+}
+
+func (p *parser) parseSubstring() (node, error) {
+	if err := p.expect("op", "("); err != nil {
+		return nil, err
+	}
+	arg, err := p.parseBytesArg()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("op", ","); err != nil {
+		return nil, err
+	}
+	start, err := p.parseInt()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("op", ","); err != nil {
+		return nil, err
+	}
+	length := -1
+	if !p.accept("string", "all") && !p.accept("ident", "all") {
+		if length, err = p.parseInt(); err != nil {
+			return nil, err
+		}
+	}
+	return &substringNode{arg: arg, start: start, length: length}, p.expect("op", ")")
+}
+
+func (p *parser) parseConcat() (node, error) {
+	if err := p.expect("op", "("); err != nil {
+		return nil, err
+	}
+	left, err := p.parseBytesArg()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("op", ","); err != nil {
+		return nil, err
+	}
+	right, err := p.parseBytesArg()
+	if err != nil {
+		return nil, err
+	}
+	return &concatNode{left: left, right: right}, p.expect("op", ")")
+}
+
+func (p *parser) parseHexstring() (node, error) {
+	if err := p.expect("op", "("); err != nil {
+		return nil, err
+	}
+	arg, err := p.parseBytesArg()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("op", ","); err != nil {
+		return nil, err
+	}
+	sep := p.next()
+	if sep.typ != "string" {
+		return nil, fmt.Errorf("expected separator string at %d", sep.pos)
+	}
+	return &hexstringNode{arg: arg, sep: sep.val}, p.expect("op", ")")
+}
+
+func (p *parser) parseMember() (node, error) {
+	if err := p.expect("op", "("); err != nil {
+		return nil, err
+	}
+	name := p.next()
+	if name.typ != "string" {
+		return nil, fmt.Errorf("expected class name at %d", name.pos)
+	}
+	if !p.known[name.val] {
+		return nil, fmt.Errorf("member() refers to unknown or later class %q", name.val)
+	}
+	return &memberNode{class: name.val}, p.expect("op", ")")
+}
+
+// getSubOption returns the value of sub-option code in data, which is
+// encoded like the top-level options field (code, length, value).
+func getSubOption(data []byte, code byte) []byte {
+	for i := 0; i+1 < len(data); {
+		length := int(data[i+1])
+		if i+2+length > len(data) {
+			return nil
+		}
+		if data[i] == code {
+			return data[i+2 : i+2+length]
+		}
+		i += length + 2
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"dhcp/classify"
+	"dhcp/pool"
+	"dhcp/server"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// fileConfig is the JSON form of server.Config. Addresses, networks and
+// durations are strings, and class option values are hex.
+type fileConfig struct {
+	Start         string         `json:"start"`
+	End           string         `json:"end"`
+	Subnet        string         `json:"subnet"`
+	Lease         string         `json:"lease"`
+	MinLease      string         `json:"min_lease"`
+	MaxLease      string         `json:"max_lease"`
+	RenewalTime   string         `json:"renewal_time"`
+	RebindingTime string         `json:"rebinding_time"`
+	DNS           []string       `json:"dns"`
+	Router        string         `json:"router"`
+	ServerIP      string         `json:"server_ip"`
+	DomainName    string         `json:"domain_name"`
+	OfferHoldTime string         `json:"offer_hold_time"`
+	AffinityTime  string         `json:"affinity_time"`
+	DeclineTime   string         `json:"decline_time"`
+	Authoritative bool           `json:"authoritative"`
+	RapidCommit   bool           `json:"rapid_commit"`
+	Pools         []filePool     `json:"pools"`
+	Classes       []fileClass    `json:"classes"`
+	Exclude       []string       `json:"exclude"`
+	Probe         fileProbe      `json:"probe"`
+	BOOTP         fileBOOTP      `json:"bootp"`
+	PXE           filePXE        `json:"pxe"`
+	LeaseQuery    fileLeaseQuery `json:"lease_query"`
+	Workers       int            `json:"workers"`
+	QueueDepth    int            `json:"queue_depth"`
+}
+
+type filePool struct {
+	Name     string      `json:"name"`
+	Ranges   []fileRange `json:"ranges"`
+	Exclude  []string    `json:"exclude"`
+	Strategy string      `json:"strategy"`
+}
+
+type fileRange struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+type fileClass struct {
+	Name      string            `json:"name"`
+	Test      string            `json:"test"`
+	Options   map[string]string `json:"options"`
+	Pools     []string          `json:"pools"`
+	LeaseTime string            `json:"lease_time"`
+	MinLease  string            `json:"min_lease"`
+	MaxLease  string            `json:"max_lease"`
+}
+
+type fileBOOTP struct {
+	Enabled     bool            `json:"enabled"`
+	Hosts       []fileBOOTPHost `json:"hosts"`
+	DynamicPool string          `json:"dynamic_pool"`
+	ServerName  string          `json:"server_name"`
+	File        string          `json:"file"`
+}
+
+type fileBOOTPHost struct {
+	MAC      string `json:"mac"`
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname"`
+	File     string `json:"file"`
+}
+
+type filePXE struct {
+	Enabled    bool   `json:"enabled"`
+	NextServer string `json:"next_server"`
+	BIOS       string `json:"bios"`
+	UEFI       string `json:"uefi"`
+	ARM64      string `json:"arm64"`
+	HTTP       string `json:"http"`
+	IPXEScript string `json:"ipxe_script"`
+}
+
+type fileLeaseQuery struct {
+	Enabled        bool     `json:"enabled"`
+	Allowed        []string `json:"allowed"`
+	Listen         string   `json:"listen"`
+	MaxConnections int      `json:"max_connections"`
+	Timeout        string   `json:"timeout"`
+}
+
+type fileProbe struct {
+	Mode        string `json:"mode"`
+	Timeout     string `json:"timeout"`
+	AbandonTime string `json:"abandon_time"`
+}
+
+// loadConfig reads a JSON configuration file.
+func loadConfig(path string) (*server.Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fc fileConfig
+	if err := json.Unmarshal(data, &fc); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	cfg, err := fc.config()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (fc *fileConfig) config() (*server.Config, error) {
+	p := &fieldParser{}
+	cfg := &server.Config{
+		Start:         p.ip("start", fc.Start),
+		End:           p.ip("end", fc.End),
+		Subnet:        p.network("subnet", fc.Subnet),
+		Lease:         p.duration("lease", fc.Lease),
+		MinLease:      p.duration("min_lease", fc.MinLease),
+		MaxLease:      p.duration("max_lease", fc.MaxLease),
+		RenewalTime:   p.duration("renewal_time", fc.RenewalTime),
+		RebindingTime: p.duration("rebinding_time", fc.RebindingTime),
+		Router:        p.ip("router", fc.Router),
+		ServerIP:      p.ip("server_ip", fc.ServerIP),
+		DomainName:    fc.DomainName,
+		OfferHoldTime: p.duration("offer_hold_time", fc.OfferHoldTime),
+		AffinityTime:  p.duration("affinity_time", fc.AffinityTime),
+		DeclineTime:   p.duration("decline_time", fc.DeclineTime),
+		Authoritative: fc.Authoritative,
+		RapidCommit:   fc.RapidCommit,
+		Exclude:       p.networks("exclude", fc.Exclude),
+		Probe: server.ProbeConfig{
+			Mode:        fc.Probe.Mode,
+			Timeout:     p.duration("probe.timeout", fc.Probe.Timeout),
+			AbandonTime: p.duration("probe.abandon_time", fc.Probe.AbandonTime),
+		},
+		Workers:    fc.Workers,
+		QueueDepth: fc.QueueDepth,
+	}
+	cfg.BOOTP = server.BOOTPConfig{
+		Enabled:     fc.BOOTP.Enabled,
+		DynamicPool: fc.BOOTP.DynamicPool,
+		ServerName:  fc.BOOTP.ServerName,
+		File:        fc.BOOTP.File,
+	}
+	for _, h := range fc.BOOTP.Hosts {
+		cfg.BOOTP.Hosts = append(cfg.BOOTP.Hosts, server.BOOTPHost{
+			MAC:      p.mac("bootp host mac", h.MAC),
+			IP:       p.ip("bootp host "+h.MAC+" ip", h.IP),
+			Hostname: h.Hostname,
+			File:     h.File,
+		})
+	}
+	cfg.PXE = server.PXEConfig{
+		Enabled:    fc.PXE.Enabled,
+		NextServer: p.ip("pxe.next_server", fc.PXE.NextServer),
+		BIOS:       fc.PXE.BIOS,
+		UEFI:       fc.PXE.UEFI,
+		ARM64:      fc.PXE.ARM64,
+		HTTP:       fc.PXE.HTTP,
+		IPXEScript: fc.PXE.IPXEScript,
+	}
+	cfg.LeaseQuery = server.LeaseQueryConfig{
+		Enabled:        fc.LeaseQuery.Enabled,
+		Allowed:        p.networks("lease_query.allowed", fc.LeaseQuery.Allowed),
+		Listen:         fc.LeaseQuery.Listen,
+		MaxConnections: fc.LeaseQuery.MaxConnections,
+		Timeout:        p.duration("lease_query.timeout", fc.LeaseQuery.Timeout),
+	}
+	for i, dns := range fc.DNS {
+		cfg.DNS = append(cfg.DNS, p.ip(fmt.Sprintf("dns[%d]", i), dns))
+	}
+	for _, fp := range fc.Pools {
+		pc := server.PoolConfig{
+			Name:     fp.Name,
+			Exclude:  p.networks("pool "+fp.Name+" exclude", fp.Exclude),
+			Strategy: fp.Strategy,
+		}
+		for _, r := range fp.Ranges {
+			pc.Ranges = append(pc.Ranges, pool.Range{
+				Start: p.ip("pool "+fp.Name+" start", r.Start),
+				End:   p.ip("pool "+fp.Name+" end", r.End),
+			})
+		}
+		cfg.Pools = append(cfg.Pools, pc)
+	}
+	for _, fcl := range fc.Classes {
+		class := classify.Class{
+			Name:      fcl.Name,
+			Test:      fcl.Test,
+			Pools:     fcl.Pools,
+			LeaseTime: p.duration("class "+fcl.Name+" lease_time", fcl.LeaseTime),
+			MinLease:  p.duration("class "+fcl.Name+" min_lease", fcl.MinLease),
+			MaxLease:  p.duration("class "+fcl.Name+" max_lease", fcl.MaxLease),
+		}
+		if len(fcl.Options) > 0 {
+			class.Options = make(map[byte][]byte, len(fcl.Options))
+		}
+		for code, value := range fcl.Options {
+			class.Options[p.optionCode(fcl.Name, code)] = p.hex(fmt.Sprintf("class %s option %s", fcl.Name, code), value)
+		}
+		cfg.Classes = append(cfg.Classes, class)
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return cfg, nil
+}
+
+// fieldParser converts string fields, keeping the first error so a whole
+// file can be converted before checking.
+type fieldParser struct {
+	err error
+}
+
+func (p *fieldParser) fail(field, value string, err error) {
+	if p.err == nil {
+		p.err = fmt.Errorf("invalid %s %q: %w", field, value, err)
+	}
+}
+
+func (p *fieldParser) ip(field, value string) net.IP {
+	if value == "" {
+		return nil
+	}
+	ip := net.ParseIP(value).To4()
+	if ip == nil {
+		p.fail(field, value, fmt.Errorf("not an IPv4 address"))
+	}
+	return ip
+}
+
+func (p *fieldParser) mac(field, value string) net.HardwareAddr {
+	mac, err := net.ParseMAC(value)
+	if err != nil {
+		p.fail(field, value, err)
+	}
+	return mac
+}
+
+func (p *fieldParser) network(field, value string) net.IPNet {
+	if value == "" {
+		return net.IPNet{}
+	}
+	_, ipNet, err := net.ParseCIDR(value)
+	if err != nil {
+		p.fail(field, value, err)
+		return net.IPNet{}
+	}
+	return *ipNet
+}
+
+// networks accepts CIDRs and bare addresses, which exclude a single host.
+func (p *fieldParser) networks(field string, values []string) []net.IPNet {
+	var nets []net.IPNet
+	for _, value := range values {
+		if ip := net.ParseIP(value).To4(); ip != nil {
+			nets = append(nets, net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)})
+			continue
+		}
+		nets = append(nets, p.network(field, value))
+	}
+	return nets
+}
+
+func (p *fieldParser) duration(field, value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		p.fail(field, value, err)
+	}
+	return d
+}
+
+func (p *fieldParser) optionCode(class, value string) byte {
+	code, err := strconv.ParseUint(value, 10, 8)
+	if err != nil {
+		p.fail("class "+class+" option code", value, err)
+	}
+	return byte(code)
+}
+
+func (p *fieldParser) hex(field, value string) []byte {
+	b, err := hex.DecodeString(value)
+	if err != nil {
+		p.fail(field, value, err)
+	}
+	return b
+}
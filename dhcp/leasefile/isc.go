@@ -0,0 +1,404 @@
+package leasefile
+
+import (
+	"bufio"
+	"dhcp/store"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// iscTimeLayout is the UTC date format of dhcpd.leases, after the weekday.
+const iscTimeLayout = "2006/01/02 15:04:05"
+
+// ReadISC parses an ISC dhcpd.leases file. dhcpd appends a new lease block
+// on every change, so the last block for an address wins. Leases in the
+// free, backup and reset states hold nothing and are dropped.
+func ReadISC(r io.Reader) ([]*store.Lease, error) {
+	tokens, err := tokenize(r)
+	if err != nil {
+		return nil, err
+	}
+	p := &iscParser{tokens: tokens}
+	set := newLeaseSet()
+	for !p.done() {
+		if p.peek() != "lease" {
+			if err := p.skipStatement(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		p.next()
+		l, keep, err := p.lease()
+		if err != nil {
+			return nil, err
+		}
+		if keep {
+			set.put(l)
+		} else {
+			set.remove(l.IP)
+		}
+	}
+	return set.leases(), nil
+}
+
+// WriteISC writes leases as dhcpd.leases blocks. Offers are not leases in
+// dhcpd terms and are left out; declined addresses become abandoned.
+func WriteISC(w io.Writer, leases []*store.Lease) error {
+	bw := bufio.NewWriter(w)
+	for _, l := range leases {
+		state, ok := iscStates[l.State]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(bw, "lease %s {\n", l.IP)
+		if !l.Start.IsZero() {
+			fmt.Fprintf(bw, "  starts %s;\n", iscTime(l.Start))
+			fmt.Fprintf(bw, "  cltt %s;\n", iscTime(l.Start))
+		}
+		if l.Expiration.IsZero() {
+			fmt.Fprintf(bw, "  ends never;\n")
+		} else {
+			fmt.Fprintf(bw, "  ends %s;\n", iscTime(l.Expiration))
+		}
+		fmt.Fprintf(bw, "  binding state %s;\n", state)
+		if len(l.MAC) > 0 {
+			fmt.Fprintf(bw, "  hardware ethernet %s;\n", l.MAC)
+		}
+		if uid := explicitClientID(l); uid != nil {
+			fmt.Fprintf(bw, "  uid %s;\n", quote(uid))
+		}
+		if l.Hostname != "" {
+			fmt.Fprintf(bw, "  client-hostname %s;\n", quote([]byte(l.Hostname)))
+		}
+		fmt.Fprintf(bw, "}\n")
+	}
+	return bw.Flush()
+}
+
+var iscStates = map[store.LeaseState]string{
+	store.BOUND:     "active",
+	store.EXPIRED:   "expired",
+	store.RELEASED:  "released",
+	store.DECLINED:  "abandoned",
+	store.ABANDONED: "abandoned",
+}
+
+func iscTime(t time.Time) string {
+	t = t.UTC()
+	return fmt.Sprintf("%d %s", t.Weekday(), t.Format(iscTimeLayout))
+}
+
+type iscParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *iscParser) done() bool { return p.pos >= len(p.tokens) }
+
+func (p *iscParser) peek() string {
+	if p.done() {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *iscParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// statement returns the tokens up to the next ";". A nested block, such as
+// "on commit { ... }", is skipped and yields no tokens.
+func (p *iscParser) statement() ([]string, error) {
+	start := p.pos
+	for !p.done() {
+		switch p.next() {
+		case ";":
+			return p.tokens[start : p.pos-1], nil
+		case "{":
+			if err := p.skipBlock(); err != nil {
+				return nil, err
+			}
+			return nil, nil
+		case "}":
+			return nil, fmt.Errorf("unexpected '}'")
+		}
+	}
+	return nil, fmt.Errorf("unterminated statement %q", strings.Join(p.tokens[start:], " "))
+}
+
+func (p *iscParser) skipStatement() error {
+	_, err := p.statement()
+	return err
+}
+
+// skipBlock skips to the "}" closing a block whose "{" was just read.
+func (p *iscParser) skipBlock() error {
+	for depth := 1; depth > 0; {
+		if p.done() {
+			return fmt.Errorf("unterminated block")
+		}
+		switch p.next() {
+		case "{":
+			depth++
+		case "}":
+			depth--
+		}
+	}
+	return nil
+}
+
+// lease parses a lease block after the "lease" keyword. keep is false if
+// the final state means the address is free.
+func (p *iscParser) lease() (l *store.Lease, keep bool, err error) {
+	addr := p.next()
+	ip := net.ParseIP(addr).To4()
+	if ip == nil {
+		return nil, false, fmt.Errorf("invalid lease address %q", addr)
+	}
+	if p.next() != "{" {
+		return nil, false, fmt.Errorf("lease %s: expected '{'", addr)
+	}
+
+	l = &store.Lease{IP: ip, State: store.BOUND}
+	keep = true
+	var starts, cltt time.Time
+	for p.peek() != "}" {
+		if p.done() {
+			return nil, false, fmt.Errorf("lease %s: unterminated block", addr)
+		}
+		stmt, err := p.statement()
+		if err != nil {
+			return nil, false, fmt.Errorf("lease %s: %w", addr, err)
+		}
+		if len(stmt) == 0 {
+			continue
+		}
+		switch stmt[0] {
+		case "starts", "ends", "cltt":
+			t, err := parseISCTime(stmt[1:])
+			if err != nil {
+				return nil, false, fmt.Errorf("lease %s: %s: %w", addr, stmt[0], err)
+			}
+			switch stmt[0] {
+			case "starts":
+				starts = t
+			case "ends":
+				l.Expiration = t
+			case "cltt":
+				cltt = t
+			}
+		case "binding":
+			if len(stmt) != 3 || stmt[1] != "state" {
+				continue
+			}
+			switch stmt[2] {
+			case "active", "bootp":
+				l.State = store.BOUND
+			case "expired":
+				l.State = store.EXPIRED
+			case "released":
+				l.State = store.RELEASED
+			case "abandoned":
+				l.State = store.ABANDONED
+			default:
+				keep = false
+			}
+		case "hardware":
+			if len(stmt) != 3 {
+				return nil, false, fmt.Errorf("lease %s: malformed hardware statement", addr)
+			}
+			if l.MAC, err = parseHex(stmt[2]); err != nil {
+				return nil, false, fmt.Errorf("lease %s: hardware: %w", addr, err)
+			}
+		case "uid":
+			if len(stmt) != 2 {
+				return nil, false, fmt.Errorf("lease %s: malformed uid", addr)
+			}
+			if l.ClientID, err = parseData(stmt[1]); err != nil {
+				return nil, false, fmt.Errorf("lease %s: uid: %w", addr, err)
+			}
+		case "client-hostname":
+			if len(stmt) == 2 {
+				hostname, err := parseData(stmt[1])
+				if err != nil {
+					return nil, false, fmt.Errorf("lease %s: client-hostname: %w", addr, err)
+				}
+				l.Hostname = string(hostname)
+			}
+		}
+	}
+	p.next()
+
+	l.Start = cltt
+	if l.Start.IsZero() {
+		l.Start = starts
+	}
+	if l.ClientID == nil {
+		l.ClientID = defaultClientID(l.MAC)
+	}
+	return l, keep, nil
+}
+
+// parseISCTime parses "W YYYY/MM/DD HH:MM:SS", "epoch N" or "never",
+// which is returned as the zero time.
+func parseISCTime(fields []string) (time.Time, error) {
+	switch {
+	case len(fields) == 1 && fields[0] == "never":
+		return time.Time{}, nil
+	case len(fields) == 2 && fields[0] == "epoch":
+		secs, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(secs, 0), nil
+	case len(fields) == 3:
+		return time.ParseInLocation(iscTimeLayout, fields[1]+" "+fields[2], time.UTC)
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", strings.Join(fields, " "))
+}
+
+// parseData decodes a token that is either a quoted string or colon
+// separated hex octets.
+func parseData(token string) ([]byte, error) {
+	if strings.HasPrefix(token, `"`) {
+		return []byte(token[1:]), nil
+	}
+	return parseHex(token)
+}
+
+// quote formats b as a dhcpd string, escaping quotes, backslashes and
+// non-printable bytes in octal.
+func quote(b []byte) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, c := range b {
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&sb, "\\%03o", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// tokenize splits a dhcpd configuration-style file into words, braces and
+// semicolons. Quoted strings are returned unescaped with a leading '"' to
+// tell them apart from words; comments are dropped.
+func tokenize(r io.Reader) ([]string, error) {
+	br := bufio.NewReader(r)
+	var tokens []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			tokens = append(tokens, word.String())
+			word.Reset()
+		}
+	}
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			flush()
+			return tokens, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case c == '#':
+			flush()
+			if _, err := br.ReadString('\n'); err != nil && err != io.EOF {
+				return nil, err
+			}
+		case c == '"':
+			flush()
+			s, err := readQuoted(br)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, `"`+s)
+		case c == '{' || c == '}' || c == ';':
+			flush()
+			tokens = append(tokens, string(c))
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			flush()
+		default:
+			word.WriteByte(c)
+		}
+	}
+}
+
+func readQuoted(br *bufio.Reader) (string, error) {
+	var sb strings.Builder
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return "", fmt.Errorf("unterminated string")
+		}
+		switch c {
+		case '"':
+			return sb.String(), nil
+		case '\\':
+			c, err = br.ReadByte()
+			if err != nil {
+				return "", fmt.Errorf("unterminated string")
+			}
+			if c < '0' || c > '7' {
+				if c == 'n' {
+					c = '\n'
+				} else if c == 't' {
+					c = '\t'
+				}
+				sb.WriteByte(c)
+				continue
+			}
+			v := int(c - '0')
+			for i := 0; i < 2; i++ {
+				next, err := br.ReadByte()
+				if err != nil {
+					return "", fmt.Errorf("unterminated string")
+				}
+				if next < '0' || next > '7' {
+					br.UnreadByte()
+					break
+				}
+				v = v*8 + int(next-'0')
+			}
+			sb.WriteByte(byte(v))
+		default:
+			sb.WriteByte(c)
+		}
+	}
+}
+
+// parseHex decodes colon separated hex octets, where dhcpd may drop the
+// leading zero of an octet.
+func parseHex(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, ":")
+	b := make([]byte, len(parts))
+	for i, part := range parts {
+		if len(part) == 1 {
+			part = "0" + part
+		}
+		v, err := hex.DecodeString(part)
+		if err != nil || len(v) != 1 {
+			return nil, fmt.Errorf("invalid hex octet %q", parts[i])
+		}
+		b[i] = v[0]
+	}
+	return b, nil
+}
@@ -0,0 +1,182 @@
+package leasefile
+
+import (
+	"dhcp/store"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// keaColumns is the kea-leases4.csv header written by WriteKea. ReadKea
+// looks columns up by name, so files from older Kea versions with fewer
+// columns are read as well.
+var keaColumns = []string{
+	"address", "hwaddr", "client_id", "valid_lifetime", "expire", "subnet_id",
+	"fqdn_fwd", "fqdn_rev", "hostname", "state", "user_context", "pool_id",
+}
+
+// Kea lease states.
+const (
+	keaDefault          = 0
+	keaDeclined         = 1
+	keaExpiredReclaimed = 2
+	keaReleased         = 3
+)
+
+// keaInfinite is the valid lifetime Kea gives leases that never expire.
+const keaInfinite = 0xffffffff
+
+// ReadKea parses a Kea memfile kea-leases4.csv. The memfile is a log:
+// later rows for an address replace earlier ones, and a row with a zero
+// valid lifetime deletes the lease.
+func ReadKea(r io.Reader) ([]*store.Lease, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	col := make(map[string]int, len(header))
+	for i, name := range header {
+		col[strings.TrimSpace(name)] = i
+	}
+	for _, name := range []string{"address", "hwaddr", "client_id", "valid_lifetime", "expire"} {
+		if _, ok := col[name]; !ok {
+			return nil, fmt.Errorf("missing column %q", name)
+		}
+	}
+	field := func(row []string, name string) string {
+		if i, ok := col[name]; ok && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+
+	set := newLeaseSet()
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return set.leases(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		ip := net.ParseIP(field(row, "address")).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("line %d: invalid address %q", line, field(row, "address"))
+		}
+		lifetime, err := strconv.ParseUint(field(row, "valid_lifetime"), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid valid_lifetime: %w", line, err)
+		}
+		if lifetime == 0 {
+			set.remove(ip)
+			continue
+		}
+		expire, err := strconv.ParseInt(field(row, "expire"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expire: %w", line, err)
+		}
+
+		l := &store.Lease{
+			IP:         ip,
+			State:      store.BOUND,
+			Expiration: time.Unix(expire, 0),
+			Start:      time.Unix(expire-int64(lifetime), 0),
+			Hostname:   strings.ReplaceAll(field(row, "hostname"), "&#x2c", ","),
+		}
+		if lifetime == keaInfinite {
+			l.Expiration = time.Time{}
+		}
+		if l.MAC, err = parseHex(field(row, "hwaddr")); err != nil {
+			return nil, fmt.Errorf("line %d: hwaddr: %w", line, err)
+		}
+		if l.ClientID, err = parseHex(field(row, "client_id")); err != nil {
+			return nil, fmt.Errorf("line %d: client_id: %w", line, err)
+		}
+		if l.ClientID == nil {
+			l.ClientID = defaultClientID(l.MAC)
+		}
+		switch field(row, "state") {
+		case "", strconv.Itoa(keaDefault):
+		case strconv.Itoa(keaDeclined):
+			l.State = store.DECLINED
+		case strconv.Itoa(keaExpiredReclaimed):
+			l.State = store.EXPIRED
+		case strconv.Itoa(keaReleased):
+			l.State = store.RELEASED
+		default:
+			return nil, fmt.Errorf("line %d: unknown state %q", line, field(row, "state"))
+		}
+		set.put(l)
+	}
+}
+
+// WriteKea writes leases as a kea-leases4.csv memfile, all in subnetID.
+// Offers and abandoned addresses, which Kea does not persist, are left out.
+func WriteKea(w io.Writer, leases []*store.Lease, subnetID uint32) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(keaColumns); err != nil {
+		return err
+	}
+	for _, l := range leases {
+		var state int
+		switch l.State {
+		case store.BOUND:
+			state = keaDefault
+		case store.DECLINED:
+			state = keaDeclined
+		case store.EXPIRED:
+			state = keaExpiredReclaimed
+		case store.RELEASED:
+			state = keaReleased
+		default:
+			continue
+		}
+		// A zero lifetime would read back as a deletion.
+		lifetime := int64(l.Expiration.Sub(l.Start) / time.Second)
+		if l.Start.IsZero() || lifetime < 1 {
+			lifetime = 1
+		}
+		expire := l.Expiration.Unix()
+		if l.Expiration.IsZero() {
+			lifetime, expire = keaInfinite, keaInfinite
+			if !l.Start.IsZero() {
+				expire += l.Start.Unix()
+			}
+		}
+		err := cw.Write([]string{
+			l.IP.String(),
+			hexColon(l.MAC),
+			hexColon(explicitClientID(l)),
+			strconv.FormatInt(lifetime, 10),
+			strconv.FormatInt(expire, 10),
+			strconv.FormatUint(uint64(subnetID), 10),
+			"0",
+			"0",
+			strings.ReplaceAll(l.Hostname, ",", "&#x2c"),
+			strconv.Itoa(state),
+			"",
+			"0",
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func hexColon(b []byte) string {
+	parts := make([]string, len(b))
+	for i, c := range b {
+		parts[i] = hex.EncodeToString([]byte{c})
+	}
+	return strings.Join(parts, ":")
+}
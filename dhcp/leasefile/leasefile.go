@@ -0,0 +1,60 @@
+// Package leasefile converts between the server's leases and the lease
+// files of ISC dhcpd and Kea, for migrating clients without renumbering.
+package leasefile
+
+import (
+	"bytes"
+	"dhcp/store"
+	"net"
+)
+
+// defaultClientID is the identifier the server uses for clients that send
+// no client identifier option: hardware type 1 followed by the MAC.
+func defaultClientID(mac net.HardwareAddr) []byte {
+	if len(mac) == 0 {
+		return nil
+	}
+	return append([]byte{1}, mac...)
+}
+
+// explicitClientID returns the lease's client identifier, or nil if it is
+// only the default derived from the MAC and need not be written out.
+func explicitClientID(l *store.Lease) []byte {
+	if len(l.ClientID) == 0 || bytes.Equal(l.ClientID, defaultClientID(l.MAC)) {
+		return nil
+	}
+	return l.ClientID
+}
+
+// leaseSet keeps the latest lease per address in first-seen order.
+type leaseSet struct {
+	byIP  map[string]*store.Lease
+	order []string
+}
+
+func newLeaseSet() *leaseSet {
+	return &leaseSet{byIP: make(map[string]*store.Lease)}
+}
+
+func (s *leaseSet) put(l *store.Lease) {
+	key := string(l.IP.To4())
+	if _, exists := s.byIP[key]; !exists {
+		s.order = append(s.order, key)
+	}
+	s.byIP[key] = l
+}
+
+func (s *leaseSet) remove(ip net.IP) {
+	delete(s.byIP, string(ip.To4()))
+}
+
+func (s *leaseSet) leases() []*store.Lease {
+	leases := make([]*store.Lease, 0, len(s.byIP))
+	for _, key := range s.order {
+		if l, exists := s.byIP[key]; exists {
+			leases = append(leases, l)
+			delete(s.byIP, key)
+		}
+	}
+	return leases
+}
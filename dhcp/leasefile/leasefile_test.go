@@ -0,0 +1,190 @@
+package leasefile
+
+import (
+	"bytes"
+	"dhcp/store"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const iscLeases = `# The format of this file is documented in the dhcpd.leases(5) manual page.
+# This lease file was written by isc-dhcp-4.4.3
+
+authoring-byte-order little-endian;
+server-duid "\000\001\000\001,\340\026\242RT\000\022\0045";
+
+lease 192.168.1.10 {
+  starts 4 2024/01/11 10:00:00;
+  ends 4 2024/01/11 22:00:00;
+  cltt 4 2024/01/11 10:00:00;
+  binding state active;
+  next binding state free;
+  rewind binding state free;
+  hardware ethernet 00:11:22:33:44:55;
+  uid "\001\000\021\"3DU";
+  set vendor-class-identifier = "MSFT 5.0";
+  client-hostname "laptop";
+}
+lease 192.168.1.11 {
+  starts epoch 1704967200;
+  ends never;
+  binding state active;
+  hardware ethernet 0:aa:bb:c:dd:ee;
+  uid 01:00:aa:bb:0c:dd:ee;
+  on commit { set x = "}"; }
+}
+lease 192.168.1.12 {
+  starts 4 2024/01/11 10:00:00;
+  ends 4 2024/01/11 11:00:00;
+  binding state active;
+  hardware ethernet 00:00:00:00:00:12;
+}
+lease 192.168.1.12 {
+  starts 4 2024/01/11 11:00:00;
+  ends 4 2024/01/11 11:00:00;
+  binding state free;
+  hardware ethernet 00:00:00:00:00:12;
+}
+lease 192.168.1.13 {
+  ends 4 2024/01/11 11:00:00;
+  binding state abandoned;
+}
+failover peer "peer" state {
+  my state normal at 4 2024/01/11 09:00:00;
+}
+`
+
+func TestReadISC(t *testing.T) {
+	leases, err := ReadISC(strings.NewReader(iscLeases))
+	if err != nil {
+		t.Fatalf("ReadISC: %v", err)
+	}
+	if len(leases) != 3 {
+		t.Fatalf("read %d leases, want 3: %+v", len(leases), leases)
+	}
+
+	l := leases[0]
+	if !l.IP.Equal(net.ParseIP("192.168.1.10")) || l.State != store.BOUND || l.Hostname != "laptop" {
+		t.Errorf("lease 0 = %+v", l)
+	}
+	if want := []byte{1, 0, 0x11, '"', '3', 'D', 'U'}; !bytes.Equal(l.ClientID, want) {
+		t.Errorf("uid = %x, want %x", l.ClientID, want)
+	}
+	if want := time.Date(2024, 1, 11, 22, 0, 0, 0, time.UTC); !l.Expiration.Equal(want) {
+		t.Errorf("ends = %v, want %v", l.Expiration, want)
+	}
+	if want := time.Date(2024, 1, 11, 10, 0, 0, 0, time.UTC); !l.Start.Equal(want) {
+		t.Errorf("start = %v, want %v", l.Start, want)
+	}
+
+	l = leases[1]
+	if want := (net.HardwareAddr{0, 0xaa, 0xbb, 0x0c, 0xdd, 0xee}); !bytes.Equal(l.MAC, want) {
+		t.Errorf("hardware = %v, want %v", l.MAC, want)
+	}
+	if !l.Expiration.IsZero() || !l.Start.Equal(time.Unix(1704967200, 0)) {
+		t.Errorf("lease 1 times = %v - %v", l.Start, l.Expiration)
+	}
+
+	if l := leases[2]; !l.IP.Equal(net.ParseIP("192.168.1.13")) || l.State != store.ABANDONED {
+		t.Errorf("lease 2 = %+v, want abandoned 192.168.1.13", l)
+	}
+}
+
+func TestReadISCErrors(t *testing.T) {
+	for _, input := range []string{
+		"lease 192.168.1.300 { }",
+		"lease 192.168.1.1 { starts 4 2024/01/11;",
+		"lease 192.168.1.1 { hardware ethernet zz:11; }",
+		`lease 192.168.1.1 { uid "abc; }`,
+	} {
+		if _, err := ReadISC(strings.NewReader(input)); err == nil {
+			t.Errorf("ReadISC(%q) succeeded, want error", input)
+		}
+	}
+}
+
+const keaLeases = `address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,user_context,pool_id
+192.168.1.10,00:11:22:33:44:55,01:00:11:22:33:44:55,3600,1704970800,1,0,0,laptop&#x2c inc,0,,0
+192.168.1.11,00:11:22:33:44:66,ff:00:01,3600,1704970800,1,0,0,,0,,0
+192.168.1.12,00:11:22:33:44:77,,3600,1704970800,1,0,0,,1,,0
+192.168.1.11,00:11:22:33:44:66,ff:00:01,0,1704967200,1,0,0,,0,,0
+192.168.1.13,00:11:22:33:44:88,,3600,1704970800,1,0,0,,3,,0
+`
+
+func TestReadKea(t *testing.T) {
+	leases, err := ReadKea(strings.NewReader(keaLeases))
+	if err != nil {
+		t.Fatalf("ReadKea: %v", err)
+	}
+	if len(leases) != 3 {
+		t.Fatalf("read %d leases, want 3: %+v", len(leases), leases)
+	}
+	l := leases[0]
+	if l.Hostname != "laptop, inc" || l.State != store.BOUND || !l.Start.Equal(time.Unix(1704967200, 0)) {
+		t.Errorf("lease 0 = %+v", l)
+	}
+	if l := leases[1]; l.State != store.DECLINED || !bytes.Equal(l.ClientID, []byte{1, 0, 0x11, 0x22, 0x33, 0x44, 0x77}) {
+		t.Errorf("lease 1 = %+v, want declined with default client ID", l)
+	}
+	if l := leases[2]; l.State != store.RELEASED {
+		t.Errorf("lease 2 = %+v, want released", l)
+	}
+
+	if _, err := ReadKea(strings.NewReader("address,hwaddr\n")); err == nil {
+		t.Errorf("ReadKea without required columns succeeded")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	start := time.Unix(1704967200, 0)
+	leases := []*store.Lease{
+		{IP: net.IP{192, 168, 1, 10}, MAC: net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}, ClientID: []byte{0, 'i', 'd', '"', 0xff},
+			State: store.BOUND, Start: start, Expiration: start.Add(time.Hour), Hostname: `odd "name", here`},
+		{IP: net.IP{192, 168, 1, 11}, MAC: net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x66}, ClientID: []byte{1, 0, 0x11, 0x22, 0x33, 0x44, 0x66},
+			State: store.RELEASED, Start: start, Expiration: start.Add(2 * time.Hour)},
+		// A dynamic BOOTP lease never expires.
+		{IP: net.IP{192, 168, 1, 12}, MAC: net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x88}, ClientID: []byte{1, 0, 0x11, 0x22, 0x33, 0x44, 0x88},
+			State: store.BOUND, Start: start},
+		{IP: net.IP{192, 168, 1, 13}, MAC: net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x77}, ClientID: []byte{1, 0, 0x11, 0x22, 0x33, 0x44, 0x77},
+			State: store.OFFERED, Start: start, Expiration: start.Add(time.Minute)},
+	}
+
+	formats := map[string]struct {
+		write func(*bytes.Buffer) error
+		read  func(*bytes.Buffer) ([]*store.Lease, error)
+	}{
+		"isc": {
+			func(b *bytes.Buffer) error { return WriteISC(b, leases) },
+			func(b *bytes.Buffer) ([]*store.Lease, error) { return ReadISC(b) },
+		},
+		"kea": {
+			func(b *bytes.Buffer) error { return WriteKea(b, leases, 1) },
+			func(b *bytes.Buffer) ([]*store.Lease, error) { return ReadKea(b) },
+		},
+	}
+	for name, f := range formats {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := f.write(&buf); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			got, err := f.read(&buf)
+			if err != nil {
+				t.Fatalf("read: %v\n%s", err, buf.String())
+			}
+			// The offer is not written out.
+			if len(got) != 3 {
+				t.Fatalf("read back %d leases, want 3", len(got))
+			}
+			for i, l := range got {
+				want := leases[i]
+				if !l.IP.Equal(want.IP) || !bytes.Equal(l.MAC, want.MAC) || !bytes.Equal(l.ClientID, want.ClientID) ||
+					l.State != want.State || !l.Start.Equal(want.Start) || !l.Expiration.Equal(want.Expiration) || l.Hostname != want.Hostname {
+					t.Errorf("lease %d = %+v, want %+v", i, l, want)
+				}
+			}
+		})
+	}
+}
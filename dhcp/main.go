@@ -1,13 +1,125 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"dhcp/server"
+	"dhcp/store"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
+
+	_ "modernc.org/sqlite"
 )
 
 func main() {
-	config := server.Config{
+	configPath := flag.String("config", "", "JSON configuration file, re-read on SIGHUP")
+	storeKind := flag.String("store", "journal", `lease store: "journal" or "sql"`)
+	journalPath := flag.String("journal", "leases.journal", "lease journal file")
+	compactInterval := flag.Duration("compact-interval", time.Hour, "how often the lease journal is compacted, 0 to compact only as it grows")
+	sqlDriver := flag.String("sql-driver", "sqlite", "database/sql driver of the SQL lease store")
+	sqlDSN := flag.String("sql-dsn", "leases.db", "data source name of the SQL lease store")
+	var m migration
+	flag.StringVar(&m.importISC, "import-isc", "", "import leases from an ISC dhcpd.leases file, then exit")
+	flag.StringVar(&m.importKea, "import-kea", "", "import leases from a Kea kea-leases4.csv file, then exit")
+	flag.StringVar(&m.exportISC, "export-isc", "", "export leases to an ISC dhcpd.leases file, then exit")
+	flag.StringVar(&m.exportKea, "export-kea", "", "export leases to a Kea kea-leases4.csv file, then exit")
+	flag.UintVar(&m.keaSubnetID, "kea-subnet-id", 1, "subnet ID of exported Kea leases")
+	flag.Parse()
+
+	compactCtx, stopCompact := context.WithCancel(context.Background())
+	defer stopCompact()
+	var leases store.LeaseStore
+	switch *storeKind {
+	case "journal":
+		journal, err := store.OpenJournal(*journalPath)
+		if err != nil {
+			panic(err)
+		}
+		if *compactInterval > 0 {
+			go journal.CompactEvery(compactCtx, *compactInterval)
+		}
+		leases = journal
+	case "sql":
+		db, err := sql.Open(*sqlDriver, *sqlDSN)
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+		if leases, err = store.OpenSQL(db, *sqlDriver); err != nil {
+			panic(err)
+		}
+	default:
+		panic(fmt.Sprintf("unknown lease store %q", *storeKind))
+	}
+	defer leases.Close()
+
+	config := defaultConfig()
+	if *configPath != "" {
+		var err error
+		if config, err = loadConfig(*configPath); err != nil {
+			panic(err)
+		}
+	}
+	config.Store = leases
+	if m.requested() {
+		offline, err := server.NewOfflineServer(config)
+		if err != nil {
+			panic(err)
+		}
+		if err := m.run(offline); err != nil {
+			panic(err)
+		}
+		return
+	}
+	s, err := server.NewServer(config)
+	if err != nil {
+		panic(err)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go reloadOnSignal(s, *configPath, hup)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.Serve(context.Background())
+	}()
+
+	select {
+	case err := <-serveErr:
+		if err != nil {
+			panic(err)
+		}
+		return
+	case <-ctx.Done():
+		slog.Info("Received signal, stopping server")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Timed out waiting for the server to stop", "error", err)
+		return
+	}
+	if err := <-serveErr; err != nil {
+		slog.Error("Server stopped with error", "error", err)
+		return
+	}
+	slog.Info("Server stopped")
+}
+
+func defaultConfig() *server.Config {
+	return &server.Config{
 		Start:         net.IP{172, 20, 0, 10},
 		End:           net.IP{172, 20, 0, 20},
 		Subnet:        net.IPNet{IP: net.IP{172, 20, 0, 0}, Mask: net.IPMask{255, 255, 0, 0}},
@@ -19,9 +131,23 @@ func main() {
 		ServerIP:      net.IP{172, 20, 0, 2},
 		DomainName:    "DHCP TEST",
 	}
-	s, err := server.NewServer(&config)
-	if err != nil {
-		panic(err)
+}
+
+// reloadOnSignal re-reads the configuration file each time hup fires. A
+// file that fails to load or validate is logged and the running
+// configuration kept.
+func reloadOnSignal(s *server.Server, path string, hup <-chan os.Signal) {
+	for range hup {
+		if path == "" {
+			slog.Warn("Received SIGHUP but no configuration file was given")
+			continue
+		}
+		config, err := loadConfig(path)
+		if err == nil {
+			err = s.Reload(config)
+		}
+		if err != nil {
+			slog.Error("Failed to reload configuration", "path", path, "error", err)
+		}
 	}
-	s.Run()
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"dhcp/leasefile"
+	"dhcp/server"
+	"dhcp/store"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// migration names the lease files of another server to import, and the
+// files to export the leases to, when moving between servers.
+type migration struct {
+	importISC, importKea string
+	exportISC, exportKea string
+	// keaSubnetID is the subnet ID written to exported Kea leases.
+	keaSubnetID uint
+}
+
+func (m *migration) requested() bool {
+	return m.importISC != "" || m.importKea != "" || m.exportISC != "" || m.exportKea != ""
+}
+
+// run imports the lease files into s, which persists them to its store,
+// and then exports every lease s holds. Leases the server cannot take are
+// logged and skipped.
+func (m *migration) run(s *server.Server) error {
+	imports := []struct {
+		path string
+		read func(io.Reader) ([]*store.Lease, error)
+	}{
+		{m.importISC, leasefile.ReadISC},
+		{m.importKea, leasefile.ReadKea},
+	}
+	for _, imp := range imports {
+		if imp.path == "" {
+			continue
+		}
+		leases, err := readLeaseFile(imp.path, imp.read)
+		if err != nil {
+			return err
+		}
+		n, err := s.ImportLeases(leases, time.Now())
+		if err != nil {
+			slog.Warn("Skipped leases during import", "path", imp.path, "error", err)
+		}
+		slog.Info("Imported leases", "path", imp.path, "imported", n, "read", len(leases))
+	}
+
+	exports := []struct {
+		path  string
+		write func(io.Writer, []*store.Lease) error
+	}{
+		{m.exportISC, leasefile.WriteISC},
+		{m.exportKea, func(w io.Writer, leases []*store.Lease) error {
+			return leasefile.WriteKea(w, leases, uint32(m.keaSubnetID))
+		}},
+	}
+	for _, exp := range exports {
+		if exp.path == "" {
+			continue
+		}
+		leases := s.Leases()
+		if err := writeLeaseFile(exp.path, leases, exp.write); err != nil {
+			return err
+		}
+		slog.Info("Exported leases", "path", exp.path, "count", len(leases))
+	}
+	return nil
+}
+
+func readLeaseFile(path string, read func(io.Reader) ([]*store.Lease, error)) ([]*store.Lease, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	leases, err := read(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return leases, nil
+}
+
+func writeLeaseFile(path string, leases []*store.Lease, write func(io.Writer, []*store.Lease) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := write(w, leases); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return f.Close()
+}
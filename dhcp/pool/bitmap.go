@@ -0,0 +1,116 @@
+package pool
+
+import "math/bits"
+
+// bitmap tracks used offsets with one bit per address, plus a summary with
+// one bit per word that is set when the word is full, so finding a free
+// offset skips 4096 used addresses per summary word.
+type bitmap struct {
+	size    uint32
+	words   []uint64
+	full    []uint64
+	used    uint32
+	lastLen uint32 // valid bits in the last word
+	hint    uint32 // every word before hint is full
+}
+
+func newBitmap(size uint32) *bitmap {
+	nwords := (size + 63) / 64
+	b := &bitmap{
+		size:    size,
+		words:   make([]uint64, nwords),
+		full:    make([]uint64, (nwords+63)/64),
+		lastLen: size % 64,
+	}
+	if b.lastLen != 0 {
+		// Bits past the end are permanently set so the word can fill up.
+		b.words[nwords-1] = ^uint64(0) << b.lastLen
+	}
+	return b
+}
+
+func (b *bitmap) isSet(i uint32) bool {
+	return b.words[i/64]&(1<<(i%64)) != 0
+}
+
+func (b *bitmap) set(i uint32) bool {
+	w := i / 64
+	mask := uint64(1) << (i % 64)
+	if b.words[w]&mask != 0 {
+		return false
+	}
+	b.words[w] |= mask
+	b.used++
+	if b.words[w] == ^uint64(0) {
+		b.full[w/64] |= 1 << (w % 64)
+		for b.hint < uint32(len(b.words)) && b.words[b.hint] == ^uint64(0) {
+			b.hint++
+		}
+	}
+	return true
+}
+
+func (b *bitmap) clear(i uint32) bool {
+	w := i / 64
+	mask := uint64(1) << (i % 64)
+	if b.words[w]&mask == 0 {
+		return false
+	}
+	b.words[w] &^= mask
+	b.used--
+	b.full[w/64] &^= 1 << (w % 64)
+	if w < b.hint {
+		b.hint = w
+	}
+	return true
+}
+
+func (b *bitmap) Size() uint32 {
+	return b.size
+}
+
+// NextFree returns the first clear offset at or after start, wrapping
+// around to the beginning.
+func (b *bitmap) NextFree(start uint32) (uint32, bool) {
+	if b.used == b.size {
+		return 0, false
+	}
+	if start >= b.size {
+		start = 0
+	}
+	if start < b.hint*64 {
+		start = b.hint * 64
+	}
+	w := start / 64
+	if free := ^b.words[w] &^ (1<<(start%64) - 1); free != 0 {
+		return w*64 + uint32(bits.TrailingZeros64(free)), true
+	}
+	nwords := uint32(len(b.words))
+	if next := b.nextNonFullWord(w + 1); next < nwords {
+		return next*64 + uint32(bits.TrailingZeros64(^b.words[next])), true
+	}
+	// Wrap around; the word containing start may have free bits before it.
+	if next := b.nextNonFullWord(0); next < nwords {
+		return next*64 + uint32(bits.TrailingZeros64(^b.words[next])), true
+	}
+	return 0, false
+}
+
+// nextNonFullWord returns the index of the first word at or after w with a
+// clear bit, or len(b.words) if there is none.
+func (b *bitmap) nextNonFullWord(w uint32) uint32 {
+	return b.scanSummary(max(w, b.hint))
+}
+
+func (b *bitmap) scanSummary(w uint32) uint32 {
+	nwords := uint32(len(b.words))
+	for w < nwords {
+		s := w / 64
+		notFull := ^b.full[s] &^ (1<<(w%64) - 1)
+		if notFull != 0 {
+			return min(s*64+uint32(bits.TrailingZeros64(notFull)), nwords)
+		}
+		w = (s + 1) * 64
+	}
+	return nwords
+}
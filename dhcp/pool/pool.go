@@ -1,58 +1,227 @@
 package pool
 
 import (
+	"cmp"
+	"encoding/binary"
 	"fmt"
 	"net"
+	"slices"
+	"sort"
 	"sync"
 )
 
+// maxPoolSize bounds a pool to a /1 worth of addresses so sizes fit in a
+// uint32.
+const maxPoolSize = 1 << 31
+
+// Range is an inclusive range of IPv4 addresses.
+type Range struct {
+	Start net.IP
+	End   net.IP
+}
+
+// span is a range of the pool; base is the bitmap offset of start.
+type span struct {
+	start, end, base uint32
+}
+
 type IPPool struct {
-	start     uint32
-	end       uint32
-	available []uint32
-	m         sync.Mutex
+	spans    []span
+	excluded []span // sorted, non-overlapping; base unused
+	nexclude uint32 // excluded addresses inside spans
+	used     *bitmap
+	strategy Strategy
+	m        sync.Mutex
 }
 
 func NewIPPool(start, end net.IP) (*IPPool, error) {
-	startInt := ip4ToUint32(start)
-	endInt := ip4ToUint32(end)
-	if startInt > endInt {
-		return nil, fmt.Errorf("invalid IP range")
+	return New([]Range{{Start: start, End: end}}, nil)
+}
+
+// New creates a pool serving the given ranges, which must not overlap.
+// Addresses inside exclude are never handed out.
+func New(ranges []Range, exclude []*net.IPNet) (*IPPool, error) {
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("pool needs at least one IP range")
+	}
+	spans := make([]span, 0, len(ranges))
+	for _, r := range ranges {
+		if r.Start.To4() == nil || r.End.To4() == nil {
+			return nil, fmt.Errorf("IP range must be IPv4")
+		}
+		startInt, endInt := ip4ToUint32(r.Start), ip4ToUint32(r.End)
+		if startInt > endInt {
+			return nil, fmt.Errorf("invalid IP range %s-%s", r.Start, r.End)
+		}
+		spans = append(spans, span{start: startInt, end: endInt})
+	}
+	slices.SortFunc(spans, func(a, b span) int { return cmp.Compare(a.start, b.start) })
+
+	var size uint64
+	for i := range spans {
+		if i > 0 && spans[i].start <= spans[i-1].end {
+			return nil, fmt.Errorf("IP ranges %s-%s and %s-%s overlap",
+				uint32ToIP4(spans[i-1].start), uint32ToIP4(spans[i-1].end),
+				uint32ToIP4(spans[i].start), uint32ToIP4(spans[i].end))
+		}
+		spans[i].base = uint32(size)
+		size += uint64(spans[i].end) - uint64(spans[i].start) + 1
+		if size > maxPoolSize {
+			return nil, fmt.Errorf("IP range too large")
+		}
 	}
 
 	pool := &IPPool{
-		start:     startInt,
-		end:       endInt,
-		available: make([]uint32, 0, endInt-startInt+1),
+		spans:    spans,
+		excluded: mergeExclusions(exclude),
+		used:     newBitmap(uint32(size)),
+		strategy: Sequential{},
 	}
+	for _, ex := range pool.excluded {
+		for _, sp := range spans {
+			lo, hi := max(ex.start, sp.start), min(ex.end, sp.end)
+			for ip := uint64(lo); ip <= uint64(hi); ip++ {
+				pool.used.set(sp.base + uint32(ip) - sp.start)
+				pool.nexclude++
+			}
+		}
+	}
+	return pool, nil
+}
 
-	for ip := startInt; ip <= endInt; ip++ {
-		pool.available = append(pool.available, ip)
+func mergeExclusions(exclude []*net.IPNet) []span {
+	var spans []span
+	for _, n := range exclude {
+		ip := n.IP.To4()
+		if ip == nil || len(n.Mask) != net.IPv4len {
+			continue
+		}
+		start := ip4ToUint32(ip) & binary.BigEndian.Uint32(n.Mask)
+		spans = append(spans, span{start: start, end: start | ^binary.BigEndian.Uint32(n.Mask)})
 	}
+	slices.SortFunc(spans, func(a, b span) int { return cmp.Compare(a.start, b.start) })
+	merged := spans[:0]
+	for _, sp := range spans {
+		if n := len(merged); n > 0 && uint64(sp.start) <= uint64(merged[n-1].end)+1 {
+			merged[n-1].end = max(merged[n-1].end, sp.end)
+			continue
+		}
+		merged = append(merged, sp)
+	}
+	return merged
+}
 
-	return pool, nil
+// Ranges returns the ranges served by the pool, including excluded
+// addresses.
+func (p *IPPool) Ranges() []Range {
+	ranges := make([]Range, len(p.spans))
+	for i, sp := range p.spans {
+		ranges[i] = Range{Start: uint32ToIP4(sp.start), End: uint32ToIP4(sp.end)}
+	}
+	return ranges
 }
 
-func (p *IPPool) Allocate() net.IP {
-	if len(p.available) == 0 {
-		return nil
+// offset returns the bitmap offset of ip, or false if ip is not served by
+// the pool.
+func (p *IPPool) offset(ip net.IP) (uint32, bool) {
+	if ip.To4() == nil {
+		return 0, false
+	}
+	ipInt := ip4ToUint32(ip)
+	i := sort.Search(len(p.spans), func(i int) bool { return p.spans[i].end >= ipInt })
+	if i == len(p.spans) || ipInt < p.spans[i].start || p.isExcluded(ipInt) {
+		return 0, false
 	}
+	return p.spans[i].base + ipInt - p.spans[i].start, true
+}
+
+func (p *IPPool) isExcluded(ipInt uint32) bool {
+	i := sort.Search(len(p.excluded), func(i int) bool { return p.excluded[i].end >= ipInt })
+	return i < len(p.excluded) && ipInt >= p.excluded[i].start
+}
+
+func (p *IPPool) ipAt(offset uint32) net.IP {
+	i := sort.Search(len(p.spans), func(i int) bool { return p.spans[i].base > offset }) - 1
+	return uint32ToIP4(p.spans[i].start + offset - p.spans[i].base)
+}
+
+// SetStrategy changes how Allocate chooses among free addresses.
+func (p *IPPool) SetStrategy(s Strategy) {
 	p.m.Lock()
-	ip := p.available[0]
-	p.available = p.available[1:]
+	p.strategy = s
 	p.m.Unlock()
-	return uint32ToIP4(ip)
+}
+
+// Allocate takes a free address chosen by the pool's strategy for the
+// client identified by clientID, or returns nil if the pool is exhausted.
+func (p *IPPool) Allocate(clientID []byte) net.IP {
+	p.m.Lock()
+	defer p.m.Unlock()
+	offset, ok := p.strategy.Select(p.used, clientID)
+	if !ok || !p.used.set(offset) {
+		return nil
+	}
+	return p.ipAt(offset)
+}
+
+// AllocateIP takes ip out of the pool if it is free and reports whether it
+// did.
+func (p *IPPool) AllocateIP(ip net.IP) bool {
+	offset, ok := p.offset(ip)
+	if !ok {
+		return false
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.used.set(offset)
+}
+
+// Contains reports whether ip is served by the pool. Excluded addresses
+// are not.
+func (p *IPPool) Contains(ip net.IP) bool {
+	_, ok := p.offset(ip)
+	return ok
+}
+
+// InUse reports whether ip belongs to the pool and is allocated.
+func (p *IPPool) InUse(ip net.IP) bool {
+	offset, ok := p.offset(ip)
+	if !ok {
+		return false
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.used.isSet(offset)
 }
 
 func (p *IPPool) Release(ip net.IP) {
-	ipInt := ip4ToUint32(ip)
-	if ipInt >= p.start && ipInt <= p.end {
+	if offset, ok := p.offset(ip); ok {
 		p.m.Lock()
-		p.available = append(p.available, ipInt)
+		p.used.clear(offset)
 		p.m.Unlock()
 	}
 }
 
+// Size returns the number of addresses the pool can hand out.
+func (p *IPPool) Size() int {
+	return int(p.used.size - p.nexclude)
+}
+
+// Used returns the number of allocated addresses.
+func (p *IPPool) Used() int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return int(p.used.used - p.nexclude)
+}
+
+// Utilization returns the allocated fraction of the pool.
+func (p *IPPool) Utilization() float64 {
+	if p.Size() == 0 {
+		return 1
+	}
+	return float64(p.Used()) / float64(p.Size())
+}
+
 func ip4ToUint32(ip net.IP) uint32 {
 	ip = ip.To4()
 	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
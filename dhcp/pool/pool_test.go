@@ -0,0 +1,255 @@
+package pool
+
+import (
+	"net"
+	"testing"
+)
+
+func newTestPool(t *testing.T, start, end string, s Strategy) *IPPool {
+	t.Helper()
+	p, err := NewIPPool(net.ParseIP(start), net.ParseIP(end))
+	if err != nil {
+		t.Fatalf("NewIPPool: %v", err)
+	}
+	p.SetStrategy(s)
+	return p
+}
+
+func TestSequentialReturnsLowestFree(t *testing.T) {
+	p := newTestPool(t, "10.0.0.1", "10.0.0.4", Sequential{})
+	for _, want := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if got := p.Allocate(nil); !got.Equal(net.ParseIP(want)) {
+			t.Fatalf("Allocate = %v, want %v", got, want)
+		}
+	}
+	p.Release(net.ParseIP("10.0.0.2"))
+	if got := p.Allocate(nil); !got.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("Allocate after release = %v, want 10.0.0.2", got)
+	}
+}
+
+func TestHashIsStableAcrossPools(t *testing.T) {
+	client := []byte{1, 0xde, 0xad, 0xbe, 0xef, 0, 1}
+	a := newTestPool(t, "10.0.0.0", "10.0.0.255", Hash{})
+	b := newTestPool(t, "10.0.0.0", "10.0.0.255", Hash{})
+	b.Allocate([]byte("someone else"))
+
+	first, second := a.Allocate(client), b.Allocate(client)
+	if !first.Equal(second) {
+		t.Errorf("hash strategy gave %v and %v for the same client", first, second)
+	}
+
+	// When the preferred address is taken, the next free one is used.
+	c := newTestPool(t, "10.0.0.0", "10.0.0.255", Hash{})
+	c.AllocateIP(first)
+	if got := c.Allocate(client); got == nil || got.Equal(first) {
+		t.Errorf("hash strategy gave %v, want another free address", got)
+	}
+}
+
+func TestStrategiesExhaustPool(t *testing.T) {
+	for _, name := range []string{"sequential", "random", "hash"} {
+		t.Run(name, func(t *testing.T) {
+			s, err := StrategyByName(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := newTestPool(t, "192.168.0.10", "192.168.0.19", s)
+			seen := make(map[string]bool)
+			for i := 0; i < 10; i++ {
+				ip := p.Allocate([]byte{byte(i)})
+				if ip == nil || seen[ip.String()] || !p.Contains(ip) {
+					t.Fatalf("allocation %d returned %v", i, ip)
+				}
+				seen[ip.String()] = true
+			}
+			if ip := p.Allocate([]byte{42}); ip != nil {
+				t.Errorf("exhausted pool returned %v", ip)
+			}
+		})
+	}
+}
+
+func TestStrategyByNameRejectsUnknown(t *testing.T) {
+	if _, err := StrategyByName("round-robin"); err == nil {
+		t.Error("expected error for unknown strategy")
+	}
+}
+
+func TestBitmapNextFree(t *testing.T) {
+	b := newBitmap(5000)
+	for i := uint32(0); i < 5000; i++ {
+		if i != 70 && i != 4999 {
+			b.set(i)
+		}
+	}
+	testCases := []struct {
+		start, want uint32
+	}{
+		{0, 70},
+		{70, 70},
+		{71, 4999},
+		{4999, 4999},
+		{6000, 70},
+	}
+	for _, tc := range testCases {
+		if got, ok := b.NextFree(tc.start); !ok || got != tc.want {
+			t.Errorf("NextFree(%d) = %d, %v; want %d", tc.start, got, ok, tc.want)
+		}
+	}
+
+	b.set(70)
+	b.set(4999)
+	if _, ok := b.NextFree(0); ok {
+		t.Error("expected full bitmap to have no free offset")
+	}
+	b.clear(4096)
+	if got, ok := b.NextFree(4097); !ok || got != 4096 {
+		t.Errorf("NextFree wrapped to %d, %v; want 4096", got, ok)
+	}
+}
+
+func TestPoolAccounting(t *testing.T) {
+	p := newTestPool(t, "10.0.0.0", "10.0.3.255", Sequential{})
+	if p.Size() != 1024 {
+		t.Fatalf("Size = %d, want 1024", p.Size())
+	}
+	for i := 0; i < 256; i++ {
+		p.Allocate(nil)
+	}
+	if !p.InUse(net.ParseIP("10.0.0.255")) || p.InUse(net.ParseIP("10.0.1.0")) {
+		t.Error("InUse disagrees with allocations")
+	}
+	if p.InUse(net.ParseIP("10.0.4.0")) || p.Contains(net.ParseIP("10.0.4.0")) {
+		t.Error("address outside the range reported as member")
+	}
+	if p.AllocateIP(net.ParseIP("10.0.0.7")) {
+		t.Error("AllocateIP succeeded for a used address")
+	}
+	p.Release(net.ParseIP("10.0.0.7"))
+	p.Release(net.ParseIP("10.0.0.7"))
+	if got := p.Used(); got != 255 {
+		t.Errorf("Used = %d, want 255", got)
+	}
+	if got := p.Utilization(); got != 255.0/1024 {
+		t.Errorf("Utilization = %v", got)
+	}
+}
+
+func TestNewIPPoolRejectsInvalidRanges(t *testing.T) {
+	if _, err := NewIPPool(net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.1")); err == nil {
+		t.Error("expected error for reversed range")
+	}
+	if _, err := NewIPPool(net.ParseIP("::1"), net.ParseIP("::2")); err == nil {
+		t.Error("expected error for IPv6 range")
+	}
+}
+
+func benchmarkAllocateRelease(b *testing.B, size uint32, s Strategy) {
+	start := uint32(10 << 24)
+	p, err := NewIPPool(uint32ToIP4(start), uint32ToIP4(start+size-1))
+	if err != nil {
+		b.Fatal(err)
+	}
+	p.SetStrategy(s)
+	// Fill 90% of the pool so allocations have to search.
+	for i := uint32(0); i < size/10*9; i++ {
+		p.used.set(i)
+	}
+	clientID := make([]byte, 7)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		clientID[6] = byte(i)
+		ip := p.Allocate(clientID)
+		if ip == nil {
+			b.Fatal("pool exhausted")
+		}
+		p.Release(ip)
+	}
+}
+
+func BenchmarkAllocateRelease256(b *testing.B) {
+	benchmarkAllocateRelease(b, 256, Sequential{})
+}
+
+func BenchmarkAllocateRelease65k(b *testing.B) {
+	benchmarkAllocateRelease(b, 1<<16, Sequential{})
+}
+
+func BenchmarkAllocateRelease16M(b *testing.B) {
+	benchmarkAllocateRelease(b, 1<<24, Sequential{})
+}
+
+func BenchmarkAllocateRelease16MRandom(b *testing.B) {
+	benchmarkAllocateRelease(b, 1<<24, Random{})
+}
+
+func BenchmarkAllocateRelease16MHash(b *testing.B) {
+	benchmarkAllocateRelease(b, 1<<24, Hash{})
+}
+
+func BenchmarkNewIPPool16M(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := NewIPPool(net.IP{10, 0, 0, 0}, net.IP{10, 255, 255, 255}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestMultipleRangesAndExclusions(t *testing.T) {
+	p, err := New([]Range{
+		{Start: net.ParseIP("10.0.0.150"), End: net.ParseIP("10.0.0.153")},
+		{Start: net.ParseIP("10.0.0.10"), End: net.ParseIP("10.0.0.13")},
+	}, []*net.IPNet{
+		mustCIDR(t, "10.0.0.11/32"),
+		mustCIDR(t, "10.0.0.152/31"),
+		mustCIDR(t, "10.0.0.200/32"),
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if p.Size() != 5 {
+		t.Errorf("Size = %d, want 5", p.Size())
+	}
+	if p.Contains(net.ParseIP("10.0.0.11")) || p.AllocateIP(net.ParseIP("10.0.0.153")) {
+		t.Error("excluded address treated as part of the pool")
+	}
+
+	var got []string
+	for ip := p.Allocate(nil); ip != nil; ip = p.Allocate(nil) {
+		got = append(got, ip.String())
+	}
+	want := []string{"10.0.0.10", "10.0.0.12", "10.0.0.13", "10.0.0.150", "10.0.0.151"}
+	if len(got) != len(want) {
+		t.Fatalf("allocated %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("allocated %v, want %v", got, want)
+		}
+	}
+
+	p.Release(net.ParseIP("10.0.0.11"))
+	if p.Used() != 5 || p.Allocate(nil) != nil {
+		t.Error("releasing an excluded address made it allocatable")
+	}
+}
+
+func TestNewRejectsOverlappingRanges(t *testing.T) {
+	_, err := New([]Range{
+		{Start: net.ParseIP("10.0.0.10"), End: net.ParseIP("10.0.0.99")},
+		{Start: net.ParseIP("10.0.0.99"), End: net.ParseIP("10.0.0.120")},
+	}, nil)
+	if err == nil {
+		t.Error("expected error for overlapping ranges")
+	}
+}
@@ -0,0 +1,66 @@
+package pool
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+)
+
+// Strategy chooses which free address a pool hands out next. Addresses are
+// identified by their offset from the start of the pool.
+type Strategy interface {
+	// Select returns the offset of a free address for the client
+	// identified by clientID, or false if none is free.
+	Select(free FreeSet, clientID []byte) (uint32, bool)
+}
+
+// FreeSet is the view of a pool's free addresses given to a Strategy.
+type FreeSet interface {
+	// Size is the number of addresses in the pool.
+	Size() uint32
+	// NextFree returns the first free offset at or after start, wrapping
+	// around, or false if the pool is exhausted.
+	NextFree(start uint32) (uint32, bool)
+}
+
+// Sequential hands out the lowest free address.
+type Sequential struct{}
+
+func (Sequential) Select(free FreeSet, _ []byte) (uint32, bool) {
+	return free.NextFree(0)
+}
+
+// Random hands out the first free address at or after a uniformly chosen
+// offset, which makes addresses harder to predict and spreads reuse of
+// released addresses. The choice is not uniform among free addresses: one
+// that follows a run of used addresses is picked more often.
+type Random struct{}
+
+func (Random) Select(free FreeSet, _ []byte) (uint32, bool) {
+	return free.NextFree(rand.Uint32N(free.Size()))
+}
+
+// Hash maps each client identifier to a fixed preferred address, so a
+// client gets the same address across server restarts without any
+// persisted state. Collisions fall through to the next free address.
+type Hash struct{}
+
+func (Hash) Select(free FreeSet, clientID []byte) (uint32, bool) {
+	h := fnv.New64a()
+	h.Write(clientID)
+	return free.NextFree(uint32(h.Sum64() % uint64(free.Size())))
+}
+
+// StrategyByName returns the strategy called name: "sequential" (the
+// default for an empty name), "random" or "hash".
+func StrategyByName(name string) (Strategy, error) {
+	switch name {
+	case "", "sequential":
+		return Sequential{}, nil
+	case "random":
+		return Random{}, nil
+	case "hash":
+		return Hash{}, nil
+	}
+	return nil, fmt.Errorf("unknown allocation strategy %q", name)
+}
@@ -0,0 +1,46 @@
+package probe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+)
+
+const (
+	arpRequestOp = 1
+	arpReplyOp   = 2
+)
+
+// arpRequest builds an Ethernet frame carrying an ARP probe for ip.
+func arpRequest(src net.HardwareAddr, ip net.IP) []byte {
+	frame := make([]byte, 42)
+	copy(frame[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	copy(frame[6:12], src)
+	binary.BigEndian.PutUint16(frame[12:], 0x0806)
+
+	arp := frame[14:]
+	binary.BigEndian.PutUint16(arp[0:], 1)      // Ethernet
+	binary.BigEndian.PutUint16(arp[2:], 0x0800) // IPv4
+	arp[4], arp[5] = 6, 4
+	binary.BigEndian.PutUint16(arp[6:], arpRequestOp)
+	copy(arp[8:14], src)
+	// Sender protocol address stays 0.0.0.0 and target hardware address
+	// stays zero, as RFC 5227 requires for probes.
+	copy(arp[24:28], ip.To4())
+	return frame
+}
+
+// claimsAddress reports whether frame is an ARP packet sent by a host
+// claiming ip. Requests count too: a host probing or announcing the same
+// address is a conflict as well.
+func claimsAddress(frame []byte, ip net.IP) bool {
+	if len(frame) < 42 || binary.BigEndian.Uint16(frame[12:]) != 0x0806 {
+		return false
+	}
+	arp := frame[14:]
+	op := binary.BigEndian.Uint16(arp[6:])
+	if op != arpReplyOp && op != arpRequestOp {
+		return false
+	}
+	return bytes.Equal(arp[14:18], ip.To4())
+}
@@ -0,0 +1,80 @@
+//go:build linux
+
+package probe
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+const ethPARP = 0x0806
+
+// ARP probes an address on a directly attached link with an RFC 5227 ARP
+// probe (sender protocol address 0.0.0.0), so the probe itself does not
+// pollute neighbor caches.
+type ARP struct {
+	Interface *net.Interface
+}
+
+func NewARP(ifaceName string) (*ARP, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("could not get interface: %w", err)
+	}
+	return &ARP{Interface: iface}, nil
+}
+
+func (a *ARP) Probe(ctx context.Context, ip net.IP) (bool, error) {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(ethPARP)))
+	if err != nil {
+		return false, fmt.Errorf("failed to create ARP socket: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	addr := &syscall.SockaddrLinklayer{
+		Protocol: htons(ethPARP),
+		Ifindex:  a.Interface.Index,
+		Halen:    6,
+		Addr:     [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+	if err := syscall.Bind(fd, addr); err != nil {
+		return false, fmt.Errorf("failed to bind ARP socket: %w", err)
+	}
+	if err := syscall.Sendto(fd, arpRequest(a.Interface.HardwareAddr, ip), 0, addr); err != nil {
+		return false, fmt.Errorf("failed to send ARP probe: %w", err)
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Second)
+	}
+	buf := make([]byte, 128)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 || ctx.Err() != nil {
+			return false, nil
+		}
+		// Wake up periodically so cancellation is noticed.
+		tv := syscall.NsecToTimeval(min(remaining, 100*time.Millisecond).Nanoseconds())
+		if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+			return false, err
+		}
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if claimsAddress(buf[:n], ip) {
+			return true, nil
+		}
+	}
+}
+
+func htons(host uint16) uint16 {
+	return (host&0xff)<<8 | (host >> 8)
+}
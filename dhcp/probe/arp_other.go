@@ -0,0 +1,22 @@
+//go:build !linux
+
+package probe
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// ARP probing needs AF_PACKET sockets and is only supported on Linux.
+type ARP struct {
+	Interface *net.Interface
+}
+
+func NewARP(ifaceName string) (*ARP, error) {
+	return nil, errors.New("ARP probing is only supported on Linux")
+}
+
+func (a *ARP) Probe(ctx context.Context, ip net.IP) (bool, error) {
+	return false, errors.New("ARP probing is only supported on Linux")
+}
@@ -0,0 +1,94 @@
+package probe
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	icmpEchoReply   = 0
+	icmpEchoRequest = 8
+	ipv4HeaderLen   = 20
+)
+
+var icmpSeq atomic.Uint32
+
+// ICMP probes an address with an ICMP echo request. It needs a raw socket,
+// so the process must run as root or with CAP_NET_RAW.
+type ICMP struct{}
+
+func (ICMP) Probe(ctx context.Context, ip net.IP) (bool, error) {
+	conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return false, fmt.Errorf("failed to open ICMP socket: %w", err)
+	}
+	defer conn.Close()
+
+	id := uint16(os.Getpid())
+	seq := uint16(icmpSeq.Add(1))
+	if _, err := conn.WriteTo(echoRequest(id, seq), &net.IPAddr{IP: ip}); err != nil {
+		return false, fmt.Errorf("failed to send echo request: %w", err)
+	}
+
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetReadDeadline(time.Now()) })
+	defer stop()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetReadDeadline(deadline)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() || ctx.Err() != nil {
+				return false, nil
+			}
+			return false, err
+		}
+		addr, ok := from.(*net.IPAddr)
+		if ok && addr.IP.Equal(ip) && isEchoReply(buf[:n], id, seq) {
+			return true, nil
+		}
+	}
+}
+
+func echoRequest(id, seq uint16) []byte {
+	msg := make([]byte, 16)
+	msg[0] = icmpEchoRequest
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	copy(msg[8:], "dhcpprob")
+	binary.BigEndian.PutUint16(msg[2:], checksum(msg))
+	return msg
+}
+
+// isEchoReply reports whether msg is the reply to our request. Raw IPv4
+// sockets may deliver the IP header in front of the ICMP message.
+func isEchoReply(msg []byte, id, seq uint16) bool {
+	if len(msg) >= ipv4HeaderLen && msg[0]>>4 == 4 {
+		msg = msg[int(msg[0]&0x0f)*4:]
+	}
+	return len(msg) >= 8 && msg[0] == icmpEchoReply &&
+		binary.BigEndian.Uint16(msg[4:]) == id && binary.BigEndian.Uint16(msg[6:]) == seq
+}
+
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,23 @@
+// Package probe checks whether an address is already in use before the
+// server offers it, using ARP on the local link or ICMP echo for relayed
+// subnets.
+package probe
+
+import (
+	"context"
+	"net"
+)
+
+// Prober reports whether some host already answers on an address.
+type Prober interface {
+	// Probe returns true if ip answered before ctx is done. An error
+	// means the probe could not be carried out, not that ip is free.
+	Probe(ctx context.Context, ip net.IP) (bool, error)
+}
+
+// Func adapts a function to the Prober interface.
+type Func func(ctx context.Context, ip net.IP) (bool, error)
+
+func (f Func) Probe(ctx context.Context, ip net.IP) (bool, error) {
+	return f(ctx, ip)
+}
@@ -0,0 +1,58 @@
+package probe
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestEchoRequest(t *testing.T) {
+	msg := echoRequest(0x1234, 7)
+	if msg[0] != icmpEchoRequest {
+		t.Fatalf("type = %d, want %d", msg[0], icmpEchoRequest)
+	}
+	if checksum(msg) != 0 {
+		t.Errorf("checksum does not verify")
+	}
+
+	reply := append([]byte(nil), msg...)
+	reply[0] = icmpEchoReply
+	if !isEchoReply(reply, 0x1234, 7) {
+		t.Errorf("reply not recognised")
+	}
+	withHeader := append(make([]byte, ipv4HeaderLen), reply...)
+	withHeader[0] = 0x45
+	if !isEchoReply(withHeader, 0x1234, 7) {
+		t.Errorf("reply behind IPv4 header not recognised")
+	}
+	if isEchoReply(reply, 0x1234, 8) {
+		t.Errorf("reply with other sequence accepted")
+	}
+}
+
+func TestARPFrames(t *testing.T) {
+	src := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	ip := net.ParseIP("192.168.1.100")
+	frame := arpRequest(src, ip)
+
+	if sender := frame[14+14 : 14+18]; !net.IP(sender).Equal(net.IPv4zero) {
+		t.Errorf("probe sender address = %v, want 0.0.0.0", net.IP(sender))
+	}
+	if claimsAddress(frame, ip) {
+		t.Errorf("our own probe must not count as a conflict")
+	}
+
+	reply := append([]byte(nil), frame...)
+	binary.BigEndian.PutUint16(reply[14+6:], arpReplyOp)
+	copy(reply[14+14:], ip.To4())
+	if !claimsAddress(reply, ip) {
+		t.Errorf("reply from %v not detected", ip)
+	}
+	if claimsAddress(reply, net.ParseIP("192.168.1.101")) {
+		t.Errorf("reply claims unrelated address")
+	}
+	binary.BigEndian.PutUint16(reply[12:], 0x0800)
+	if claimsAddress(reply, ip) {
+		t.Errorf("non-ARP frame accepted")
+	}
+}
@@ -12,6 +12,18 @@ const (
 	DHCPNAK      = 6
 	DHCPRELEASE  = 7
 	DHCPINFORM   = 8
+	// DHCPFORCERENEW tells a bound client to renew now (RFC 3203).
+	DHCPFORCERENEW = 9
+	// Leasequery (RFC 4388) lets relays and access concentrators ask the
+	// server who holds an address.
+	DHCPLEASEQUERY      = 10
+	DHCPLEASEUNASSIGNED = 11
+	DHCPLEASEUNKNOWN    = 12
+	DHCPLEASEACTIVE     = 13
+	// Bulk leasequery (RFC 6926) runs over TCP and streams every matching
+	// lease before a final DHCPLEASEQUERYDONE.
+	DHCPBULKLEASEQUERY = 14
+	DHCPLEASEQUERYDONE = 15
 
 	//1	DHCPDISCOVER	[RFC2132]
 	//2	DHCPOFFER	[RFC2132]
@@ -0,0 +1,118 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"net"
+)
+
+// Fields of the Authentication option (RFC 3118) as RFC 6704 uses it to
+// authenticate DHCPFORCERENEW with a nonce handed out in the DHCPACK.
+const (
+	authProtocolReconfigureKey = 3
+	authAlgorithmHMACMD5       = 1
+	authRDMMonotonic           = 0
+
+	authInfoReconfigureKey = 1
+	authInfoHMACMD5        = 2
+
+	// ForceRenewKeySize is the size of the nonce, which is also the
+	// HMAC-MD5 key.
+	ForceRenewKeySize = md5.Size
+
+	// authHeaderSize covers protocol, algorithm, RDM and replay detection.
+	authHeaderSize = 3 + 8
+)
+
+// ForceRenewNonceCapable reports whether the client lists HMAC-MD5 in
+// option 145 and so accepts a nonce for authenticating DHCPFORCERENEW.
+func (p *Packet) ForceRenewNonceCapable() bool {
+	return bytes.IndexByte(p.GetOption(OptionForceRenewCapable), authAlgorithmHMACMD5) >= 0
+}
+
+// AddForceRenewNonce hands key to the client in an Authentication option.
+// replay must increase with every message the server authenticates.
+func (p *Packet) AddForceRenewNonce(key []byte, replay uint64) {
+	p.AddOption(OptionAuthentication, authOption(replay, authInfoReconfigureKey, key))
+}
+
+// ForceRenewNonce returns the key handed out by AddForceRenewNonce, or nil.
+func (p *Packet) ForceRenewNonce() []byte {
+	auth := p.GetOption(OptionAuthentication)
+	if len(auth) != authHeaderSize+1+ForceRenewKeySize || auth[0] != authProtocolReconfigureKey || auth[authHeaderSize] != authInfoReconfigureKey {
+		return nil
+	}
+	return auth[authHeaderSize+1:]
+}
+
+// NewForceRenew builds a DHCPFORCERENEW for the client at ip, whose
+// hardware address mac is of type htype, and signs it with the client's
+// key using HMAC-MD5.
+func NewForceRenew(ip net.IP, htype byte, mac net.HardwareAddr, serverIP net.IP, xid uint32, key []byte, replay uint64) *Packet {
+	p := &Packet{
+		Op:     BOOTREPLY,
+		HType:  htype,
+		HLen:   byte(len(mac)),
+		XId:    xid,
+		CIAddr: ip,
+		YIAddr: net.IPv4zero,
+		SIAddr: net.IPv4zero,
+		GIAddr: net.IPv4zero,
+		CHAddr: mac,
+	}
+	p.AddOption(OptionDHCPMessageType, []byte{DHCPFORCERENEW})
+	p.AddOption(OptionServerIdentifier, serverIP.To4())
+	p.AddOption(OptionAuthentication, authOption(replay, authInfoHMACMD5, make([]byte, md5.Size)))
+	copy(p.forceRenewDigest(), p.signature(key))
+	return p
+}
+
+// VerifyForceRenew checks the HMAC-MD5 of an encoded DHCPFORCERENEW
+// against key, as the client does.
+func VerifyForceRenew(data, key []byte) bool {
+	p, err := Decode(data)
+	if err != nil {
+		return false
+	}
+	digest := p.forceRenewDigest()
+	if digest == nil {
+		return false
+	}
+	// digest aliases p.Options, which starts after the magic cookie.
+	offset := 240 + cap(p.Options) - cap(digest)
+	unsigned := bytes.Clone(data)
+	clear(unsigned[offset : offset+md5.Size])
+	mac := hmac.New(md5.New, key)
+	mac.Write(unsigned)
+	return hmac.Equal(digest, mac.Sum(nil))
+}
+
+// forceRenewDigest returns the HMAC-MD5 field of the Authentication
+// option, aliasing p.Options, or nil.
+func (p *Packet) forceRenewDigest() []byte {
+	auth := p.GetOption(OptionAuthentication)
+	if len(auth) != authHeaderSize+1+md5.Size || auth[0] != authProtocolReconfigureKey || auth[authHeaderSize] != authInfoHMACMD5 {
+		return nil
+	}
+	return auth[authHeaderSize+1:]
+}
+
+// signature computes the HMAC-MD5 over the whole message with the digest
+// field zeroed.
+func (p *Packet) signature(key []byte) []byte {
+	mac := hmac.New(md5.New, key)
+	mac.Write(p.Encode())
+	return mac.Sum(nil)
+}
+
+func authOption(replay uint64, infoType byte, info []byte) []byte {
+	auth := make([]byte, authHeaderSize+1, authHeaderSize+1+len(info))
+	auth[0] = authProtocolReconfigureKey
+	auth[1] = authAlgorithmHMACMD5
+	auth[2] = authRDMMonotonic
+	binary.BigEndian.PutUint64(auth[3:], replay)
+	auth[authHeaderSize] = infoType
+	return append(auth, info...)
+}
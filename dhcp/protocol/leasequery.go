@@ -0,0 +1,194 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"time"
+)
+
+// Sub-options of the Relay Agent Information option that identify the
+// relay and the subscriber behind it.
+const (
+	RelayAgentRemoteID = 2
+	RelayAgentRelayID  = 12
+)
+
+// Status codes carried in option 151 (RFC 6926 section 6.2.2).
+const (
+	StatusSuccess         = 0
+	StatusUnspecFail      = 1
+	StatusQueryTerminated = 2
+	StatusMalformedQuery  = 3
+	StatusNotAllowed      = 4
+)
+
+// LeaseInfo describes a binding in a reply to DHCPLEASEQUERY.
+type LeaseInfo struct {
+	IP       net.IP
+	MAC      net.HardwareAddr
+	ClientID []byte
+	// HType is the hardware type of MAC. Zero is taken as Ethernet.
+	HType byte
+	// Start is the client's last transaction time. A zero Expiration is
+	// an infinite lease.
+	Start      time.Time
+	Expiration time.Time
+	// Associated lists every address bound to the client, for queries
+	// by MAC address or client identifier.
+	Associated []net.IP
+	// RelayAgentInfo is option 82 from the client's last request.
+	RelayAgentInfo []byte
+}
+
+// maxAssociated is the number of addresses option 92 can hold.
+const maxAssociated = 255 / net.IPv4len
+
+// ToLeaseQueryReply answers a DHCPLEASEQUERY with messageType. A
+// DHCPLEASEACTIVE reply describes lease as of now: ciaddr and chaddr
+// identify the binding, and the options carry the remaining lease time,
+// the time since the client was last heard from (RFC 4388 section 6.4.1),
+// the associated addresses and the client's relay agent information.
+// Other replies echo the query.
+func (p *Packet) ToLeaseQueryReply(messageType byte, serverIP net.IP, lease *LeaseInfo, now time.Time) *Packet {
+	reply := &Packet{
+		Op:     BOOTREPLY,
+		HType:  p.HType,
+		HLen:   p.HLen,
+		XId:    p.XId,
+		Flags:  p.Flags,
+		CIAddr: p.CIAddr,
+		YIAddr: net.IPv4zero,
+		SIAddr: net.IPv4zero,
+		GIAddr: p.GIAddr,
+		CHAddr: p.CHAddr,
+	}
+	reply.AddOption(OptionDHCPMessageType, []byte{messageType})
+	reply.AddOption(OptionServerIdentifier, serverIP.To4())
+	if messageType != DHCPLEASEACTIVE || lease == nil {
+		reply.echoClientID(p)
+		return reply
+	}
+
+	reply.CIAddr = lease.IP
+	if len(lease.MAC) > 0 {
+		reply.HType, reply.HLen, reply.CHAddr = lease.HType, byte(len(lease.MAC)), lease.MAC
+		if reply.HType == 0 {
+			reply.HType = 1
+		}
+	}
+	remaining := uint32(math.MaxUint32)
+	if !lease.Expiration.IsZero() {
+		remaining = leaseSeconds(lease.Expiration.Sub(now))
+	}
+	reply.AddOption(OptionIPAddressLeaseTime, intToBytes(remaining))
+	reply.AddOption(OptionLastTransactionTime, intToBytes(leaseSeconds(now.Sub(lease.Start))))
+	if len(lease.ClientID) > 0 {
+		reply.AddOption(OptionClientIdentifier, lease.ClientID)
+	}
+	if len(lease.Associated) > 0 {
+		associated := lease.Associated[:min(len(lease.Associated), maxAssociated)]
+		reply.AddOption(OptionAssociatedIP, flattenIPs(associated))
+	}
+	if len(lease.RelayAgentInfo) > 0 {
+		reply.AddOption(OptionDHCPAgentOptions, lease.RelayAgentInfo)
+	}
+	return reply
+}
+
+// ToBulkLeaseReply describes lease in reply to a DHCPBULKLEASEQUERY. Times
+// are given relative to base-time, the server's clock when now is sent
+// (RFC 6926 section 6.2.3).
+func (p *Packet) ToBulkLeaseReply(serverIP net.IP, lease *LeaseInfo, now time.Time) *Packet {
+	reply := p.ToLeaseQueryReply(DHCPLEASEACTIVE, serverIP, lease, now)
+	reply.AddOption(OptionBaseTime, intToBytes(uint32(now.Unix())))
+	reply.AddOption(OptionStartTimeOfState, intToBytes(leaseSeconds(now.Sub(lease.Start))))
+	return reply
+}
+
+// ToLeaseQueryDone ends the replies to a DHCPBULKLEASEQUERY with status,
+// and message explaining a failure.
+func (p *Packet) ToLeaseQueryDone(serverIP net.IP, status byte, message string, now time.Time) *Packet {
+	done := &Packet{
+		Op:     BOOTREPLY,
+		HType:  p.HType,
+		HLen:   p.HLen,
+		XId:    p.XId,
+		CIAddr: net.IPv4zero,
+		YIAddr: net.IPv4zero,
+		SIAddr: net.IPv4zero,
+		GIAddr: net.IPv4zero,
+		CHAddr: p.CHAddr,
+	}
+	done.AddOption(OptionDHCPMessageType, []byte{DHCPLEASEQUERYDONE})
+	done.AddOption(OptionServerIdentifier, serverIP.To4())
+	done.AddOption(OptionStatusCode, append([]byte{status}, message...))
+	done.AddOption(OptionBaseTime, intToBytes(uint32(now.Unix())))
+	return done
+}
+
+// RelayAgentSubOption returns sub-option code of the Relay Agent
+// Information option data info, or nil.
+func RelayAgentSubOption(info []byte, code byte) []byte {
+	for i := 0; i+1 < len(info); {
+		length := int(info[i+1])
+		if i+2+length > len(info) {
+			return nil
+		}
+		if info[i] == code {
+			return info[i+2 : i+2+length]
+		}
+		i += 2 + length
+	}
+	return nil
+}
+
+// maxTCPMessage is the largest message the two-octet length prefix of
+// the TCP framing can describe.
+const maxTCPMessage = math.MaxUint16
+
+// ReadTCPMessage reads one length-prefixed DHCP message from a leasequery
+// TCP connection (RFC 6926 section 6.1).
+func ReadTCPMessage(r io.Reader) (*Packet, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return Decode(data)
+}
+
+// WriteTCPMessage writes p to a leasequery TCP connection, preceded by its
+// length.
+func WriteTCPMessage(w io.Writer, p *Packet) error {
+	data := p.Encode()
+	if len(data) > maxTCPMessage {
+		return fmt.Errorf("message of %d bytes too long for TCP framing", len(data))
+	}
+	framed := make([]byte, 2, 2+len(data))
+	binary.BigEndian.PutUint16(framed, uint16(len(data)))
+	_, err := w.Write(append(framed, data...))
+	return err
+}
+
+// leaseSeconds converts d to whole seconds, clamped to what a 32-bit
+// option can hold.
+func leaseSeconds(d time.Duration) uint32 {
+	switch seconds := d / time.Second; {
+	case seconds < 0:
+		return 0
+	case seconds >= math.MaxUint32:
+		return math.MaxUint32 - 1
+	default:
+		return uint32(seconds)
+	}
+}
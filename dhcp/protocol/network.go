@@ -149,13 +149,14 @@ func SendPacket(conn net.PacketConn, p *Packet, sendAddr *net.UDPAddr) error {
 	)
 	return nil
 }
-func resolveDestinationAddress(p *Packet, sendAddr *net.UDPAddr) (net.Addr, error) {
-	if p.IsBroadcast() {
-		return &net.UDPAddr{IP: net.IPv4bcast, Port: clientPort}, nil
-	}
 
-	if len(p.GetOption(OptionDHCPMessageType)) > 0 && p.GetOption(OptionDHCPMessageType)[0] == DHCPNAK {
-		return &net.UDPAddr{IP: net.IPv4bcast, Port: clientPort}, nil
+// resolveDestinationAddress picks where a reply goes, in the order of RFC
+// 2131 section 4.1.
+func resolveDestinationAddress(p *Packet, sendAddr *net.UDPAddr) (net.Addr, error) {
+	// An ACK without yiaddr answers a DHCPINFORM and goes straight to the
+	// client's configured address (RFC 2131 section 4.3.5).
+	if p.DHCPMessageType() == DHCPACK && isUnset(p.YIAddr) && !isUnset(p.CIAddr) {
+		return &net.UDPAddr{IP: p.CIAddr, Port: clientPort}, nil
 	}
 
 	// If GIAddr is specified and not zero, send to the relay agent
@@ -163,11 +164,19 @@ func resolveDestinationAddress(p *Packet, sendAddr *net.UDPAddr) (net.Addr, erro
 		return &net.UDPAddr{IP: p.GIAddr, Port: serverPort}, nil
 	}
 
+	if p.DHCPMessageType() == DHCPNAK {
+		return &net.UDPAddr{IP: net.IPv4bcast, Port: clientPort}, nil
+	}
+
 	// Send directly to the client's IP if specified
 	if p.CIAddr != nil && !p.CIAddr.IsUnspecified() {
 		return &net.UDPAddr{IP: p.CIAddr, Port: clientPort}, nil
 	}
 
+	if p.IsBroadcast() {
+		return &net.UDPAddr{IP: net.IPv4bcast, Port: clientPort}, nil
+	}
+
 	// Handle unicast
 	if p.CHAddr != nil {
 		//TODO
@@ -180,3 +189,7 @@ func resolveDestinationAddress(p *Packet, sendAddr *net.UDPAddr) (net.Addr, erro
 
 	return sendAddr, nil
 }
+
+func isUnset(ip net.IP) bool {
+	return ip == nil || ip.IsUnspecified()
+}
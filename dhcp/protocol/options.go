@@ -26,6 +26,7 @@ const (
 	OptionDHCPMessageType           = 53
 	OptionServerIdentifier          = 54
 	OptionParameterRequestList      = 55
+	OptionMessage                   = 56
 	OptionRenewalTime               = 58
 	OptionRebindingTime             = 59
 	OptionClassIdentifier           = 60
@@ -33,10 +34,23 @@ const (
 	OptionTFTPServerName            = 66
 	OptionBootfileName              = 67
 	OptionUserClass                 = 77
+	OptionRapidCommit               = 80
 	OptionClientFQDN                = 81
 	OptionDHCPAgentOptions          = 82
+	OptionAuthentication            = 90
+	OptionLastTransactionTime       = 91
+	OptionAssociatedIP              = 92
+	OptionClientSystemArch          = 93
+	OptionClientNDI                 = 94
+	OptionClientMachineID           = 97
 	OptionDomainSearch              = 119
 	OptionClasslessStaticRoute      = 121
+	OptionForceRenewCapable         = 145
+	OptionStatusCode                = 151
+	OptionBaseTime                  = 152
+	OptionStartTimeOfState          = 153
+	OptionQueryStartTime            = 154
+	OptionQueryEndTime              = 155
 	OptionEnd                       = 255
 )
 
@@ -221,4 +235,29 @@ type ReplyOptions struct {
 	DNS           []net.IP
 	ServerIP      net.IP
 	DomainName    string
+	// Extra holds additional options, e.g. from client classes. An entry
+	// replaces the default value of the same option.
+	Extra map[byte][]byte
+	// NextServer and BootFile fill the siaddr and file fields for network
+	// boot clients. NextServer defaults to ServerIP; a BootFile too long
+	// for the file field is only sent in option 67.
+	NextServer net.IP
+	BootFile   string
+}
+
+// nextServer returns the address for siaddr.
+func (o *ReplyOptions) nextServer() net.IP {
+	if o.NextServer != nil {
+		return o.NextServer
+	}
+	return o.ServerIP
+}
+
+// fileField returns the contents of the file field, which must leave room
+// for a terminating NUL.
+func (o *ReplyOptions) fileField() []byte {
+	if len(o.BootFile) >= fileFieldSize {
+		return nil
+	}
+	return []byte(o.BootFile)
 }
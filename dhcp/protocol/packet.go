@@ -1,14 +1,23 @@
 package protocol
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"net"
+	"slices"
+	"sort"
 	"strings"
 )
 
 var magicCookie = []byte{99, 130, 83, 99}
 
+// minPacketSize is the size of a BOOTP message with a 64-octet vendor area.
+const minPacketSize = 300
+
+// fileFieldSize is the size of the boot file name field.
+const fileFieldSize = 128
+
 type Packet struct {
 	Op      byte
 	HType   byte
@@ -35,6 +44,42 @@ func (p *Packet) SetBroadcast() {
 	p.Flags |= 0x8000
 }
 
+// HardwareAddr returns the first HLen bytes of CHAddr.
+func (p *Packet) HardwareAddr() net.HardwareAddr {
+	hlen := int(p.HLen)
+	if hlen > len(p.CHAddr) {
+		hlen = len(p.CHAddr)
+	}
+	return p.CHAddr[:hlen]
+}
+
+// ClientID identifies the client as described in RFC 2132 section 9.14 and
+// RFC 4361: the client identifier option when present, otherwise the
+// hardware type followed by the hardware address. A client sending the
+// conventional "type + MAC" identifier therefore keeps the same ID whether
+// or not it includes option 61. It returns nil for a client with neither,
+// which cannot be told apart from others of its hardware type.
+func (p *Packet) ClientID() []byte {
+	if id := p.GetOption(OptionClientIdentifier); len(id) > 0 {
+		return id
+	}
+	hw := p.HardwareAddr()
+	if len(hw) == 0 {
+		return nil
+	}
+	id := make([]byte, 0, 1+len(hw))
+	id = append(id, p.HType)
+	return append(id, hw...)
+}
+
+// echoClientID copies the client identifier of request into the reply, as
+// required by RFC 6842.
+func (p *Packet) echoClientID(request *Packet) {
+	if id := request.GetOption(OptionClientIdentifier); len(id) > 0 {
+		p.AddOption(OptionClientIdentifier, id)
+	}
+}
+
 func (p *Packet) ToOffer(offerIP net.IP, options *ReplyOptions) *Packet {
 	offer := &Packet{
 		Op:     BOOTREPLY,
@@ -46,13 +91,15 @@ func (p *Packet) ToOffer(offerIP net.IP, options *ReplyOptions) *Packet {
 		Flags:  p.Flags,
 		CIAddr: net.IPv4zero,
 		YIAddr: offerIP,
-		SIAddr: options.ServerIP,
+		SIAddr: options.nextServer(),
 		GIAddr: p.GIAddr,
 		CHAddr: p.CHAddr,
+		File:   options.fileField(),
 	}
 
 	offer.AddOption(OptionDHCPMessageType, []byte{DHCPOFFER})
 	offer.addCommonOptions(options)
+	offer.echoClientID(p)
 
 	return offer
 }
@@ -68,18 +115,86 @@ func (p *Packet) ToAck(ackIP net.IP, options *ReplyOptions) *Packet {
 		Flags:  p.Flags,
 		CIAddr: p.CIAddr,
 		YIAddr: ackIP,
-		SIAddr: options.ServerIP,
+		SIAddr: options.nextServer(),
 		GIAddr: p.GIAddr,
 		CHAddr: p.CHAddr,
+		File:   options.fileField(),
 	}
 
 	ack.AddOption(OptionDHCPMessageType, []byte{DHCPACK})
 	ack.addCommonOptions(options)
+	ack.echoClientID(p)
 
 	return ack
 }
 
-func (p *Packet) ToNak(options *ReplyOptions) *Packet {
+// ToInformAck answers a DHCPINFORM. The client already has an address, so
+// the reply carries configuration only: no yiaddr and no lease times.
+func (p *Packet) ToInformAck(options *ReplyOptions) *Packet {
+	ack := &Packet{
+		Op:     BOOTREPLY,
+		HType:  p.HType,
+		HLen:   p.HLen,
+		Hops:   0,
+		XId:    p.XId,
+		Secs:   0,
+		Flags:  p.Flags,
+		CIAddr: p.CIAddr,
+		YIAddr: net.IPv4zero,
+		SIAddr: options.nextServer(),
+		GIAddr: p.GIAddr,
+		CHAddr: p.CHAddr,
+		File:   options.fileField(),
+	}
+
+	ack.AddOption(OptionDHCPMessageType, []byte{DHCPACK})
+	ack.addOptions(options, false)
+	ack.echoClientID(p)
+
+	return ack
+}
+
+// ToBootReply answers a BOOTP request (RFC 951). serverName and file fill
+// the sname and file fields, and the options go in the vendor area as RFC
+// 1497 extensions, without the DHCP-only ones.
+func (p *Packet) ToBootReply(yiaddr net.IP, options *ReplyOptions, serverName, file string) *Packet {
+	reply := &Packet{
+		Op:     BOOTREPLY,
+		HType:  p.HType,
+		HLen:   p.HLen,
+		Hops:   0,
+		XId:    p.XId,
+		Secs:   0,
+		Flags:  p.Flags,
+		CIAddr: p.CIAddr,
+		YIAddr: yiaddr,
+		SIAddr: options.ServerIP,
+		GIAddr: p.GIAddr,
+		CHAddr: p.CHAddr,
+		SName:  []byte(serverName),
+		File:   []byte(file),
+	}
+
+	reply.addDefaultOption(options, OptionSubnetMask, options.SubnetMask)
+	reply.addDefaultOption(options, OptionRouter, options.Router.To4())
+	reply.addDefaultOption(options, OptionDomainNameServer, flattenIPs(options.DNS))
+	if options.DomainName != "" {
+		reply.addDefaultOption(options, OptionDomainName, []byte(options.DomainName))
+	}
+	reply.addExtraOptions(options, dhcpOnlyOptions...)
+
+	return reply
+}
+
+// dhcpOnlyOptions have no meaning to BOOTP clients.
+var dhcpOnlyOptions = []byte{
+	OptionIPAddressLeaseTime, OptionDHCPMessageType, OptionServerIdentifier,
+	OptionRenewalTime, OptionRebindingTime,
+}
+
+// ToNak rejects the request. message, if not empty, is sent in option 56
+// to tell the client why.
+func (p *Packet) ToNak(options *ReplyOptions, message string) *Packet {
 	nak := &Packet{
 		Op:     BOOTREPLY,
 		HType:  p.HType,
@@ -94,26 +209,73 @@ func (p *Packet) ToNak(options *ReplyOptions) *Packet {
 		GIAddr: p.GIAddr,
 		CHAddr: p.CHAddr,
 	}
+	// The relay must broadcast the NAK: the client may no longer be able
+	// to receive unicast on the address it asked for.
+	if p.GIAddr != nil && !p.GIAddr.IsUnspecified() {
+		nak.SetBroadcast()
+	}
 
 	nak.AddOption(OptionDHCPMessageType, []byte{DHCPNAK})
 	nak.AddOption(OptionServerIdentifier, options.ServerIP.To4()) // Server Identifier
+	if message != "" {
+		nak.AddOption(OptionMessage, []byte(message))
+	}
+	nak.echoClientID(p)
 
 	return nak
 }
 
 func (p *Packet) addCommonOptions(options *ReplyOptions) {
-	p.AddOption(OptionSubnetMask, options.SubnetMask)
-	p.AddOption(OptionRouter, options.Router.To4())
-	p.AddOption(OptionDomainNameServer, flattenIPs(options.DNS))
-	p.AddOption(OptionIPAddressLeaseTime, intToBytes(uint32(options.LeaseTime.Seconds())))
+	p.addOptions(options, true)
+}
+
+// addOptions adds the scope and class options. Without lease, the lease
+// time, T1 and T2 are left out, including any set by a class.
+func (p *Packet) addOptions(options *ReplyOptions, lease bool) {
+	p.addDefaultOption(options, OptionSubnetMask, options.SubnetMask)
+	p.addDefaultOption(options, OptionRouter, options.Router.To4())
+	p.addDefaultOption(options, OptionDomainNameServer, flattenIPs(options.DNS))
+	if lease {
+		p.AddOption(OptionIPAddressLeaseTime, intToBytes(uint32(options.LeaseTime.Seconds())))
+	}
 	p.AddOption(OptionServerIdentifier, options.ServerIP.To4())
-	p.AddOption(OptionRenewalTime, intToBytes(uint32(options.RenewalTime.Seconds())))
-	p.AddOption(OptionRebindingTime, intToBytes(uint32(options.RebindingTime.Seconds())))
+	if lease {
+		p.AddOption(OptionRenewalTime, intToBytes(uint32(options.RenewalTime.Seconds())))
+		p.AddOption(OptionRebindingTime, intToBytes(uint32(options.RebindingTime.Seconds())))
+	}
 	if options.DomainName != "" {
-		p.AddOption(OptionDomainName, []byte(options.DomainName))
+		p.addDefaultOption(options, OptionDomainName, []byte(options.DomainName))
+	}
+	if lease {
+		p.addExtraOptions(options)
+	} else {
+		p.addExtraOptions(options, OptionIPAddressLeaseTime, OptionRenewalTime, OptionRebindingTime)
 	}
 }
 
+// addExtraOptions adds options.Extra in code order, leaving out the codes
+// in exclude.
+func (p *Packet) addExtraOptions(options *ReplyOptions, exclude ...byte) {
+	codes := make([]int, 0, len(options.Extra))
+	for code := range options.Extra {
+		if !slices.Contains(exclude, code) {
+			codes = append(codes, int(code))
+		}
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		p.AddOption(byte(code), options.Extra[byte(code)])
+	}
+}
+
+// addDefaultOption adds a scope-level option unless Extra overrides it.
+func (p *Packet) addDefaultOption(options *ReplyOptions, code byte, data []byte) {
+	if _, ok := options.Extra[code]; ok {
+		return
+	}
+	p.AddOption(code, data)
+}
+
 func (p *Packet) Print() {
 	fmt.Printf("Op: %d\n", p.Op)
 	fmt.Printf("Hardware Type: %d\n", p.HType)
@@ -153,13 +315,21 @@ func (p *Packet) Encode() []byte {
 
 	//add end opt
 	data = append(data, OptionEnd)
+	// BOOTP clients and relays expect at least the 64-octet vendor area
+	// of RFC 951.
+	if len(data) < minPacketSize {
+		data = append(data, make([]byte, minPacketSize-len(data))...)
+	}
 	return data
 }
 
+// Decode parses a DHCP message. The packet does not alias data, so the
+// caller may reuse the buffer.
 func Decode(data []byte) (*Packet, error) {
 	if len(data) < 240 {
 		return nil, fmt.Errorf("packet too short")
 	}
+	data = bytes.Clone(data)
 
 	packet := &Packet{
 		Op:      data[0],
@@ -178,6 +348,11 @@ func Decode(data []byte) (*Packet, error) {
 		File:    data[108:236],
 		Options: data[240:],
 	}
+	// A BOOTP client may fill the vendor area with something other than
+	// RFC 1048 options.
+	if !bytes.Equal(data[236:240], magicCookie) {
+		packet.Options = nil
+	}
 	return packet, nil
 }
 
@@ -1,7 +1,10 @@
 package protocol
 
 import (
+	"bytes"
+	"net"
 	"testing"
+	"time"
 )
 
 var testPacket = []byte{1, 1, 6, 0, 93, 81, 216, 159, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
@@ -19,3 +22,170 @@ var testPacket = []byte{1, 1, 6, 0, 93, 81, 216, 159, 0, 0, 0, 0, 0, 0, 0, 0, 0,
 func TestPacket_Marshal(t *testing.T) {
 	//_, _ = decode(testPacket)
 }
+
+func TestPacket_ClientID(t *testing.T) {
+	p := &Packet{HType: 1, HLen: 6, CHAddr: net.HardwareAddr{1, 2, 3, 4, 5, 6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}}
+	if got, want := p.ClientID(), []byte{1, 1, 2, 3, 4, 5, 6}; !bytes.Equal(got, want) {
+		t.Errorf("ClientID without option 61 = %v, want %v", got, want)
+	}
+
+	ib := &Packet{HType: 32, HLen: 0, CHAddr: make(net.HardwareAddr, 16)}
+	if got := ib.ClientID(); got != nil {
+		t.Errorf("ClientID for HLen 0 without option 61 = %v, want nil", got)
+	}
+
+	p.AddOption(OptionClientIdentifier, []byte{0, 'h', 'o', 's', 't'})
+	if got, want := p.ClientID(), []byte{0, 'h', 'o', 's', 't'}; !bytes.Equal(got, want) {
+		t.Errorf("ClientID with option 61 = %v, want %v", got, want)
+	}
+
+	ack := p.ToAck(net.IP{10, 0, 0, 5}, &ReplyOptions{ServerIP: net.IP{10, 0, 0, 1}})
+	if got := ack.GetOption(OptionClientIdentifier); !bytes.Equal(got, p.ClientID()) {
+		t.Errorf("ACK echoed client identifier %v, want %v", got, p.ClientID())
+	}
+}
+
+func TestInformAckIsUnicastToClient(t *testing.T) {
+	inform := &Packet{
+		HType:  1,
+		HLen:   6,
+		Flags:  0x8000,
+		CIAddr: net.ParseIP("192.168.1.50").To4(),
+		GIAddr: net.ParseIP("10.0.0.1").To4(),
+		CHAddr: net.HardwareAddr{1, 2, 3, 4, 5, 6},
+	}
+	inform.AddOption(OptionDHCPMessageType, []byte{DHCPINFORM})
+	ack := inform.ToInformAck(&ReplyOptions{ServerIP: net.ParseIP("192.168.1.2"), LeaseTime: time.Hour})
+
+	for _, code := range []byte{OptionIPAddressLeaseTime, OptionRenewalTime, OptionRebindingTime} {
+		if ack.GetOption(code) != nil {
+			t.Errorf("inform reply carries option %d", code)
+		}
+	}
+	if !ack.YIAddr.Equal(net.IPv4zero) {
+		t.Errorf("yiaddr = %v, want 0.0.0.0", ack.YIAddr)
+	}
+	dest, err := resolveDestinationAddress(ack, nil)
+	if err != nil {
+		t.Fatalf("resolveDestinationAddress: %v", err)
+	}
+	if want := (&net.UDPAddr{IP: inform.CIAddr, Port: clientPort}); dest.String() != want.String() {
+		t.Errorf("destination = %v, want %v", dest, want)
+	}
+}
+
+func TestBootReply(t *testing.T) {
+	// A BOOTP request with an empty vendor area, as RFC 951 clients send.
+	raw := make([]byte, minPacketSize)
+	raw[0], raw[1], raw[2] = BOOTREQUEST, 1, 6
+	copy(raw[28:], []byte{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+	request, err := Decode(raw)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if request.Options != nil || request.DHCPMessageType() != 0 {
+		t.Fatalf("vendor area without magic cookie decoded as options: %v", request.Options)
+	}
+
+	options := &ReplyOptions{
+		ServerIP:   net.ParseIP("192.168.1.2"),
+		SubnetMask: net.CIDRMask(24, 32),
+		LeaseTime:  time.Hour,
+		Extra:      map[byte][]byte{OptionHostname: []byte("plc-1"), OptionIPAddressLeaseTime: {0, 0, 0, 1}},
+	}
+	data := request.ToBootReply(net.ParseIP("192.168.1.50"), options, "boot", "plc.bin").Encode()
+	if len(data) < minPacketSize {
+		t.Errorf("reply is %d bytes, want at least %d", len(data), minPacketSize)
+	}
+	reply, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Decode reply: %v", err)
+	}
+	if reply.Op != BOOTREPLY || !reply.YIAddr.Equal(net.ParseIP("192.168.1.50")) {
+		t.Errorf("reply op %d yiaddr %v", reply.Op, reply.YIAddr)
+	}
+	if got := string(bytes.TrimRight(reply.SName, "\x00")); got != "boot" {
+		t.Errorf("sname = %q, want boot", got)
+	}
+	if got := string(bytes.TrimRight(reply.File, "\x00")); got != "plc.bin" {
+		t.Errorf("file = %q, want plc.bin", got)
+	}
+	if got := string(reply.GetOption(OptionHostname)); got != "plc-1" {
+		t.Errorf("hostname = %q, want plc-1", got)
+	}
+	for _, code := range dhcpOnlyOptions {
+		if reply.GetOption(code) != nil {
+			t.Errorf("BOOTREPLY carries DHCP option %d", code)
+		}
+	}
+}
+
+func TestForceRenewAuthentication(t *testing.T) {
+	key := bytes.Repeat([]byte{0x5a}, ForceRenewKeySize)
+
+	ack := &Packet{}
+	ack.AddForceRenewNonce(key, 1)
+	if got := ack.ForceRenewNonce(); !bytes.Equal(got, key) {
+		t.Fatalf("nonce = %x, want %x", got, key)
+	}
+
+	p := NewForceRenew(net.IP{192, 168, 1, 10}, 1, net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}, net.IP{192, 168, 1, 1}, 7, key, 2)
+	if p.DHCPMessageType() != DHCPFORCERENEW {
+		t.Errorf("message type = %d, want DHCPFORCERENEW", p.DHCPMessageType())
+	}
+	data := p.Encode()
+	if !VerifyForceRenew(data, key) {
+		t.Errorf("FORCERENEW does not verify")
+	}
+	if VerifyForceRenew(data, bytes.Repeat([]byte{0xa5}, ForceRenewKeySize)) {
+		t.Errorf("FORCERENEW verifies with the wrong key")
+	}
+	data[4]++
+	if VerifyForceRenew(data, key) {
+		t.Errorf("tampered FORCERENEW verifies")
+	}
+
+	capable := &Packet{}
+	capable.AddOption(OptionForceRenewCapable, []byte{1})
+	if !capable.ForceRenewNonceCapable() || (&Packet{}).ForceRenewNonceCapable() {
+		t.Errorf("ForceRenewNonceCapable misreads option 145")
+	}
+}
+
+func TestTCPFramingAndRelayAgentSubOptions(t *testing.T) {
+	query := &Packet{Op: BOOTREQUEST, XId: 9, CIAddr: net.IPv4zero, YIAddr: net.IPv4zero, SIAddr: net.IPv4zero, GIAddr: net.IPv4zero}
+	query.AddOption(OptionDHCPMessageType, []byte{DHCPBULKLEASEQUERY})
+	query.AddOption(OptionDHCPAgentOptions, []byte{1, 2, 'e', '0', RelayAgentRemoteID, 3, 'r', 'i', 'd', RelayAgentRelayID, 2, 0xaa, 0xbb})
+
+	var buf bytes.Buffer
+	for range 2 {
+		if err := WriteTCPMessage(&buf, query); err != nil {
+			t.Fatalf("WriteTCPMessage: %v", err)
+		}
+	}
+	for i := range 2 {
+		got, err := ReadTCPMessage(&buf)
+		if err != nil {
+			t.Fatalf("message %d: ReadTCPMessage: %v", i, err)
+		}
+		if got.XId != 9 || got.DHCPMessageType() != DHCPBULKLEASEQUERY {
+			t.Errorf("message %d = %+v", i, got)
+		}
+		info := got.GetOption(OptionDHCPAgentOptions)
+		if id := RelayAgentSubOption(info, RelayAgentRemoteID); string(id) != "rid" {
+			t.Errorf("remote-id = %q, want rid", id)
+		}
+		if id := RelayAgentSubOption(info, RelayAgentRelayID); !bytes.Equal(id, []byte{0xaa, 0xbb}) {
+			t.Errorf("relay-id = %x, want aabb", id)
+		}
+	}
+	if _, err := ReadTCPMessage(&buf); err == nil {
+		t.Errorf("read past the last message")
+	}
+	if _, err := ReadTCPMessage(bytes.NewReader([]byte{1, 0, 1, 2})); err == nil {
+		t.Errorf("read a truncated message")
+	}
+	if id := RelayAgentSubOption([]byte{2, 9, 'x'}, RelayAgentRemoteID); id != nil {
+		t.Errorf("truncated sub-option = %q, want nil", id)
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"dhcp/protocol"
+	"dhcp/store"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// BOOTPConfig enables answering BOOTP clients (RFC 951), whose requests
+// carry no DHCP message type. Reserved hosts always get their address;
+// other clients get one from DynamicPool if it is set, for good, as BOOTP
+// has no way to end a lease (RFC 1534).
+type BOOTPConfig struct {
+	Enabled bool
+	// Hosts reserves addresses by hardware address. Reserved addresses
+	// must be outside every pool, or excluded from it.
+	Hosts []BOOTPHost
+	// DynamicPool names the pool that BOOTP clients without a reservation
+	// are served from. DHCP clients never get addresses from it.
+	DynamicPool string
+	// ServerName and File fill the sname and file fields of replies:
+	// the boot server's host name and the boot file to load from it.
+	ServerName string
+	File       string
+}
+
+// BOOTPHost is a BOOTP reservation.
+type BOOTPHost struct {
+	MAC      net.HardwareAddr
+	IP       net.IP
+	Hostname string
+	// File replaces BOOTPConfig.File for this host.
+	File string
+}
+
+// maxServerName and maxFile are the sizes of the sname and file fields,
+// less the terminating NUL.
+const (
+	maxServerName = 63
+	maxFile       = 127
+)
+
+// maxBOOTPBindAttempts bounds how many free addresses bindBOOTP tries when
+// the lease store reports them bound by another server.
+const maxBOOTPBindAttempts = 5
+
+func (c *BOOTPConfig) validate(cfg *Config, pools map[string]bool) error {
+	if c.DynamicPool != "" && !pools[c.DynamicPool] {
+		return fmt.Errorf("BOOTP dynamic pool %q does not exist", c.DynamicPool)
+	}
+	if len(c.ServerName) > maxServerName {
+		return fmt.Errorf("BOOTP server name longer than %d bytes", maxServerName)
+	}
+	if len(c.File) > maxFile {
+		return fmt.Errorf("BOOTP file name longer than %d bytes", maxFile)
+	}
+	macs := make(map[string]bool, len(c.Hosts))
+	for _, h := range c.Hosts {
+		if macs[string(h.MAC)] {
+			return fmt.Errorf("duplicate BOOTP host %s", h.MAC)
+		}
+		macs[string(h.MAC)] = true
+		if !cfg.Subnet.Contains(h.IP) {
+			return fmt.Errorf("BOOTP host %s: address %s is not in the subnet", h.MAC, h.IP)
+		}
+		if len(h.File) > maxFile {
+			return fmt.Errorf("BOOTP host %s: file name longer than %d bytes", h.MAC, maxFile)
+		}
+	}
+	return nil
+}
+
+func (s *Server) handleBOOTP(packet *protocol.Packet, addr *net.UDPAddr) {
+	reply := s.createBOOTPReply(packet)
+	if reply == nil {
+		return
+	}
+	if err := protocol.SendPacket(s.conn, reply, addr); err != nil {
+		slog.Error("Error sending BOOTP reply", "error", err)
+	}
+}
+
+// createBOOTPReply answers a BOOTP request from a reserved host or, failing
+// that, from the dynamic BOOTP pool. It returns nil if BOOTP is disabled
+// or the client cannot be served.
+func (s *Server) createBOOTPReply(packet *protocol.Packet) *protocol.Packet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cfg := &s.config.BOOTP
+	if !cfg.Enabled {
+		return nil
+	}
+	mac := packet.HardwareAddr()
+	options := s.replyOptions(s.classifier.Classify(packet))
+	file := cfg.File
+
+	var ip net.IP
+	if h := cfg.host(mac); h != nil {
+		ip = h.IP
+		if h.File != "" {
+			file = h.File
+		}
+		if h.Hostname != "" {
+			if options.Extra == nil {
+				options.Extra = make(map[byte][]byte)
+			}
+			options.Extra[protocol.OptionHostname] = []byte(h.Hostname)
+		}
+	} else if cfg.DynamicPool != "" {
+		ip = s.bindBOOTP(packet)
+	}
+	if ip == nil {
+		slog.Debug("Ignoring BOOTP request", "addr", mac.String())
+		return nil
+	}
+	slog.Info("Answering BOOTP request", "ip", ip, "addr", mac.String(), "file", file)
+	return packet.ToBootReply(ip, options, cfg.ServerName, file)
+}
+
+func (c *BOOTPConfig) host(mac net.HardwareAddr) *BOOTPHost {
+	for i := range c.Hosts {
+		if string(c.Hosts[i].MAC) == string(mac) {
+			return &c.Hosts[i]
+		}
+	}
+	return nil
+}
+
+// bindBOOTP returns the client's address in the dynamic BOOTP pool,
+// binding a free one for good if it has none. s.mu must be held.
+func (s *Server) bindBOOTP(packet *protocol.Packet) net.IP {
+	key := clientKey(packet)
+	p := s.namedPool(s.config.BOOTP.DynamicPool)
+	if b, exists := s.bindings[key]; exists && b.State == BOUND && b.Expiration.IsZero() && p.Contains(b.IP) {
+		return b.IP
+	}
+
+	for attempt := 0; attempt < maxBOOTPBindAttempts; attempt++ {
+		ip := p.Allocate(packet.ClientID())
+		if ip == nil {
+			slog.Warn("Dynamic BOOTP pool exhausted", "pool", p.name, "addr", packet.HardwareAddr().String())
+			return nil
+		}
+		l := &store.Lease{
+			IP:       ip,
+			ClientID: packet.ClientID(),
+			MAC:      packet.HardwareAddr(),
+			HType:    packet.HType,
+			State:    BOUND,
+			Start:    time.Now(),
+		}
+		if err := s.bind(l); errors.Is(err, store.ErrAddressInUse) {
+			continue
+		} else if err != nil {
+			return nil
+		}
+
+		if old, exists := s.bindings[key]; exists {
+			s.freeAddress(old.IP)
+			s.forget(old)
+		}
+		b := &binding{IP: ip, ClientID: l.ClientID, MAC: l.MAC, HType: l.HType, Start: l.Start}
+		_ = b.transition(BOUND)
+		s.allocated[IPToUint32(ip)] = b
+		s.bindings[key] = b
+		return ip
+	}
+	return nil
+}
+
+func (s *Server) namedPool(name string) *namedPool {
+	for _, p := range s.pools {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
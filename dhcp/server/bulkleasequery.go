@@ -0,0 +1,215 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"dhcp/protocol"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultBulkConnections and defaultBulkTimeout are BULK_LQ_MAX_CONNS
+	// and BULK_LQ_DATA_TIMEOUT from RFC 6926 section 9.
+	defaultBulkConnections = 10
+	defaultBulkTimeout     = 5 * time.Minute
+)
+
+// serveBulkLeaseQuery accepts bulk leasequery connections until ctx is
+// done, then closes the listener and every open connection.
+func (s *Server) serveBulkLeaseQuery(ctx context.Context) {
+	defer context.AfterFunc(ctx, func() { _ = s.bulkListener.Close() })()
+
+	s.mu.RLock()
+	limit := cmp.Or(s.config.LeaseQuery.MaxConnections, defaultBulkConnections)
+	s.mu.RUnlock()
+	slots := make(chan struct{}, limit)
+
+	var conns sync.WaitGroup
+	defer conns.Wait()
+	for {
+		conn, err := s.bulkListener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Bulk leasequery listener failed", "error", err)
+			}
+			return
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			slog.Warn("Refusing bulk leasequery connection over the limit", "remote", conn.RemoteAddr(), "limit", limit)
+			_ = conn.Close()
+			continue
+		}
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			// Free the slot before the requester sees the close, so it
+			// can reconnect at once.
+			defer conn.Close()
+			defer func() { <-slots }()
+			s.serveBulkConn(ctx, conn)
+		}()
+	}
+}
+
+// serveBulkConn answers the queries sent on conn in turn until the
+// requester closes it, stays idle past the timeout or ctx is done.
+func (s *Server) serveBulkConn(ctx context.Context, conn net.Conn) {
+	defer context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })()
+
+	var requester net.IP
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		requester = addr.IP
+	}
+	slog.Info("Bulk leasequery connection", "remote", conn.RemoteAddr())
+	for {
+		s.mu.RLock()
+		timeout := cmp.Or(s.config.LeaseQuery.Timeout, defaultBulkTimeout)
+		s.mu.RUnlock()
+
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		query, err := protocol.ReadTCPMessage(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+				slog.Info("Closing bulk leasequery connection", "remote", conn.RemoteAddr(), "error", err)
+			}
+			return
+		}
+		write := func(p *protocol.Packet) error {
+			_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+			return protocol.WriteTCPMessage(conn, p)
+		}
+		if err := s.answerBulkQuery(ctx, query, requester, write); err != nil {
+			slog.Info("Closing bulk leasequery connection", "remote", conn.RemoteAddr(), "error", err)
+			return
+		}
+	}
+}
+
+// answerBulkQuery streams a DHCPLEASEACTIVE for each lease query selects
+// and ends with DHCPLEASEQUERYDONE. A query that cannot be answered gets
+// only the DHCPLEASEQUERYDONE, with the reason in its status code. It
+// returns an error once the connection can no longer be used.
+func (s *Server) answerBulkQuery(ctx context.Context, query *protocol.Packet, requester net.IP, write func(*protocol.Packet) error) error {
+	s.mu.RLock()
+	serverIP := s.config.ServerIP
+	allowed := s.config.LeaseQuery.allows(requester)
+	s.mu.RUnlock()
+
+	done := func(status byte, message string) error {
+		return write(query.ToLeaseQueryDone(serverIP, status, message, time.Now()))
+	}
+	switch {
+	case query.DHCPMessageType() != protocol.DHCPBULKLEASEQUERY:
+		return done(protocol.StatusMalformedQuery, "only DHCPBULKLEASEQUERY is accepted over TCP")
+	case !allowed:
+		slog.Info("Refusing bulk leasequery from requester not allowed", "requester", requester)
+		if err := done(protocol.StatusNotAllowed, "requester not allowed"); err != nil {
+			return err
+		}
+		return errors.New("requester not allowed")
+	}
+	match, err := bulkQueryMatch(query)
+	if err != nil {
+		return done(protocol.StatusMalformedQuery, err.Error())
+	}
+
+	now := time.Now()
+	leases := s.bulkLeases(match, now)
+	slog.Info("Answering DHCPBULKLEASEQUERY", "requester", requester, "leases", len(leases))
+	for _, lease := range leases {
+		if ctx.Err() != nil {
+			return done(protocol.StatusQueryTerminated, "server shutting down")
+		}
+		if err := write(query.ToBulkLeaseReply(serverIP, lease, now)); err != nil {
+			return err
+		}
+	}
+	return done(protocol.StatusSuccess, "")
+}
+
+// bulkLeases returns the bound leases that match selects, ordered by
+// address. s.mu is taken only while copying them out.
+func (s *Server) bulkLeases(match func(b *binding) bool, now time.Time) []*protocol.LeaseInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var leases []*protocol.LeaseInfo
+	for _, b := range s.allocated {
+		if b.State == BOUND && !b.expired(now) && match(b) {
+			leases = append(leases, b.leaseInfo())
+		}
+	}
+	slices.SortFunc(leases, func(a, b *protocol.LeaseInfo) int {
+		return cmp.Compare(IPToUint32(a.IP), IPToUint32(b.IP))
+	})
+	return leases
+}
+
+// bulkQueryMatch builds the filter for a DHCPBULKLEASEQUERY. The query
+// names at most one of an address, a client identifier, a MAC address, a
+// relay ID or a remote ID, and asks for all leases if it names none.
+// Query-start-time and query-end-time restrict the leases to those whose
+// client was last heard from in that window.
+func bulkQueryMatch(query *protocol.Packet) (func(b *binding) bool, error) {
+	var criteria []func(b *binding) bool
+	if !isZeroIP(query.CIAddr) {
+		ip := query.CIAddr
+		criteria = append(criteria, func(b *binding) bool { return b.IP.Equal(ip) })
+	}
+	if id := query.GetOption(protocol.OptionClientIdentifier); len(id) > 0 {
+		criteria = append(criteria, func(b *binding) bool { return bytes.Equal(b.ClientID, id) })
+	}
+	if mac := query.HardwareAddr(); query.HLen > 0 && !isZeroMAC(mac) {
+		criteria = append(criteria, func(b *binding) bool { return bytes.Equal(b.MAC, mac) })
+	}
+	info := query.GetOption(protocol.OptionDHCPAgentOptions)
+	for _, code := range []byte{protocol.RelayAgentRelayID, protocol.RelayAgentRemoteID} {
+		if id := protocol.RelayAgentSubOption(info, code); len(id) > 0 {
+			criteria = append(criteria, func(b *binding) bool {
+				return bytes.Equal(protocol.RelayAgentSubOption(b.relayAgentInfo, code), id)
+			})
+		}
+	}
+	if len(criteria) > 1 {
+		return nil, errors.New("more than one query type")
+	}
+
+	start, err := queryTime(query, protocol.OptionQueryStartTime)
+	if err != nil {
+		return nil, err
+	}
+	end, err := queryTime(query, protocol.OptionQueryEndTime)
+	if err != nil {
+		return nil, err
+	}
+	return func(b *binding) bool {
+		if len(criteria) == 1 && !criteria[0](b) {
+			return false
+		}
+		return (start.IsZero() || !b.Start.Before(start)) && (end.IsZero() || !b.Start.After(end))
+	}, nil
+}
+
+// queryTime reads a query-start-time or query-end-time option, zero if
+// absent.
+func queryTime(query *protocol.Packet, code byte) (time.Time, error) {
+	data := query.GetOption(code)
+	switch len(data) {
+	case 0:
+		return time.Time{}, nil
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(data)), 0), nil
+	default:
+		return time.Time{}, errors.New("malformed query time")
+	}
+}
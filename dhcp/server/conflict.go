@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net"
+	"time"
+)
+
+// maxConflictEvents bounds the conflict history kept in memory.
+const maxConflictEvents = 256
+
+// ConflictReason says how an address conflict was detected.
+type ConflictReason string
+
+const (
+	// ConflictDeclined means a client sent DHCPDECLINE for the address.
+	ConflictDeclined ConflictReason = "declined"
+	// ConflictProbe means the address answered a probe before an offer.
+	ConflictProbe ConflictReason = "probe"
+)
+
+// ConflictEvent records an address found to be in use by another host.
+type ConflictEvent struct {
+	Time     time.Time
+	IP       net.IP
+	MAC      net.HardwareAddr
+	ClientID []byte
+	Reason   ConflictReason
+	// Until is when the address returns to its pool.
+	Until time.Time
+}
+
+// recordConflict appends a conflict for b, dropping the oldest event once
+// the history is full.
+func (s *Server) recordConflict(b *binding, reason ConflictReason) {
+	s.conflictsMu.Lock()
+	defer s.conflictsMu.Unlock()
+
+	if len(s.conflicts) == maxConflictEvents {
+		copy(s.conflicts, s.conflicts[1:])
+		s.conflicts = s.conflicts[:maxConflictEvents-1]
+	}
+	s.conflicts = append(s.conflicts, ConflictEvent{
+		Time:     time.Now(),
+		IP:       b.IP,
+		MAC:      b.MAC,
+		ClientID: b.ClientID,
+		Reason:   reason,
+		Until:    b.Expiration,
+	})
+}
+
+// Conflicts returns the recorded address conflicts, oldest first.
+func (s *Server) Conflicts() []ConflictEvent {
+	s.conflictsMu.Lock()
+	defer s.conflictsMu.Unlock()
+
+	return append([]ConflictEvent(nil), s.conflicts...)
+}
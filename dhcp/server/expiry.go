@@ -0,0 +1,134 @@
+package server
+
+import (
+	"container/heap"
+	"context"
+	"dhcp/store"
+	"log/slog"
+	"time"
+)
+
+// idleExpiryWait is how long the expiry loop sleeps when nothing is
+// scheduled; schedule wakes it early.
+const idleExpiryWait = time.Hour
+
+// expiryHeap orders address-holding bindings by Expiration. Every binding
+// in s.allocated is in the heap, except infinite BOOTP leases.
+type expiryHeap []*binding
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].Expiration.Before(h[j].Expiration) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i + 1
+	h[j].heapIndex = j + 1
+}
+
+func (h *expiryHeap) Push(x any) {
+	b := x.(*binding)
+	*h = append(*h, b)
+	b.heapIndex = len(*h)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	b := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	b.heapIndex = 0
+	return b
+}
+
+// schedule (re)keys b by its current Expiration, waking the expiry loop
+// if b is now the next to expire. A zero Expiration never expires and is
+// left out of the heap. s.mu must be held.
+func (s *Server) schedule(b *binding) {
+	if b.Expiration.IsZero() {
+		s.unschedule(b)
+		return
+	}
+	if b.heapIndex > 0 {
+		heap.Fix(&s.expiry, b.heapIndex-1)
+	} else {
+		heap.Push(&s.expiry, b)
+	}
+	if b.heapIndex == 1 {
+		select {
+		case s.expiryWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// unschedule removes b from the expiry heap. s.mu must be held.
+func (s *Server) unschedule(b *binding) {
+	if b.heapIndex > 0 {
+		heap.Remove(&s.expiry, b.heapIndex-1)
+	}
+}
+
+// OnExpire sets a function called with each lease that expires, after it
+// has moved to EXPIRED. It runs without server locks held, so it may call
+// back into the server.
+func (s *Server) OnExpire(f func(l *store.Lease)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onExpire = f
+}
+
+// runExpiry sleeps until the earliest expiration and processes every
+// binding due by then.
+func (s *Server) runExpiry(ctx context.Context) {
+	timer := time.NewTimer(idleExpiryWait)
+	defer timer.Stop()
+
+	for {
+		timer.Reset(s.expireLeases(time.Now()))
+		select {
+		case <-timer.C:
+		case <-s.expiryWake:
+		case <-ctx.Done():
+			slog.Info("Stopping lease expiry")
+			return
+		}
+	}
+}
+
+// expireLeases advances every binding whose Expiration is not after now:
+// unanswered offers and quarantined addresses go back to the pool, bound
+// leases become EXPIRED, and EXPIRED or RELEASED addresses go back once
+// their affinity to the last owner has passed. It returns how long until
+// the next binding is due.
+func (s *Server) expireLeases(now time.Time) time.Duration {
+	s.mu.Lock()
+	var expired []*store.Lease
+	for len(s.expiry) > 0 && !s.expiry[0].Expiration.After(now) {
+		b := s.expiry[0]
+		if b.State == BOUND {
+			_ = b.transition(EXPIRED)
+			b.Expiration = now.Add(s.affinityTime())
+			s.schedule(b)
+			s.persist(b)
+			expired = append(expired, b.lease())
+			continue
+		}
+		_ = b.transition(FREE)
+		s.unschedule(b)
+		s.freeAddress(b.IP)
+		s.forget(b)
+	}
+	wait := idleExpiryWait
+	if len(s.expiry) > 0 {
+		wait = min(s.expiry[0].Expiration.Sub(now), idleExpiryWait)
+	}
+	onExpire := s.onExpire
+	s.mu.Unlock()
+
+	if onExpire != nil {
+		for _, l := range expired {
+			onExpire(l)
+		}
+	}
+	return wait
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"crypto/rand"
+	"dhcp/classify"
+	"dhcp/protocol"
+	"errors"
+	"fmt"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"net"
+	"slices"
+	"time"
+)
+
+// addForceRenewNonce adds b's FORCERENEW nonce to ack, creating and
+// storing it on first use (RFC 6704), so clients can still be forced to
+// renew after a restart. s.mu must be held.
+func (s *Server) addForceRenewNonce(b *binding, ack *protocol.Packet) {
+	if b.forceRenewKey == nil {
+		key := make([]byte, protocol.ForceRenewKeySize)
+		if _, err := rand.Read(key); err != nil {
+			slog.Error("Failed to generate FORCERENEW nonce", "error", err)
+			return
+		}
+		b.forceRenewKey = key
+		s.persist(b)
+	}
+	ack.AddForceRenewNonce(b.forceRenewKey, s.forceRenewReplay.Add(1))
+}
+
+// ForceRenew sends DHCPFORCERENEW to the client bound to ip, so it renews
+// at once rather than at T1. The client must have accepted a nonce.
+func (s *Server) ForceRenew(ip net.IP) error {
+	s.mu.RLock()
+	b := s.allocated[IPToUint32(ip)]
+	var packet *protocol.Packet
+	switch {
+	case b == nil || b.State != BOUND || b.expired(time.Now()):
+		s.mu.RUnlock()
+		return fmt.Errorf("no bound lease for %s", ip)
+	case b.forceRenewKey == nil:
+		s.mu.RUnlock()
+		return fmt.Errorf("client of %s does not accept authenticated FORCERENEW", ip)
+	default:
+		packet = s.forceRenewPacket(b)
+	}
+	s.mu.RUnlock()
+	return s.sendForceRenew(packet)
+}
+
+// ForceRenewPool sends DHCPFORCERENEW to every client bound to an address
+// in the named pool and returns how many were sent. Clients without a
+// nonce are skipped.
+func (s *Server) ForceRenewPool(name string) (int, error) {
+	s.mu.RLock()
+	p := s.namedPool(name)
+	if p == nil {
+		s.mu.RUnlock()
+		return 0, fmt.Errorf("unknown pool %q", name)
+	}
+	packets := s.forceRenewPackets(func(b *binding) bool { return p.Contains(b.IP) })
+	s.mu.RUnlock()
+	return s.sendForceRenews(packets)
+}
+
+// ForceRenewClass sends DHCPFORCERENEW to every bound client that was in
+// the named class when last acknowledged and returns how many were sent.
+// Clients without a nonce are skipped.
+func (s *Server) ForceRenewClass(name string) (int, error) {
+	s.mu.RLock()
+	if !slices.ContainsFunc(s.config.Classes, func(c classify.Class) bool { return c.Name == name }) {
+		s.mu.RUnlock()
+		return 0, fmt.Errorf("unknown class %q", name)
+	}
+	packets := s.forceRenewPackets(func(b *binding) bool { return slices.Contains(b.classes, name) })
+	s.mu.RUnlock()
+	return s.sendForceRenews(packets)
+}
+
+// forceRenewPackets builds a DHCPFORCERENEW for each bound client with a
+// nonce that match selects. s.mu must be held.
+func (s *Server) forceRenewPackets(match func(b *binding) bool) []*protocol.Packet {
+	now := time.Now()
+	var packets []*protocol.Packet
+	for _, b := range s.allocated {
+		if b.State != BOUND || b.expired(now) || b.forceRenewKey == nil || !match(b) {
+			continue
+		}
+		packets = append(packets, s.forceRenewPacket(b))
+	}
+	return packets
+}
+
+// forceRenewPacket builds a signed DHCPFORCERENEW for b. Leases imported
+// without a hardware type are taken to be Ethernet. s.mu must be held.
+func (s *Server) forceRenewPacket(b *binding) *protocol.Packet {
+	htype := b.HType
+	if htype == 0 {
+		htype = 1
+	}
+	return protocol.NewForceRenew(b.IP, htype, b.MAC, s.config.ServerIP, mathrand.Uint32(), b.forceRenewKey, s.forceRenewReplay.Add(1))
+}
+
+func (s *Server) sendForceRenews(packets []*protocol.Packet) (int, error) {
+	var errs []error
+	sent := 0
+	for _, p := range packets {
+		if err := s.sendForceRenew(p); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		sent++
+	}
+	return sent, errors.Join(errs...)
+}
+
+func (s *Server) sendForceRenew(p *protocol.Packet) error {
+	if err := protocol.SendPacket(s.conn, p, nil); err != nil {
+		return fmt.Errorf("failed to send FORCERENEW to %s: %w", p.CIAddr, err)
+	}
+	slog.Info("Sent FORCERENEW", "ip", p.CIAddr, "addr", p.CHAddr.String())
+	return nil
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"cmp"
+	"dhcp/store"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"time"
+)
+
+// LeaseState is the state of an address binding. FREE is never stored: a
+// binding that becomes FREE is removed and its address returned to the pool.
+type LeaseState = store.LeaseState
+
+const (
+	FREE      = store.FREE
+	OFFERED   = store.OFFERED
+	BOUND     = store.BOUND
+	EXPIRED   = store.EXPIRED
+	RELEASED  = store.RELEASED
+	DECLINED  = store.DECLINED
+	ABANDONED = store.ABANDONED
+)
+
+// validTransitions lists the states each state may move to.
+var validTransitions = map[LeaseState][]LeaseState{
+	FREE:      {OFFERED, BOUND, ABANDONED},
+	OFFERED:   {OFFERED, BOUND, FREE, DECLINED, ABANDONED, RELEASED},
+	BOUND:     {OFFERED, BOUND, EXPIRED, RELEASED, DECLINED, ABANDONED},
+	EXPIRED:   {OFFERED, BOUND, FREE},
+	RELEASED:  {OFFERED, BOUND, FREE},
+	DECLINED:  {FREE},
+	ABANDONED: {FREE},
+}
+
+func canTransition(from, to LeaseState) bool {
+	for _, s := range validTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// expired reports whether b has run out by now. A zero Expiration never
+// runs out.
+func (b *binding) expired(now time.Time) bool {
+	return !b.Expiration.IsZero() && b.Expiration.Before(now)
+}
+
+// isActive reports whether the client is currently using or being offered
+// the address.
+func (b *binding) isActive() bool {
+	return b.State == OFFERED || b.State == BOUND
+}
+
+// transition moves b to state to, rejecting transitions the state machine
+// does not allow.
+func (b *binding) transition(to LeaseState) error {
+	if !canTransition(b.State, to) {
+		return fmt.Errorf("invalid lease transition %s -> %s for %s", b.State, to, b.IP)
+	}
+	if b.State != to {
+		slog.Info("Lease state changed", "ip", b.IP, "mac", b.MAC.String(), "from", b.State, "to", to)
+	}
+	b.State = to
+	return nil
+}
+
+// rollback returns b to FREE after an acknowledgement that never reached
+// the client. Only a BOUND binding can be rolled back; the state machine
+// has no BOUND -> FREE transition otherwise.
+func (b *binding) rollback() error {
+	if b.State != BOUND {
+		return fmt.Errorf("invalid lease rollback %s -> %s for %s", b.State, FREE, b.IP)
+	}
+	slog.Info("Lease state rolled back", "ip", b.IP, "mac", b.MAC.String(), "from", b.State, "to", FREE)
+	b.State = FREE
+	return nil
+}
+
+// forget removes b from the client index if it is still the client's
+// binding. s.mu must be held.
+func (s *Server) forget(b *binding) {
+	key := string(b.ClientID)
+	if s.bindings[key] == b {
+		delete(s.bindings, key)
+	}
+}
+
+// freeAddress returns ip to its pool. s.mu must be held.
+func (s *Server) freeAddress(ip net.IP) {
+	ipUint := IPToUint32(ip)
+	b, exists := s.allocated[ipUint]
+	if !exists {
+		return
+	}
+	s.unschedule(b)
+	delete(s.allocated, ipUint)
+	if p := s.poolFor(ip); p != nil {
+		p.Release(ip)
+	}
+	if s.store != nil {
+		if err := s.store.Delete(ip); err != nil {
+			slog.Error("Failed to delete lease from store", "ip", ip, "error", err)
+		}
+	}
+}
+
+// lease returns the persisted form of b.
+func (b *binding) lease() *store.Lease {
+	return &store.Lease{
+		IP:             b.IP,
+		ClientID:       b.ClientID,
+		MAC:            b.MAC,
+		State:          b.State,
+		Expiration:     b.Expiration,
+		Start:          b.Start,
+		Hostname:       b.Hostname,
+		HType:          b.HType,
+		Classes:        b.classes,
+		RelayAgentInfo: b.relayAgentInfo,
+		ForceRenewKey:  b.forceRenewKey,
+	}
+}
+
+func bindingFromLease(l *store.Lease) *binding {
+	return &binding{
+		IP:             l.IP.To4(),
+		ClientID:       l.ClientID,
+		MAC:            l.MAC,
+		State:          l.State,
+		Expiration:     l.Expiration,
+		Start:          l.Start,
+		Hostname:       l.Hostname,
+		HType:          l.HType,
+		classes:        l.Classes,
+		relayAgentInfo: l.RelayAgentInfo,
+		forceRenewKey:  l.ForceRenewKey,
+	}
+}
+
+// persist writes b to the lease store. s.mu must be held.
+func (s *Server) persist(b *binding) {
+	if s.store == nil {
+		return
+	}
+	if err := s.store.Put(b.lease()); err != nil {
+		slog.Error("Failed to persist lease", "ip", b.IP, "error", err)
+	}
+}
+
+// bind records the offer l in the lease store. When another server holds
+// the address, its lease is adopted if known and store.ErrAddressInUse
+// returned. Any other store error is returned as well: without the store's
+// agreement the address may be handed out twice. Either way the address
+// selection is undone. s.mu must be held.
+func (s *Server) bind(l *store.Lease) error {
+	if s.store == nil {
+		return nil
+	}
+	holder, err := s.store.Bind(l)
+	if err == nil {
+		return nil
+	}
+	s.releaseSelection(l.IP)
+	if !errors.Is(err, store.ErrAddressInUse) {
+		slog.Error("Failed to bind lease", "ip", l.IP, "error", err)
+		return err
+	}
+	if holder != nil {
+		slog.Warn("Address bound elsewhere, adopting lease", "ip", l.IP, "state", holder.State)
+		s.adopt(holder)
+	} else {
+		slog.Warn("Address contended by another server", "ip", l.IP, "error", err)
+	}
+	return err
+}
+
+// releaseSelection undoes the allocation selectAddress made for ip when
+// the address turned out to be unusable: a fresh pool allocation or an
+// affine address reclaimed from its last owner. s.mu must be held.
+func (s *Server) releaseSelection(ip net.IP) {
+	ipUint := IPToUint32(ip)
+	b := s.allocated[ipUint]
+	if b != nil && b.State != FREE {
+		return
+	}
+	if b != nil {
+		s.unschedule(b)
+	}
+	delete(s.allocated, ipUint)
+	if p := s.poolFor(ip); p != nil {
+		p.Release(ip)
+	}
+}
+
+// adopt installs a binding for a lease read from the store. It reports
+// false if the address is outside every pool or already in use locally.
+// s.mu must be held.
+func (s *Server) adopt(l *store.Lease) bool {
+	p := s.poolFor(l.IP)
+	if p == nil || !p.AllocateIP(l.IP) {
+		return false
+	}
+	b := bindingFromLease(l)
+	s.allocated[IPToUint32(l.IP)] = b
+	s.schedule(b)
+	if b.State != DECLINED && b.State != ABANDONED {
+		if _, exists := s.bindings[string(b.ClientID)]; !exists {
+			s.bindings[string(b.ClientID)] = b
+		}
+	}
+	return true
+}
+
+// restoreLeases rebuilds bindings and pool state from the lease store.
+// Leases that have run out, fall outside every pool or collide with an
+// address already restored are dropped.
+func (s *Server) restoreLeases(now time.Time) error {
+	leases, err := s.store.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load leases: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var restored int
+	for _, l := range leases {
+		switch {
+		case l.State == FREE || l.Expired(now):
+		case !s.adopt(l):
+			slog.Warn("Dropping stored lease outside every pool or for an address in use", "ip", l.IP)
+		default:
+			restored++
+			continue
+		}
+		if err := s.store.Delete(l.IP); err != nil {
+			return fmt.Errorf("failed to drop lease %s: %w", l.IP, err)
+		}
+	}
+	slog.Info("Restored leases", "count", restored, "stored", len(leases))
+	return nil
+}
+
+// Leases returns a snapshot of every binding that holds an address,
+// ordered by IP.
+func (s *Server) Leases() []*store.Lease {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	leases := make([]*store.Lease, 0, len(s.allocated))
+	for _, b := range s.allocated {
+		leases = append(leases, b.lease())
+	}
+	slices.SortFunc(leases, func(a, b *store.Lease) int {
+		return cmp.Compare(IPToUint32(a.IP), IPToUint32(b.IP))
+	})
+	return leases
+}
+
+// ImportLeases loads leases migrated from another server and persists
+// them. A lease is skipped, and reported in the returned error, if it has
+// run out, falls outside every pool, its address is already in use or its
+// client already holds another address.
+func (s *Server) ImportLeases(leases []*store.Lease, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var imported int
+	var errs []error
+	for _, l := range leases {
+		_, clientBound := s.bindings[string(l.ClientID)]
+		switch {
+		case l.State == FREE || l.Expired(now):
+			errs = append(errs, fmt.Errorf("%s: lease has run out", l.IP))
+		case s.poolFor(l.IP) == nil:
+			errs = append(errs, fmt.Errorf("%s: outside every pool", l.IP))
+		case s.allocated[IPToUint32(l.IP)] != nil:
+			errs = append(errs, fmt.Errorf("%s: address already in use", l.IP))
+		case l.State != DECLINED && l.State != ABANDONED && clientBound:
+			errs = append(errs, fmt.Errorf("%s: client %x already holds an address", l.IP, l.ClientID))
+		case !s.adopt(l):
+			errs = append(errs, fmt.Errorf("%s: address already in use", l.IP))
+		default:
+			s.persist(s.allocated[IPToUint32(l.IP)])
+			imported++
+		}
+	}
+	slog.Info("Imported leases", "imported", imported, "skipped", len(errs))
+	return imported, errors.Join(errs...)
+}
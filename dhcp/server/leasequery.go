@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bytes"
+	"dhcp/protocol"
+	"errors"
+	"log/slog"
+	"net"
+	"slices"
+	"time"
+)
+
+// LeaseQueryConfig enables answering DHCPLEASEQUERY (RFC 4388), which
+// relays and access concentrators use to rebuild their view of who holds
+// which address.
+type LeaseQueryConfig struct {
+	Enabled bool
+	// Allowed restricts the requesters, identified by giaddr or, over
+	// TCP, by their address, that are answered. Empty allows any.
+	Allowed []net.IPNet
+	// Listen is the TCP address, usually ":67", on which bulk leasequery
+	// (RFC 6926) is served. Empty disables it.
+	Listen string
+	// MaxConnections limits concurrent bulk leasequery connections.
+	// Defaults to 10.
+	MaxConnections int
+	// Timeout closes a bulk leasequery connection that sends no query, or
+	// does not read a reply, for that long. Defaults to 5 minutes.
+	Timeout time.Duration
+}
+
+func (c *LeaseQueryConfig) validate() error {
+	if c.MaxConnections < 0 {
+		return errors.New("leasequery connection limit must not be negative")
+	}
+	if c.Timeout < 0 {
+		return errors.New("leasequery timeout must not be negative")
+	}
+	return nil
+}
+
+// allows reports whether requester may query leases.
+func (c *LeaseQueryConfig) allows(requester net.IP) bool {
+	if !c.Enabled {
+		return false
+	}
+	if len(c.Allowed) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(c.Allowed, func(n net.IPNet) bool { return n.Contains(requester) })
+}
+
+func (s *Server) handleLeaseQuery(packet *protocol.Packet, addr *net.UDPAddr) {
+	reply := s.createLeaseQueryReply(packet, time.Now())
+	if reply == nil {
+		return
+	}
+	if err := protocol.SendPacket(s.conn, reply, addr); err != nil {
+		slog.Error("Error sending leasequery reply", "error", err)
+	}
+}
+
+// createLeaseQueryReply answers a DHCPLEASEQUERY. The query is by ciaddr
+// if set, else by the client identifier option, else by chaddr (RFC 4388
+// section 6.1). Queries without giaddr, from requesters not allowed or
+// naming nothing to look up are ignored.
+func (s *Server) createLeaseQueryReply(packet *protocol.Packet, now time.Time) *protocol.Packet {
+	if isZeroIP(packet.GIAddr) {
+		slog.Debug("Ignoring DHCPLEASEQUERY without giaddr")
+		return nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.config.LeaseQuery.allows(packet.GIAddr) {
+		slog.Debug("Ignoring DHCPLEASEQUERY from requester not allowed", "giaddr", packet.GIAddr)
+		return nil
+	}
+
+	var messageType byte
+	var lease *protocol.LeaseInfo
+	clientID := packet.GetOption(protocol.OptionClientIdentifier)
+	switch {
+	case !isZeroIP(packet.CIAddr):
+		messageType, lease = s.queryByIP(packet.CIAddr, now)
+	case len(clientID) > 0:
+		messageType, lease = s.queryByClient(func(b *binding) bool { return bytes.Equal(b.ClientID, clientID) }, now)
+	case packet.HLen > 0 && !isZeroMAC(packet.HardwareAddr()):
+		mac := packet.HardwareAddr()
+		messageType, lease = s.queryByClient(func(b *binding) bool { return bytes.Equal(b.MAC, mac) }, now)
+	default:
+		slog.Debug("Ignoring DHCPLEASEQUERY without ciaddr, client identifier or chaddr", "giaddr", packet.GIAddr)
+		return nil
+	}
+	slog.Info("Answering DHCPLEASEQUERY", "giaddr", packet.GIAddr, "ciaddr", packet.CIAddr, "addr", packet.HardwareAddr().String(), "reply", messageType)
+	return packet.ToLeaseQueryReply(messageType, s.config.ServerIP, lease, now)
+}
+
+// queryByIP looks up the holder of ip. An address the server manages but
+// has not leased is unassigned; one it does not manage is unknown. s.mu
+// must be held.
+func (s *Server) queryByIP(ip net.IP, now time.Time) (byte, *protocol.LeaseInfo) {
+	b := s.allocated[IPToUint32(ip)]
+	switch {
+	case b != nil && b.State == BOUND && !b.expired(now):
+		return protocol.DHCPLEASEACTIVE, b.leaseInfo()
+	case b != nil || s.poolFor(ip) != nil:
+		return protocol.DHCPLEASEUNASSIGNED, nil
+	default:
+		return protocol.DHCPLEASEUNKNOWN, nil
+	}
+}
+
+// queryByClient looks up the addresses bound to the client that match
+// selects. The reply describes the most recently used one and lists all
+// of them as associated addresses. s.mu must be held.
+func (s *Server) queryByClient(match func(b *binding) bool, now time.Time) (byte, *protocol.LeaseInfo) {
+	var bound []*binding
+	for _, b := range s.allocated {
+		if b.State == BOUND && !b.expired(now) && match(b) {
+			bound = append(bound, b)
+		}
+	}
+	if len(bound) == 0 {
+		return protocol.DHCPLEASEUNKNOWN, nil
+	}
+	slices.SortFunc(bound, func(a, b *binding) int { return b.Start.Compare(a.Start) })
+	lease := bound[0].leaseInfo()
+	for _, b := range bound {
+		lease.Associated = append(lease.Associated, b.IP)
+	}
+	return protocol.DHCPLEASEACTIVE, lease
+}
+
+func (b *binding) leaseInfo() *protocol.LeaseInfo {
+	return &protocol.LeaseInfo{
+		IP:             b.IP,
+		MAC:            b.MAC,
+		ClientID:       b.ClientID,
+		HType:          b.HType,
+		Start:          b.Start,
+		Expiration:     b.Expiration,
+		RelayAgentInfo: b.relayAgentInfo,
+	}
+}
+
+func isZeroMAC(mac net.HardwareAddr) bool {
+	return !slices.ContainsFunc(mac, func(b byte) bool { return b != 0 })
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// defaultWorkers spreads clients widely enough that a slow lease
+	// store delays few others. Conflict probes run off the workers.
+	defaultWorkers    = 64
+	defaultQueueDepth = 64
+
+	// chaddrOffset and hlenOffset locate the client hardware address in a
+	// raw BOOTP message.
+	hlenOffset   = 2
+	chaddrOffset = 28
+)
+
+// pipeline hands packets from the reader to a fixed set of workers. All
+// packets from one chaddr go to the same worker, so they are processed in
+// arrival order. A full worker queue drops the packet instead of blocking
+// the reader.
+type pipeline struct {
+	queues []chan *input
+
+	received  atomic.Uint64
+	dropped   atomic.Uint64
+	processed atomic.Uint64
+}
+
+// PipelineStats counts packets through the server's pipeline.
+type PipelineStats struct {
+	Received  uint64
+	Dropped   uint64
+	Processed uint64
+}
+
+func newPipeline(workers, depth int) *pipeline {
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	if depth <= 0 {
+		depth = defaultQueueDepth
+	}
+	p := &pipeline{queues: make([]chan *input, workers)}
+	for i := range p.queues {
+		p.queues[i] = make(chan *input, depth)
+	}
+	return p
+}
+
+// start runs one goroutine per worker queue, calling handle for each
+// packet until the queue is closed and drained.
+func (p *pipeline) start(wg *sync.WaitGroup, handle func(in *input)) {
+	for _, q := range p.queues {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for in := range q {
+				handle(in)
+				p.processed.Add(1)
+			}
+		}()
+	}
+}
+
+// dispatch queues in on its client's worker, reporting false if the queue
+// was full and the packet dropped. Only the reader may call dispatch.
+func (p *pipeline) dispatch(in *input) bool {
+	p.received.Add(1)
+	select {
+	case p.queues[p.worker(in.data)] <- in:
+		return true
+	default:
+		p.dropped.Add(1)
+		return false
+	}
+}
+
+// close stops accepting packets; workers finish what is queued. Only the
+// reader may call close, after its last dispatch.
+func (p *pipeline) close() {
+	for _, q := range p.queues {
+		close(q)
+	}
+}
+
+// worker picks the queue for a raw packet by hashing its chaddr.
+func (p *pipeline) worker(data []byte) int {
+	if len(p.queues) == 1 || len(data) < chaddrOffset+16 {
+		return 0
+	}
+	hlen := min(int(data[hlenOffset]), 16)
+	h := fnv.New32a()
+	h.Write(data[chaddrOffset : chaddrOffset+hlen])
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
+
+func (p *pipeline) stats() PipelineStats {
+	return PipelineStats{
+		Received:  p.received.Load(),
+		Dropped:   p.dropped.Load(),
+		Processed: p.processed.Load(),
+	}
+}
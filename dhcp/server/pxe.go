@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"dhcp/protocol"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+)
+
+// Client system architectures from option 93 (RFC 4578, IANA "Processor
+// Architecture Types").
+const (
+	archBIOS       = 0
+	archEFIBC      = 7
+	archEFIx64     = 9
+	archEFIARM64   = 11
+	archEFIHTTPx64 = 16
+)
+
+// PXEConfig enables network boot for PXE and UEFI clients, which announce
+// themselves with option 60 "PXEClient" or "HTTPClient" and give their
+// architecture in option 93. Each architecture gets its own boot file; an
+// empty one leaves those clients without boot information.
+type PXEConfig struct {
+	Enabled bool
+	// NextServer is the TFTP server, sent in siaddr and option 66.
+	// Defaults to ServerIP.
+	NextServer net.IP
+	// BIOS is the boot file for legacy PXE clients, UEFI for x86-64 UEFI,
+	// ARM64 for 64-bit ARM UEFI and HTTP the URL for x86-64 UEFI HTTP
+	// boot.
+	BIOS  string
+	UEFI  string
+	ARM64 string
+	HTTP  string
+	// IPXEScript is the URL of the script that iPXE, recognised by user
+	// class "iPXE" in option 77, is chainloaded to. Without it iPXE would
+	// be handed the boot file that loads iPXE again.
+	IPXEScript string
+}
+
+// bootFile returns the boot file for a client of architecture arch.
+func (c *PXEConfig) bootFile(arch uint16) string {
+	switch arch {
+	case archBIOS:
+		return c.BIOS
+	case archEFIBC, archEFIx64:
+		return c.UEFI
+	case archEFIARM64:
+		return c.ARM64
+	case archEFIHTTPx64:
+		return c.HTTP
+	}
+	return ""
+}
+
+func (c *PXEConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.NextServer != nil && c.NextServer.To4() == nil {
+		return fmt.Errorf("PXE next server %s is not an IPv4 address", c.NextServer)
+	}
+	return nil
+}
+
+// addBootOptions adds boot information to options if packet comes from a
+// network boot client: siaddr, the boot file in the file field and option
+// 67, the TFTP server in option 66, and option 60 and the client's options
+// 97 and 94 echoed back as PXE requires. Options already set by a client
+// class are kept. s.mu must be held.
+func (s *Server) addBootOptions(packet *protocol.Packet, options *protocol.ReplyOptions) {
+	cfg := &s.config.PXE
+	if !cfg.Enabled {
+		return
+	}
+	vendor := packet.GetOption(protocol.OptionClassIdentifier)
+	http := bytes.HasPrefix(vendor, []byte("HTTPClient"))
+	ipxe := bytes.Equal(packet.GetOption(protocol.OptionUserClass), []byte("iPXE"))
+	if !ipxe && !http && !bytes.HasPrefix(vendor, []byte("PXEClient")) {
+		return
+	}
+
+	// Clients that predate option 93 are BIOS PXE ROMs.
+	var arch uint16 = archBIOS
+	if data := packet.GetOption(protocol.OptionClientSystemArch); len(data) >= 2 {
+		arch = binary.BigEndian.Uint16(data)
+	}
+	file := cfg.bootFile(arch)
+	if ipxe && cfg.IPXEScript != "" {
+		file = cfg.IPXEScript
+	}
+	if file == "" {
+		slog.Debug("No boot file for network boot client", "addr", packet.HardwareAddr().String(), "arch", arch)
+		return
+	}
+
+	set := func(code byte, data []byte) {
+		if options.Extra == nil {
+			options.Extra = make(map[byte][]byte)
+		}
+		if _, ok := options.Extra[code]; !ok {
+			options.Extra[code] = data
+		}
+	}
+	options.NextServer = cfg.NextServer
+	options.BootFile = file
+	set(protocol.OptionBootfileName, []byte(file))
+	if http {
+		set(protocol.OptionClassIdentifier, []byte("HTTPClient"))
+	} else {
+		set(protocol.OptionClassIdentifier, []byte("PXEClient"))
+		nextServer := cfg.NextServer
+		if nextServer == nil {
+			nextServer = s.config.ServerIP
+		}
+		set(protocol.OptionTFTPServerName, []byte(nextServer.String()))
+	}
+	for _, code := range []byte{protocol.OptionClientMachineID, protocol.OptionClientNDI} {
+		if data := packet.GetOption(code); data != nil {
+			set(code, data)
+		}
+	}
+	slog.Info("Network boot client", "addr", packet.HardwareAddr().String(), "arch", arch, "ipxe", ipxe, "file", file)
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"dhcp/classify"
+	"dhcp/pool"
+	"dhcp/store"
+	"fmt"
+	"log/slog"
+	"net"
+)
+
+// buildScopes validates cfg and builds its pools and classifier.
+func buildScopes(cfg *Config) ([]*namedPool, *classify.Classifier, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	poolConfigs := cfg.Pools
+	if len(poolConfigs) == 0 {
+		poolConfigs = []PoolConfig{{Start: cfg.Start, End: cfg.End}}
+	}
+	pools := make([]*namedPool, 0, len(poolConfigs))
+	for _, pc := range poolConfigs {
+		ranges := pc.Ranges
+		if len(ranges) == 0 {
+			ranges = []pool.Range{{Start: pc.Start, End: pc.End}}
+		}
+		var exclude []*net.IPNet
+		for _, list := range [][]net.IPNet{cfg.Exclude, pc.Exclude} {
+			for i := range list {
+				exclude = append(exclude, &list[i])
+			}
+		}
+		ipPool, err := pool.New(ranges, exclude)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create IP pool %q: %w", pc.Name, err)
+		}
+		if other := overlappingPool(pools, ipPool); other != nil {
+			return nil, nil, fmt.Errorf("pool %q overlaps pool %q", pc.Name, other.name)
+		}
+		strategy, err := pool.StrategyByName(pc.Strategy)
+		if err != nil {
+			return nil, nil, fmt.Errorf("pool %q: %w", pc.Name, err)
+		}
+		ipPool.SetStrategy(strategy)
+		pools = append(pools, &namedPool{name: pc.Name, IPPool: ipPool})
+	}
+
+	for _, h := range cfg.BOOTP.Hosts {
+		if p := findPool(pools, h.IP); p != nil {
+			return nil, nil, fmt.Errorf("BOOTP host %s: address %s is in pool %q; exclude it", h.MAC, h.IP, p.name)
+		}
+	}
+
+	classifier, err := classify.New(cfg.Classes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid client classes: %w", err)
+	}
+	return pools, classifier, nil
+}
+
+// Reload validates cfg and atomically replaces the reply options, pools
+// and client classes. Bindings are kept: addresses that fall outside the
+// new pools are flagged, NAKed on renewal so the client moves, and freed
+// when they expire. Store, Workers, QueueDepth, Probe.Mode and the bulk
+// leasequery listener only take effect at startup and are carried over.
+func (s *Server) Reload(cfg *Config) error {
+	next := *cfg
+	s.mu.RLock()
+	current := s.config
+	s.mu.RUnlock()
+	next.Store = current.Store
+	next.Workers = current.Workers
+	next.QueueDepth = current.QueueDepth
+	next.Probe.Mode = current.Probe.Mode
+	next.LeaseQuery.Listen = current.LeaseQuery.Listen
+	next.LeaseQuery.MaxConnections = current.LeaseQuery.MaxConnections
+
+	pools, classifier, err := buildScopes(&next)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var flagged int
+	for _, b := range s.allocated {
+		p := findPool(pools, b.IP)
+		b.outOfRange = p == nil || !p.AllocateIP(b.IP)
+		if b.outOfRange {
+			flagged++
+			slog.Warn("Lease outside the reloaded pools", "ip", b.IP, "state", b.State, "addr", b.MAC.String())
+		}
+	}
+	s.config, s.pools, s.classifier = &next, pools, classifier
+	slog.Info("Configuration reloaded", "pools", len(pools), "classes", len(next.Classes), "outOfRange", flagged)
+	return nil
+}
+
+// OutOfRangeLeases returns the leases whose addresses left every pool in
+// a reload.
+func (s *Server) OutOfRangeLeases() []*store.Lease {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var leases []*store.Lease
+	for _, b := range s.allocated {
+		if b.outOfRange {
+			leases = append(leases, b.lease())
+		}
+	}
+	return leases
+}
+
+func findPool(pools []*namedPool, ip net.IP) *namedPool {
+	for _, p := range pools {
+		if p.Contains(ip) {
+			return p
+		}
+	}
+	return nil
+}
@@ -1,18 +1,21 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"dhcp/classify"
 	"dhcp/pool"
+	"dhcp/probe"
 	"dhcp/protocol"
+	"dhcp/store"
 	"dhcp/transport"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net"
-	"os"
-	"os/signal"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,9 +27,17 @@ const (
 	InvalidState         = -1
 	defaultMTU           = 1500
 	defaultReadTimeout   = 500 * time.Millisecond
-	leaseCleanupInterval = 1 * time.Minute
+	defaultOfferHoldTime = 30 * time.Second
+	defaultProbeTimeout  = 500 * time.Millisecond
+	defaultAbandonTime   = 10 * time.Minute
+	defaultDeclineTime   = 24 * time.Hour
+	maxProbeAttempts     = 5
 )
 
+// ErrServerStarted is returned by Serve on a server that was already
+// started.
+var ErrServerStarted = errors.New("server already started")
+
 var bufPool = sync.Pool{
 	New: func() interface{} {
 		return make([]byte, 1500)
@@ -34,51 +45,223 @@ var bufPool = sync.Pool{
 }
 
 type Server struct {
-	mu          sync.RWMutex
-	bindings    map[uint64]*binding
-	allocated   map[uint32]bool
-	ipPool      *pool.IPPool
-	config      *Config
-	conn        net.PacketConn
-	wg          sync.WaitGroup
-	processChan chan *input
-	mtu         int
+	mu        sync.RWMutex
+	bindings  map[string]*binding
+	allocated map[uint32]*binding
+	// probing holds the keys of clients whose offer waits on a conflict
+	// probe. Guarded by mu.
+	probing map[string]bool
+	// pools, classifier and config are replaced by Reload; read them
+	// with mu held.
+	pools      []*namedPool
+	classifier *classify.Classifier
+	config     *Config
+	conn       net.PacketConn
+	wg         sync.WaitGroup
+	pipeline   *pipeline
+	mtu        int
+	// bulkListener accepts bulk leasequery connections, or is nil.
+	bulkListener net.Listener
+
+	lifecycleMu sync.Mutex
+	started     bool
+	stop        context.CancelFunc
+	ready       chan struct{}
+	done        chan struct{}
+
+	// localProber checks addresses for clients on the serving link,
+	// relayProber for relayed clients. Nil disables probing.
+	localProber probe.Prober
+	relayProber probe.Prober
+	store       store.LeaseStore
+
+	expiry     expiryHeap
+	expiryWake chan struct{}
+	onExpire   func(l *store.Lease)
+
+	conflictsMu sync.Mutex
+	conflicts   []ConflictEvent
 
-	cachedReplyOptions *protocol.ReplyOptions
+	// forceRenewReplay is the replay detection counter of the
+	// Authentication option. It starts from the clock so it keeps
+	// increasing across restarts.
+	forceRenewReplay atomic.Uint64
+}
+
+type namedPool struct {
+	name string
+	*pool.IPPool
 }
 
 type input struct {
 	data []byte
 	addr *net.UDPAddr
+	// buf is returned to bufPool once the packet has been decoded.
+	buf []byte
 }
 
 type Config struct {
-	Start         net.IP
-	End           net.IP
-	Subnet        net.IPNet
-	Lease         time.Duration
+	Start  net.IP
+	End    net.IP
+	Subnet net.IPNet
+	// Lease is the lease time granted to clients that do not ask for one.
+	Lease time.Duration
+	// MinLease and MaxLease bound the lease time a client may ask for in
+	// option 51. Zero MinLease sets no lower bound; zero MaxLease means
+	// Lease.
+	MinLease time.Duration
+	MaxLease time.Duration
+	// RenewalTime and RebindingTime are T1 and T2 for a lease of length
+	// Lease. Other lease times get T1 and T2 in the same proportion.
+	// Default to 50% and 87.5% of the lease.
 	RenewalTime   time.Duration
 	RebindingTime time.Duration
 	DNS           []net.IP
 	Router        net.IP
 	ServerIP      net.IP
 	DomainName    string
+	// OfferHoldTime is how long an offered address is reserved for the
+	// client to request it. Defaults to 30 seconds.
+	OfferHoldTime time.Duration
+	// AffinityTime is how long an expired or released address stays
+	// reserved for its last owner. Defaults to the lease time.
+	AffinityTime time.Duration
+	// DeclineTime is how long an address declined by a client is
+	// quarantined. Defaults to 24 hours.
+	DeclineTime time.Duration
+	// Pools splits the address space into named pools that client classes
+	// can be restricted to. If empty, a single pool covers Start to End.
+	Pools   []PoolConfig
+	Classes []classify.Class
+	// Authoritative declares this server the only one for the subnet. A
+	// client asking to keep an address the server has no record of is
+	// NAKed so it restarts discovery at once; otherwise the request is
+	// ignored, as another server may own the lease.
+	Authoritative bool
+	// RapidCommit lets clients that ask for it with option 80 in their
+	// DHCPDISCOVER skip the OFFER/REQUEST round: the address is bound at
+	// once and acknowledged (RFC 4039).
+	RapidCommit bool
+	// Exclude lists addresses and networks, such as gateways and HSRP
+	// VIPs, that no pool may hand out.
+	Exclude []net.IPNet
+	Probe   ProbeConfig
+	BOOTP   BOOTPConfig
+	PXE     PXEConfig
+	// LeaseQuery answers DHCPLEASEQUERY from relays.
+	LeaseQuery LeaseQueryConfig
+	// Workers is the number of packets processed concurrently. Packets
+	// from the same client are always processed in order. Defaults to 64.
+	Workers int
+	// QueueDepth is the number of packets each worker buffers before new
+	// ones are dropped. Defaults to 64.
+	QueueDepth int
+	// Store persists leases across restarts. Nil keeps them in memory
+	// only.
+	Store store.LeaseStore
+}
+
+// ProbeConfig enables checking that an address is unused before offering
+// it. Addresses that answer are marked ABANDONED for AbandonTime.
+type ProbeConfig struct {
+	// Mode is "arp" to ARP for clients on the serving interface and ping
+	// relayed ones, "icmp" to ping every address, or "" to disable.
+	Mode string
+	// Timeout bounds each probe. Defaults to 500ms.
+	Timeout time.Duration
+	// AbandonTime is how long a conflicting address is withheld.
+	// Defaults to 10 minutes.
+	AbandonTime time.Duration
+}
+
+type PoolConfig struct {
+	Name string
+	// Start and End give a single range; use Ranges for several.
+	Start  net.IP
+	End    net.IP
+	Ranges []pool.Range
+	// Exclude lists addresses and networks inside the ranges that this
+	// pool must not hand out, in addition to Config.Exclude.
+	Exclude []net.IPNet
+	// Strategy selects how free addresses are chosen: "sequential" (the
+	// default), "random" or "hash" of the client identifier.
+	Strategy string
 }
 
 func (c *Config) Validate() error {
 	if c.Lease <= 0 {
 		return errors.New("lease duration must be positive")
 	}
+	if c.MinLease < 0 || c.MinLease > c.Lease {
+		return errors.New("minimum lease duration must be between zero and the lease duration")
+	}
+	if c.MaxLease != 0 && c.MaxLease < c.Lease {
+		return errors.New("maximum lease duration must not be shorter than the lease duration")
+	}
+	if c.RenewalTime < 0 || c.RebindingTime < 0 || c.RenewalTime > c.Lease || c.RebindingTime > c.Lease {
+		return errors.New("renewal and rebinding times must be between zero and the lease duration")
+	}
 	if !c.Subnet.Contains(c.ServerIP) {
 		return errors.New("server IP must be within subnet")
 	}
-	return nil
+	switch c.Probe.Mode {
+	case "", "arp", "icmp":
+	default:
+		return fmt.Errorf("unknown probe mode %q", c.Probe.Mode)
+	}
+	names := make(map[string]bool, len(c.Pools))
+	for _, p := range c.Pools {
+		if names[p.Name] {
+			return fmt.Errorf("duplicate pool %q", p.Name)
+		}
+		names[p.Name] = true
+	}
+	for _, class := range c.Classes {
+		if class.MinLease < 0 || class.MaxLease < 0 || class.MaxLease != 0 && class.MinLease > class.MaxLease {
+			return fmt.Errorf("class %q: minimum lease duration must not exceed the maximum", class.Name)
+		}
+		for _, name := range class.Pools {
+			if !names[name] {
+				return fmt.Errorf("class %q refers to unknown pool %q", class.Name, name)
+			}
+		}
+	}
+	if err := c.LeaseQuery.validate(); err != nil {
+		return err
+	}
+	if err := c.PXE.validate(); err != nil {
+		return err
+	}
+	return c.BOOTP.validate(c, names)
 }
 
 type binding struct {
 	IP         net.IP
+	ClientID   []byte
 	MAC        net.HardwareAddr
+	State      LeaseState
 	Expiration time.Time
+	// Start is the client's last transaction time.
+	Start    time.Time
+	Hostname string
+	// HType is the hardware type of MAC, zero if unknown.
+	HType byte
+	// heapIndex is the binding's position in the expiry heap plus one,
+	// or zero when it is not scheduled.
+	heapIndex int
+	// outOfRange marks an address left outside every pool by a reload.
+	outOfRange bool
+	// leaseTime is the lease time last offered or granted.
+	leaseTime time.Duration
+	// classes names the client classes the client was in when last
+	// acknowledged.
+	classes []string
+	// forceRenewKey is the nonce handed to a client that accepts
+	// authenticated DHCPFORCERENEW, or nil.
+	forceRenewKey []byte
+	// relayAgentInfo is option 82 from the client's last request, which
+	// leasequery reports and matches relay and remote IDs against.
+	relayAgentInfo []byte
 }
 
 type Offer struct {
@@ -88,22 +271,11 @@ type Offer struct {
 }
 
 func NewServer(cfg *Config) (*Server, error) {
-	if err := cfg.Validate(); err != nil {
-		return nil, fmt.Errorf("invalid configuration: %w", err)
-	}
-
-	ipPool, err := pool.NewIPPool(cfg.Start, cfg.End)
+	s, err := newServer(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create IP pool: %w", err)
+		return nil, err
 	}
 
-	s := &Server{
-		bindings:    make(map[uint64]*binding),
-		allocated:   make(map[uint32]bool),
-		ipPool:      ipPool,
-		config:      cfg,
-		processChan: make(chan *input, 100),
-	}
 	s.mtu, err = transport.GetMTU()
 	if err != nil {
 		slog.Error("Error getting MTU, using default", "error", err, "defaultMTU", defaultMTU)
@@ -116,46 +288,131 @@ func NewServer(cfg *Config) (*Server, error) {
 	}
 	s.conn = conn
 
+	switch cfg.Probe.Mode {
+	case "arp":
+		ifaceName, err := transport.InterfaceName()
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up ARP probing: %w", err)
+		}
+		arp, err := probe.NewARP(ifaceName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up ARP probing: %w", err)
+		}
+		s.localProber, s.relayProber = arp, probe.ICMP{}
+	case "icmp":
+		s.localProber, s.relayProber = probe.ICMP{}, probe.ICMP{}
+	}
+
+	if lq := cfg.LeaseQuery; lq.Enabled && lq.Listen != "" {
+		if s.bulkListener, err = net.Listen("tcp", lq.Listen); err != nil {
+			return nil, fmt.Errorf("failed to listen for bulk leasequery: %w", err)
+		}
+	}
+
 	return s, nil
 }
 
-func (s *Server) Run() {
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
-	withCancel, cancelFunc := context.WithCancel(context.Background())
-	runAsync(withCancel, &s.wg, s.run)
+// NewOfflineServer returns a server that is not attached to the network,
+// for working with the leases in cfg.Store, such as importing and
+// exporting them. It cannot Serve.
+func NewOfflineServer(cfg *Config) (*Server, error) {
+	return newServer(cfg)
+}
+
+func newServer(cfg *Config) (*Server, error) {
+	pools, classifier, err := buildScopes(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	select {
-	case <-sig:
-		slog.Info("Received signal, stopping server")
-		cancelFunc()
-		close(s.processChan)
+	s := &Server{
+		bindings:   make(map[string]*binding),
+		allocated:  make(map[uint32]*binding),
+		probing:    make(map[string]bool),
+		pools:      pools,
+		classifier: classifier,
+		config:     cfg,
+		pipeline:   newPipeline(cfg.Workers, cfg.QueueDepth),
+		store:      cfg.Store,
+		expiryWake: make(chan struct{}, 1),
+		ready:      make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	s.forceRenewReplay.Store(uint64(time.Now().UnixNano()))
+	if s.store != nil {
+		if err := s.restoreLeases(time.Now()); err != nil {
+			return nil, err
+		}
 	}
-	slog.Info("waiting for all goroutines to finish")
+	return s, nil
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// Serve processes packets until ctx is cancelled or Shutdown is called,
+// then drains queued packets in order and closes the connection. It
+// returns nil after a clean stop and the error that stopped it otherwise.
+// Ready is closed once the server is accepting packets.
+func (s *Server) Serve(ctx context.Context) error {
+	if s.conn == nil {
+		return errors.New("server has no connection")
+	}
+	s.lifecycleMu.Lock()
+	if s.started {
+		s.lifecycleMu.Unlock()
+		return ErrServerStarted
+	}
+	s.started = true
+	ctx, s.stop = context.WithCancel(ctx)
+	s.lifecycleMu.Unlock()
+	defer close(s.done)
+	defer s.stop()
 
-	done := make(chan struct{})
+	s.pipeline.start(&s.wg, s.processPacket)
+	runAsync(ctx, &s.wg, s.runExpiry)
+	if s.bulkListener != nil {
+		runAsync(ctx, &s.wg, s.serveBulkLeaseQuery)
+	}
+	readErr := make(chan error, 1)
+	// Wake a reader blocked in ReadFrom instead of waiting out its deadline.
+	defer context.AfterFunc(ctx, func() { _ = s.conn.SetReadDeadline(time.Now()) })()
+	s.wg.Add(1)
 	go func() {
-		s.wg.Wait()
-		close(done)
+		defer s.wg.Done()
+		readErr <- s.startReadConn(ctx)
 	}()
+	close(s.ready)
+
+	err := <-readErr
+	s.stop()
+	s.wg.Wait()
+	if closeErr := s.conn.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to close connection: %w", closeErr)
+	}
+	return err
+}
+
+// Shutdown stops a running Serve and waits for queued packets to be
+// processed. If ctx ends first, Shutdown returns its error while Serve
+// keeps draining in the background.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lifecycleMu.Lock()
+	started, stop := s.started, s.stop
+	s.lifecycleMu.Unlock()
+	if !started {
+		return nil
+	}
+	stop()
 
 	select {
-	case <-done:
-		slog.Info("All goroutines completed")
+	case <-s.done:
+		return nil
 	case <-ctx.Done():
-		slog.Error("Timed out waiting for goroutines to complete")
+		return ctx.Err()
 	}
-
-	slog.Info("Server stopped")
 }
 
-func (s *Server) run(ctx context.Context) {
-	runAsync(ctx, &s.wg, s.processPackets)
-	runAsync(ctx, &s.wg, s.cleanupExpiredLeases)
-	runAsync(ctx, &s.wg, s.startReadConn)
+// Ready is closed once Serve is accepting packets.
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
 }
 
 func runAsync(ctx context.Context, wg *sync.WaitGroup, f func(ctx context.Context)) {
@@ -166,51 +423,68 @@ func runAsync(ctx context.Context, wg *sync.WaitGroup, f func(ctx context.Contex
 	}()
 }
 
-func (s *Server) startReadConn(ctx context.Context) {
+// startReadConn reads packets and dispatches them to the pipeline until
+// ctx is done or reading fails, then closes the pipeline so the workers
+// drain their queues.
+func (s *Server) startReadConn(ctx context.Context) error {
+	defer s.pipeline.close()
+
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return nil
 		default:
 			_ = s.conn.SetReadDeadline(time.Now().Add(defaultReadTimeout))
 			buf := bufPool.Get().([]byte)
 			n, addr, err := s.conn.ReadFrom(buf)
 			if err != nil {
+				bufPool.Put(buf)
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					continue
 				}
-				slog.Error("error reading packet:", "error", err)
+				return fmt.Errorf("failed to read packet: %w", err)
 			}
 
 			upeer, ok := addr.(*net.UDPAddr)
 			if !ok {
+				bufPool.Put(buf)
 				slog.Error("Invalid UDP address", "addr", addr)
 				continue
 			}
 
-			s.processChan <- &input{data: buf[:n], addr: upeer}
-			bufPool.Put(buf)
+			if !s.pipeline.dispatch(&input{data: buf[:n], addr: upeer, buf: buf}) {
+				bufPool.Put(buf)
+				slog.Warn("Worker queue full, dropping packet", "addr", upeer)
+			}
 		}
 	}
 }
 
-func (s *Server) processPackets(ctx context.Context) {
-	for i := range s.processChan {
-		packet, err := protocol.Decode(i.data)
-		if err != nil {
-			slog.Error("Error decoding packet", "error", err)
-			continue
-		}
-		runAsync(ctx, &s.wg, func(ctx context.Context) {
-			slog.Info("Processing packet", "packet", packet, "addr", i.addr)
-			s.handlePacket(packet, i.addr)
-		})
+func (s *Server) processPacket(in *input) {
+	packet, err := protocol.Decode(in.data)
+	bufPool.Put(in.buf)
+	if err != nil {
+		slog.Error("Error decoding packet", "error", err)
+		return
 	}
+	s.handlePacket(packet, in.addr)
+}
+
+// Stats returns packet counters for the processing pipeline.
+func (s *Server) Stats() PipelineStats {
+	return s.pipeline.stats()
 }
 
 func (s *Server) handlePacket(packet *protocol.Packet, addr *net.UDPAddr) {
 	slog.Info("Received packet", "packet", packet, "addr", addr)
-	switch packet.DHCPMessageType() {
+	msgType := packet.DHCPMessageType()
+	if msgType != protocol.DHCPINFORM && msgType != protocol.DHCPLEASEQUERY && packet.ClientID() == nil {
+		// Leases are keyed by client ID; without one the client would
+		// share a binding with every other client of its hardware type.
+		slog.Warn("Dropping packet without client identifier or hardware address", "addr", addr)
+		return
+	}
+	switch msgType {
 	case protocol.DHCPDISCOVER:
 		s.handleDiscover(packet, addr)
 	case protocol.DHCPREQUEST:
@@ -219,66 +493,481 @@ func (s *Server) handlePacket(packet *protocol.Packet, addr *net.UDPAddr) {
 		s.handleRelease(packet)
 	case protocol.DHCPDECLINE:
 		s.handleDecline(packet)
+	case protocol.DHCPINFORM:
+		s.handleInform(packet, addr)
+	case protocol.DHCPLEASEQUERY:
+		s.handleLeaseQuery(packet, addr)
+	case 0:
+		if packet.Op == protocol.BOOTREQUEST {
+			s.handleBOOTP(packet, addr)
+		}
 	}
 }
 
 func (s *Server) handleDiscover(packet *protocol.Packet, addr *net.UDPAddr) {
-	offer := s.createOffer(packet)
+	s.startOffer(packet, func(offer *protocol.Packet) {
+		s.sendOffer(packet, offer, addr)
+	})
+}
+
+// sendOffer sends the reply startOffer made for the DHCPDISCOVER packet,
+// withdrawing it if it cannot be sent.
+func (s *Server) sendOffer(packet, offer *protocol.Packet, addr *net.UDPAddr) {
 	if offer == nil {
 		slog.Debug("No IP available for offer")
 		return
 	}
 	err := protocol.SendPacket(s.conn, offer, addr)
-	if err != nil {
-		s.releaseIP(offer.YIAddr)
-		slog.Error("Error sending offer", "error", err)
+	if err == nil {
+		return
+	}
+	if offer.DHCPMessageType() == protocol.DHCPACK {
+		s.withdrawRapidCommit(packet, offer.YIAddr)
+		slog.Error("Error sending rapid commit ACK", "error", err)
+		return
+	}
+	s.withdrawOffer(packet)
+	slog.Error("Error sending offer", "error", err)
+}
+
+func (s *Server) handleInform(packet *protocol.Packet, addr *net.UDPAddr) {
+	ack := s.createInformAck(packet)
+	if ack == nil {
+		return
+	}
+	if err := protocol.SendPacket(s.conn, ack, addr); err != nil {
+		slog.Error("Error sending inform reply", "error", err)
+	}
+}
+
+// createInformAck answers a client that configured its address itself and
+// asks for the remaining parameters. No binding is created or checked; the
+// client's address, or the relay's, only has to be on the served subnet.
+func (s *Server) createInformAck(packet *protocol.Packet) *protocol.Packet {
+	if isZeroIP(packet.CIAddr) {
+		slog.Debug("Ignoring DHCPINFORM without ciaddr", "addr", packet.HardwareAddr().String())
+		return nil
 	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	relayed := !isZeroIP(packet.GIAddr)
+	if !s.config.Subnet.Contains(packet.CIAddr) && !(relayed && s.config.Subnet.Contains(packet.GIAddr)) {
+		slog.Debug("Ignoring DHCPINFORM from outside the served subnet", "ciaddr", packet.CIAddr, "giaddr", packet.GIAddr)
+		return nil
+	}
+	classes := s.classifier.Classify(packet)
+	slog.Info("Answering DHCPINFORM", "ciaddr", packet.CIAddr, "addr", packet.HardwareAddr().String(), "classes", classify.Names(classes))
+	options := s.replyOptions(classes)
+	s.addBootOptions(packet, options)
+	return packet.ToInformAck(options)
 }
 
+// createOffer answers a DHCPDISCOVER like startOffer, waiting for any
+// conflict probe to finish.
 func (s *Server) createOffer(packet *protocol.Packet) *protocol.Packet {
-	ip := s.ipPool.Allocate()
-	if ip == nil {
+	offers := make(chan *protocol.Packet, 1)
+	s.startOffer(packet, func(offer *protocol.Packet) { offers <- offer })
+	return <-offers
+}
+
+// startOffer reserves an address for the client of packet and calls reply
+// once with the offer, or with nil if none can be made. A fresh address is
+// probed for conflicts first. The probe runs on its own goroutine, which
+// then calls reply, so the worker goes on to other clients' packets
+// meanwhile; a DISCOVER the client retransmits during the probe is
+// ignored.
+func (s *Server) startOffer(packet *protocol.Packet, reply func(offer *protocol.Packet)) {
+	s.mu.RLock()
+	if s.probing[clientKey(packet)] {
+		s.mu.RUnlock()
+		slog.Debug("Ignoring DHCPDISCOVER while its offer is probed", "addr", packet.HardwareAddr().String())
+		reply(nil)
+		return
+	}
+	classes := s.classifier.Classify(packet)
+	options := s.replyOptions(classes)
+	s.grantLease(options, classes, requestedLease(packet))
+	s.addBootOptions(packet, options)
+	s.mu.RUnlock()
+
+	s.continueOffer(packet, classes, options, 0, reply)
+}
+
+// continueOffer runs the reservation attempts of startOffer from attempt
+// on.
+func (s *Server) continueOffer(packet *protocol.Packet, classes []*classify.Class, options *protocol.ReplyOptions, attempt int, reply func(offer *protocol.Packet)) {
+	for ; attempt < maxProbeAttempts; attempt++ {
+		ip, fresh, err := s.reserveOffer(packet, classes, options.LeaseTime)
+		if errors.Is(err, store.ErrAddressInUse) {
+			continue
+		}
+		if err != nil {
+			slog.Error("Not offering an address the lease store could not bind", "addr", packet.HardwareAddr().String(), "error", err)
+			reply(nil)
+			return
+		}
+		if ip == nil {
+			reply(nil)
+			return
+		}
+		if fresh && s.prober(packet) != nil {
+			s.probeOffer(packet, ip, classes, options, attempt, reply)
+			return
+		}
+		reply(s.finishOffer(packet, ip, classes, options))
+		return
+	}
+	slog.Warn("No conflict-free address found", "addr", packet.HardwareAddr().String(), "attempts", maxProbeAttempts)
+	reply(nil)
+}
+
+// probeOffer probes ip, just reserved for the client of packet, on its own
+// goroutine. An address that answers is abandoned and the next attempt
+// made; otherwise ip is offered. The client is marked as probing until
+// reply is called.
+func (s *Server) probeOffer(packet *protocol.Packet, ip net.IP, classes []*classify.Class, options *protocol.ReplyOptions, attempt int, reply func(offer *protocol.Packet)) {
+	key := clientKey(packet)
+	s.mu.Lock()
+	s.probing[key] = true
+	s.mu.Unlock()
+	done := func(offer *protocol.Packet) {
+		s.mu.Lock()
+		delete(s.probing, key)
+		s.mu.Unlock()
+		reply(offer)
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if s.addressInUse(packet, ip) {
+			s.abandonOffer(packet, ip)
+			s.continueOffer(packet, classes, options, attempt+1, done)
+			return
+		}
+		done(s.finishOffer(packet, ip, classes, options))
+	}()
+}
+
+// finishOffer makes the reply offering ip, reserved for the client of
+// packet: an ACK if it asked for rapid commit and the server allows it,
+// otherwise an OFFER.
+func (s *Server) finishOffer(packet *protocol.Packet, ip net.IP, classes []*classify.Class, options *protocol.ReplyOptions) *protocol.Packet {
+	if packet.GetOption(protocol.OptionRapidCommit) != nil {
+		if ack := s.rapidCommit(packet, ip, classes, options); ack != nil {
+			return ack
+		}
+	}
+	slog.Info("Offering IP", "app", ip, "addr", packet.HardwareAddr().String(), "classes", classify.Names(classes))
+	return packet.ToOffer(ip, options)
+}
+
+// rapidCommit binds the address just reserved for the client of packet
+// and acknowledges it with option 80, if rapid commit is enabled. It
+// returns nil otherwise, and the client is sent an ordinary offer.
+func (s *Server) rapidCommit(packet *protocol.Packet, ip net.IP, classes []*classify.Class, options *protocol.ReplyOptions) *protocol.Packet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.config.RapidCommit {
 		return nil
 	}
+	b, exists := s.bindings[clientKey(packet)]
+	if !exists || b.State != OFFERED || !b.IP.Equal(ip) {
+		return nil
+	}
+	s.commitBinding(b, packet, classes, options.LeaseTime)
+	slog.Info("Acknowledging IP with rapid commit", "ip", b.IP, "addr", packet.HardwareAddr().String())
+	ack := s.ackBinding(b, packet, options)
+	ack.AddOption(protocol.OptionRapidCommit, nil)
+	return ack
+}
 
-	slog.Info("Allocated IP", "ip", ip)
-	offer := packet.ToOffer(ip, s.createReplyOptions())
+// reserveOffer selects an address for the client and records it as
+// OFFERED. fresh is false when the address was already the client's. It
+// fails with store.ErrAddressInUse if the lease store reports that another
+// server bound the address; the holder's lease is then mirrored locally
+// so the next attempt picks another address.
+func (s *Server) reserveOffer(packet *protocol.Packet, classes []*classify.Class, leaseTime time.Duration) (ip net.IP, fresh bool, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.bindings[MACToUint64(packet.CHAddr)] = &binding{
+
+	key := clientKey(packet)
+	ip = s.selectAddress(packet, classes)
+	if ip == nil {
+		return nil, false, nil
+	}
+	now := time.Now()
+	offered := &store.Lease{
 		IP:         ip,
-		MAC:        packet.CHAddr,
-		Expiration: time.Now().Add(s.config.Lease),
+		ClientID:   packet.ClientID(),
+		MAC:        packet.HardwareAddr(),
+		HType:      packet.HType,
+		State:      OFFERED,
+		Expiration: now.Add(s.offerHoldTime()),
+		Start:      now,
+		Hostname:   string(packet.GetOption(protocol.OptionHostname)),
+	}
+
+	b, exists := s.bindings[key]
+	if exists && offered.Hostname == "" {
+		offered.Hostname = b.Hostname
+	}
+	if err := s.bind(offered); err != nil {
+		return nil, false, err
+	}
+
+	fresh = !exists || !b.IP.Equal(ip)
+	if !exists {
+		b = &binding{ClientID: offered.ClientID}
+		s.bindings[key] = b
+	} else if fresh {
+		s.freeAddress(b.IP)
+		b.outOfRange = false
+	}
+	b.IP = ip
+	b.MAC = offered.MAC
+	b.HType = offered.HType
+	b.Expiration = offered.Expiration
+	b.Start = now
+	b.Hostname = offered.Hostname
+	b.leaseTime = leaseTime
+	_ = b.transition(OFFERED)
+	if previous := s.allocated[IPToUint32(ip)]; previous != nil && previous != b {
+		s.unschedule(previous)
+	}
+	s.allocated[IPToUint32(ip)] = b
+	s.schedule(b)
+	return ip, fresh, nil
+}
+
+// selectAddress picks the address to offer, preferring in order the
+// client's current binding, its last expired or released address, the
+// address it asked for, and then a fresh address. When the pools are
+// exhausted, the address reserved longest for another client is reused.
+// s.mu must be held.
+func (s *Server) selectAddress(packet *protocol.Packet, classes []*classify.Class) net.IP {
+	allowed := allowedPools(classes)
+	if b, exists := s.bindings[clientKey(packet)]; exists && !b.outOfRange && s.poolAllowed(b.IP, allowed) {
+		switch b.State {
+		case OFFERED, BOUND, EXPIRED, RELEASED:
+			return b.IP
+		}
+	}
+
+	if requested := net.IP(packet.GetOption(protocol.OptionRequestedIPAddress)); len(requested) == net.IPv4len {
+		if p := s.poolFor(requested); p != nil && s.servesDHCP(p, allowed) && p.AllocateIP(requested) {
+			return requested.To4()
+		}
+	}
+
+	if ip := s.allocateIP(allowed, packet.ClientID()); ip != nil {
+		return ip
+	}
+	return s.reclaimAffineAddress(allowed)
+}
+
+// reclaimAffineAddress takes over the address whose affinity to its last
+// owner ends soonest. s.mu must be held.
+func (s *Server) reclaimAffineAddress(allowed map[string]bool) net.IP {
+	var oldestKey string
+	var oldest *binding
+	for key, b := range s.bindings {
+		if b.State != EXPIRED && b.State != RELEASED || !s.poolAllowed(b.IP, allowed) {
+			continue
+		}
+		if oldest == nil || b.Expiration.Before(oldest.Expiration) {
+			oldestKey, oldest = key, b
+		}
+	}
+	if oldest == nil {
+		return nil
+	}
+	_ = oldest.transition(FREE)
+	delete(s.bindings, oldestKey)
+	slog.Info("Reclaiming affine address", "ip", oldest.IP, "previousOwner", oldest.MAC.String())
+	return oldest.IP
+}
+
+// withdrawOffer frees the address offered to the client of packet.
+func (s *Server) withdrawOffer(packet *protocol.Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropOffer(clientKey(packet))
+}
+
+// withdrawRapidCommit rolls back ip, bound to the client of packet by a
+// rapid commit ACK that could not be sent: the binding returns to FREE,
+// leaves the expiry heap and its lease is deleted from the store.
+func (s *Server) withdrawRapidCommit(packet *protocol.Packet, ip net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, exists := s.bindings[clientKey(packet)]
+	if !exists || !b.IP.Equal(ip) {
+		return
+	}
+	if err := b.rollback(); err != nil {
+		slog.Error("Failed to withdraw rapid commit", "error", err)
+		return
+	}
+	s.freeAddress(b.IP)
+	s.forget(b)
+}
+
+// dropOffer frees the address offered to the client with key, if it has
+// not been requested yet. s.mu must be held.
+func (s *Server) dropOffer(key string) {
+	b, exists := s.bindings[key]
+	if !exists || b.State != OFFERED {
+		return
 	}
-	s.allocated[IPToUint32(ip)] = true
-	slog.Info("Offering IP", "app", ip, "addr", packet.CHAddr.String())
-	return offer
+	_ = b.transition(FREE)
+	s.freeAddress(b.IP)
+	delete(s.bindings, key)
+}
+
+// addressInUse probes ip before it is offered: by ARP for clients on the
+// local link and by ICMP echo for relayed clients. Probe failures are
+// logged and treated as "not in use".
+func (s *Server) addressInUse(packet *protocol.Packet, ip net.IP) bool {
+	prober := s.prober(packet)
+	if prober == nil {
+		return false
+	}
+
+	s.mu.RLock()
+	timeout := s.probeTimeout()
+	s.mu.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	inUse, err := prober.Probe(ctx, ip)
+	if err != nil {
+		slog.Error("Address probe failed", "ip", ip, "error", err)
+		return false
+	}
+	return inUse
+}
+
+// prober returns the prober for the client of packet, or nil if probing
+// is disabled.
+func (s *Server) prober(packet *protocol.Packet) probe.Prober {
+	if !isZeroIP(packet.GIAddr) {
+		return s.relayProber
+	}
+	return s.localProber
+}
+
+// abandonOffer withholds ip, which answered a probe, for the abandon time
+// and detaches it from the client so the next address can be tried.
+func (s *Server) abandonOffer(packet *protocol.Packet, ip net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := clientKey(packet)
+	b, exists := s.bindings[key]
+	if !exists || !b.IP.Equal(ip) || b.State != OFFERED {
+		return
+	}
+	slog.Warn("Address conflict detected, abandoning address", "ip", ip, "abandonTime", s.abandonTime())
+	_ = b.transition(ABANDONED)
+	b.Expiration = time.Now().Add(s.abandonTime())
+	s.schedule(b)
+	delete(s.bindings, key)
+	s.persist(b)
+	s.recordConflict(b, ConflictProbe)
 }
 
 func (s *Server) handleRelease(packet *protocol.Packet) {
-	s.releaseIP(packet.CIAddr)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, exists := s.bindings[clientKey(packet)]
+	if !exists || !b.IP.Equal(packet.CIAddr) {
+		slog.Warn("Ignoring release for address not bound to client", "ip", packet.CIAddr, "addr", packet.HardwareAddr().String())
+		return
+	}
+	if err := b.transition(RELEASED); err != nil {
+		slog.Warn("Ignoring release", "error", err)
+		return
+	}
+	b.Expiration = time.Now().Add(s.affinityTime())
+	s.schedule(b)
+	s.persist(b)
 }
 
+// handleDecline quarantines the address a client found already in use.
+// The address comes from the requested IP option (RFC 2131 §4.4.4) and must
+// be the one bound or offered to the sender.
 func (s *Server) handleDecline(packet *protocol.Packet) {
-	s.releaseIP(packet.CIAddr)
-}
+	ip := net.IP(packet.GetOption(protocol.OptionRequestedIPAddress))
+	if len(ip) != net.IPv4len {
+		slog.Warn("Ignoring decline without requested IP address", "addr", packet.HardwareAddr().String())
+		return
+	}
 
-func (s *Server) releaseIP(ip net.IP) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	ipUint := IPToUint32(ip)
-	if _, exists := s.allocated[ipUint]; exists {
-		delete(s.allocated, ipUint)
-		s.ipPool.Release(ip)
+	if serverID := packet.GetOption(protocol.OptionServerIdentifier); serverID != nil && !net.IP(serverID).Equal(s.config.ServerIP) {
+		return
 	}
 
-	for mac, b := range s.bindings {
-		if b.IP.Equal(ip) {
-			delete(s.bindings, mac)
-			break
-		}
+	key := clientKey(packet)
+	b, exists := s.bindings[key]
+	if !exists || !b.IP.Equal(ip) || !b.isActive() {
+		slog.Warn("Ignoring decline for address not bound to client", "ip", ip, "addr", packet.HardwareAddr().String())
+		return
+	}
+	if err := b.transition(DECLINED); err != nil {
+		slog.Warn("Ignoring decline", "error", err)
+		return
+	}
+	b.Expiration = time.Now().Add(s.declineTime())
+	s.schedule(b)
+	delete(s.bindings, key)
+	s.persist(b)
+	s.recordConflict(b, ConflictDeclined)
+	slog.Warn("Address declined by client, quarantining", "ip", ip, "addr", b.MAC.String(), "until", b.Expiration)
+}
+
+// affinityTime is how long an expired or released address stays reserved
+// for its last owner.
+func (s *Server) affinityTime() time.Duration {
+	if s.config.AffinityTime > 0 {
+		return s.config.AffinityTime
+	}
+	return s.config.Lease
+}
+
+// declineTime is how long a declined address stays quarantined.
+func (s *Server) declineTime() time.Duration {
+	if s.config.DeclineTime > 0 {
+		return s.config.DeclineTime
+	}
+	return defaultDeclineTime
+}
+
+func (s *Server) probeTimeout() time.Duration {
+	if s.config.Probe.Timeout > 0 {
+		return s.config.Probe.Timeout
+	}
+	return defaultProbeTimeout
+}
+
+func (s *Server) abandonTime() time.Duration {
+	if s.config.Probe.AbandonTime > 0 {
+		return s.config.Probe.AbandonTime
+	}
+	return defaultAbandonTime
+}
+
+func (s *Server) offerHoldTime() time.Duration {
+	if s.config.OfferHoldTime > 0 {
+		return s.config.OfferHoldTime
 	}
+	return defaultOfferHoldTime
 }
 
 func (s *Server) setupListener() (*net.UDPConn, error) {
@@ -290,158 +979,319 @@ func (s *Server) setupListener() (*net.UDPConn, error) {
 	return conn, nil
 }
 
-func (s *Server) cleanupExpiredLeases(ctx context.Context) {
-	ticker := time.NewTicker(leaseCleanupInterval)
-	defer ticker.Stop()
+func allowedPools(classes []*classify.Class) map[string]bool {
+	var allowed map[string]bool
+	for _, c := range classes {
+		for _, name := range c.Pools {
+			if allowed == nil {
+				allowed = make(map[string]bool)
+			}
+			allowed[name] = true
+		}
+	}
+	return allowed
+}
 
-	for {
-		select {
-		case <-ticker.C:
-			now := time.Now()
-			s.mu.Lock()
-			for mac, b := range s.bindings {
-				if b.Expiration.Before(now) {
-					s.releaseIP(b.IP)
-					delete(s.bindings, mac)
+// allocateIP takes a free address from the first allowed pool. A nil
+// allowed set permits every pool.
+func (s *Server) allocateIP(allowed map[string]bool, clientID []byte) net.IP {
+	for _, p := range s.pools {
+		if !s.servesDHCP(p, allowed) {
+			continue
+		}
+		if ip := p.Allocate(clientID); ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+func (s *Server) poolAllowed(ip net.IP, allowed map[string]bool) bool {
+	p := s.poolFor(ip)
+	return p != nil && s.servesDHCP(p, allowed)
+}
+
+// servesDHCP reports whether p is in the allowed set and open to DHCP
+// clients; the dynamic BOOTP pool is kept for BOOTP clients. A nil
+// allowed set permits every pool.
+func (s *Server) servesDHCP(p *namedPool, allowed map[string]bool) bool {
+	if s.config.BOOTP.DynamicPool != "" && p.name == s.config.BOOTP.DynamicPool {
+		return false
+	}
+	return allowed == nil || allowed[p.name]
+}
+
+func overlappingPool(pools []*namedPool, p *pool.IPPool) *namedPool {
+	for _, other := range pools {
+		for _, a := range other.Ranges() {
+			for _, b := range p.Ranges() {
+				if IPToUint32(a.Start) <= IPToUint32(b.End) && IPToUint32(b.Start) <= IPToUint32(a.End) {
+					return other
 				}
 			}
-			s.mu.Unlock()
-		case <-ctx.Done():
-			slog.Info("Stopping lease cleanup")
-			return
 		}
 	}
+	return nil
 }
 
-func (s *Server) createReplyOptions() *protocol.ReplyOptions {
-	s.mu.RLock()
-	if s.cachedReplyOptions != nil {
-		defer s.mu.RUnlock()
-		return s.cachedReplyOptions
-	}
-	s.mu.RUnlock()
+func (s *Server) poolFor(ip net.IP) *namedPool {
+	return findPool(s.pools, ip)
+}
 
+// replyOptions builds the reply options for a client in the given classes.
+// When several classes set the same option or lease time, the first one in
+// configuration order wins.
+func (s *Server) replyOptions(classes []*classify.Class) *protocol.ReplyOptions {
 	options := &protocol.ReplyOptions{
-		LeaseTime:     s.config.Lease,
-		RenewalTime:   s.config.RenewalTime,
-		RebindingTime: s.config.RebindingTime,
-		SubnetMask:    s.config.Subnet.Mask,
-		Router:        s.config.Router,
-		DNS:           s.config.DNS,
-		ServerIP:      s.config.ServerIP,
-		DomainName:    s.config.DomainName,
+		SubnetMask: s.config.Subnet.Mask,
+		Router:     s.config.Router,
+		DNS:        s.config.DNS,
+		ServerIP:   s.config.ServerIP,
+		DomainName: s.config.DomainName,
 	}
+	s.setLeaseTime(options, s.config.Lease)
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.cachedReplyOptions = options
+	leaseOverridden := false
+	for _, c := range classes {
+		if c.LeaseTime > 0 && !leaseOverridden {
+			s.setLeaseTime(options, c.LeaseTime)
+			leaseOverridden = true
+		}
+		for code, data := range c.Options {
+			if options.Extra == nil {
+				options.Extra = make(map[byte][]byte)
+			}
+			if _, ok := options.Extra[code]; !ok {
+				options.Extra[code] = data
+			}
+		}
+	}
 	return options
 }
 
-func (s *Server) createAckOrNak(packet *protocol.Packet) *protocol.Packet {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// grantLease sets the lease time in options to the time the client asked
+// for, clamped to the lease bounds of its classes. If it did not ask, the
+// default already in options stands. s.mu must be held.
+func (s *Server) grantLease(options *protocol.ReplyOptions, classes []*classify.Class, requested time.Duration) {
+	if requested <= 0 {
+		return
+	}
+	minLease, maxLease := s.leaseBounds(classes)
+	s.setLeaseTime(options, min(max(requested, minLease), maxLease))
+}
 
-	b, exists := s.bindings[MACToUint64(packet.CHAddr)]
-	if !exists || !b.IP.Equal(packet.CIAddr) {
-		slog.Error("Invalid request", "packet", packet)
-		return packet.ToNak(s.createReplyOptions())
+// leaseBounds returns the shortest and longest lease a client in classes
+// may ask for. The first class that sets a bound overrides MinLease or
+// MaxLease; an unset maximum is the default lease of the classes, and the
+// bounds always admit that default. s.mu must be held.
+func (s *Server) leaseBounds(classes []*classify.Class) (minLease, maxLease time.Duration) {
+	lease, minLease, maxLease := s.config.Lease, s.config.MinLease, s.config.MaxLease
+	leaseSet, minSet, maxSet := false, false, false
+	for _, c := range classes {
+		if c.LeaseTime > 0 && !leaseSet {
+			lease, leaseSet = c.LeaseTime, true
+		}
+		if c.MinLease > 0 && !minSet {
+			minLease, minSet = c.MinLease, true
+		}
+		if c.MaxLease > 0 && !maxSet {
+			maxLease, maxSet = c.MaxLease, true
+		}
+	}
+	if maxLease == 0 {
+		maxLease = lease
+	}
+	return min(minLease, lease), max(maxLease, lease)
+}
+
+// setLeaseTime sets the lease time in options and derives T1 and T2 in the
+// proportion Config.RenewalTime and Config.RebindingTime have to
+// Config.Lease. s.mu must be held.
+func (s *Server) setLeaseTime(options *protocol.ReplyOptions, lease time.Duration) {
+	renewal, rebinding := 0.5, 0.875
+	if s.config.RenewalTime > 0 {
+		renewal = float64(s.config.RenewalTime) / float64(s.config.Lease)
 	}
+	if s.config.RebindingTime > 0 {
+		rebinding = float64(s.config.RebindingTime) / float64(s.config.Lease)
+	}
+	options.LeaseTime = lease
+	options.RenewalTime = time.Duration(float64(lease) * renewal)
+	options.RebindingTime = time.Duration(float64(lease) * rebinding)
+}
 
-	b.Expiration = time.Now().Add(s.config.Lease)
-	slog.Info("Acknowledging IP", "ip", b.IP)
-	return packet.ToAck(b.IP, s.createReplyOptions())
+// requestedLease returns the lease time the client asked for in option
+// 51, or zero.
+func requestedLease(packet *protocol.Packet) time.Duration {
+	data := packet.GetOption(protocol.OptionIPAddressLeaseTime)
+	if len(data) != 4 {
+		return 0
+	}
+	return time.Duration(binary.BigEndian.Uint32(data)) * time.Second
 }
 
+// handleRequest answers a DHCPREQUEST as RFC 2131 section 4.3.2 requires
+// for the client's state. A nil reply means the server stays silent.
 func (s *Server) handleRequest(packet *protocol.Packet, addr *net.UDPAddr) {
+	response := s.createRequestReply(packet)
+	if response == nil {
+		return
+	}
+	if err := protocol.SendPacket(s.conn, response, addr); err != nil {
+		slog.Error("Error sending response", "error", err)
+	}
+}
+
+func (s *Server) createRequestReply(packet *protocol.Packet) *protocol.Packet {
 	state := determineClientState(packet)
-	var response *protocol.Packet
-	switch state {
-	case SELECTING:
-		s.mu.Lock()
-		defer s.mu.Unlock()
+	if state == InvalidState {
+		slog.Warn("Ignoring malformed DHCPREQUEST", "addr", packet.HardwareAddr().String(), "ciaddr", packet.CIAddr)
+		return nil
+	}
 
-		requestedIP := packet.GetOption(protocol.OptionRequestedIPAddress)
-		serverIdentifier := packet.GetOption(protocol.OptionServerIdentifier)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		if !net.IP(serverIdentifier).Equal(s.config.ServerIP) {
-			// Client has selected a different server
-			return
+	switch state {
+	case SELECTING:
+		if !net.IP(packet.GetOption(protocol.OptionServerIdentifier)).Equal(s.config.ServerIP) {
+			// The client accepted another server's offer.
+			s.dropOffer(clientKey(packet))
+			return nil
 		}
-		response = s.buildResponseToBinding(packet, requestedIP)
-
+		return s.confirmBinding(packet, packet.GetOption(protocol.OptionRequestedIPAddress), state)
 	case INIT_REBOOT:
-		s.mu.Lock()
-		defer s.mu.Unlock()
-		requestedIP := packet.GetOption(protocol.OptionRequestedIPAddress)
-		response = s.buildResponseToBinding(packet, requestedIP)
+		return s.confirmBinding(packet, packet.GetOption(protocol.OptionRequestedIPAddress), state)
+	default:
+		return s.confirmBinding(packet, packet.CIAddr, state)
+	}
+}
 
-	case RENEWING, REBINDING:
-		s.mu.Lock()
-		defer s.mu.Unlock()
-		response = s.buildResponseToBinding(packet, packet.CIAddr)
+// confirmBinding ACKs the client's binding to ip or NAKs it. In SELECTING
+// the client accepted this server's offer and always gets an answer. In
+// the other states a client the server has no record of, or one asking
+// for an address off the served subnet, is only NAKed by an authoritative
+// server; otherwise the lease may belong to another server and the
+// request is ignored. s.mu must be held.
+func (s *Server) confirmBinding(packet *protocol.Packet, ip net.IP, state int) *protocol.Packet {
+	classes := s.classifier.Classify(packet)
+	options := s.replyOptions(classes)
+	s.addBootOptions(packet, options)
+	b, exists := s.bindings[clientKey(packet)]
+	now := time.Now()
 
-	default:
-		slog.Error("Invalid DHCPREQUEST state")
-		return
+	nak := func(reason string) *protocol.Packet {
+		slog.Info("Rejecting request", "ip", ip, "addr", packet.HardwareAddr().String(), "state", clientStateNames[state], "reason", reason)
+		return packet.ToNak(options, reason)
 	}
-	if response == nil {
-		slog.Error("Error creating response")
-		return
+	unknown := func(reason string) *protocol.Packet {
+		if !s.config.Authoritative {
+			slog.Debug("Ignoring request for an unknown lease", "ip", ip, "addr", packet.HardwareAddr().String(), "state", clientStateNames[state], "reason", reason)
+			return nil
+		}
+		return nak(reason)
 	}
-	err := protocol.SendPacket(s.conn, response, addr)
-	if err != nil {
-		slog.Error("Error sending response", "error", err)
+
+	switch {
+	case state == SELECTING && (!exists || !b.IP.Equal(ip)):
+		return nak("address was not offered to this client")
+	case !exists && !s.config.Subnet.Contains(ip):
+		return unknown("address is not on this network")
+	case !exists:
+		return unknown("no lease for this client")
+	case !b.IP.Equal(ip):
+		return nak("address is not leased to this client")
+	case b.outOfRange:
+		return nak("address is no longer served")
+	case b.State == OFFERED && state != SELECTING:
+		return nak("address was offered, not leased")
+	case b.State != OFFERED && b.State != BOUND, b.State == BOUND && b.expired(now):
+		return nak("lease has expired")
+	}
+
+	// The ACK grants what was offered, whatever the REQUEST repeats.
+	if state == SELECTING && b.leaseTime > 0 {
+		s.setLeaseTime(options, b.leaseTime)
+	} else {
+		s.grantLease(options, classes, requestedLease(packet))
 	}
+	s.commitBinding(b, packet, classes, options.LeaseTime)
+	slog.Info("Acknowledging IP", "ip", b.IP, "addr", packet.HardwareAddr().String(), "state", clientStateNames[state])
+	return s.ackBinding(b, packet, options)
 }
 
-func (s *Server) buildResponseToBinding(packet *protocol.Packet, ip net.IP) (response *protocol.Packet) {
-	b, exists := s.bindings[MACToUint64(packet.CHAddr)]
-	isWrongBind := !exists || !b.IP.Equal(ip)
-	expiredBind := b.Expiration.Before(time.Now())
+// commitBinding binds b to the client of packet for leaseTime and stores
+// the lease. s.mu must be held.
+func (s *Server) commitBinding(b *binding, packet *protocol.Packet, classes []*classify.Class, leaseTime time.Duration) {
+	now := time.Now()
+	b.classes = classify.Names(classes)
+	b.relayAgentInfo = bytes.Clone(packet.GetOption(protocol.OptionDHCPAgentOptions))
+	b.leaseTime = leaseTime
+	_ = b.transition(BOUND)
+	b.Expiration = now.Add(leaseTime)
+	s.schedule(b)
+	b.Start = now
+	if hostname := packet.GetOption(protocol.OptionHostname); len(hostname) > 0 {
+		b.Hostname = string(hostname)
+	}
+	s.persist(b)
+}
 
-	switch {
-	case isWrongBind:
-		return packet.ToNak(s.createReplyOptions())
-	case expiredBind:
-		return packet.ToNak(s.createReplyOptions())
-	default:
-		b.Expiration = time.Now().Add(s.config.Lease)
-		return packet.ToAck(b.IP, s.createReplyOptions())
+// ackBinding acknowledges b to the client of packet, handing out the
+// FORCERENEW nonce to clients that accept one. s.mu must be held.
+func (s *Server) ackBinding(b *binding, packet *protocol.Packet, options *protocol.ReplyOptions) *protocol.Packet {
+	ack := packet.ToAck(b.IP, options)
+	if packet.ForceRenewNonceCapable() {
+		s.addForceRenewNonce(b, ack)
 	}
+	return ack
 }
 
 func isZeroIP(ip net.IP) bool {
 	return ip == nil || ip.Equal(net.IPv4zero)
 }
 
+var clientStateNames = map[int]string{
+	SELECTING:   "SELECTING",
+	INIT_REBOOT: "INIT-REBOOT",
+	RENEWING:    "RENEWING",
+	REBINDING:   "REBINDING",
+}
+
+// determineClientState classifies a DHCPREQUEST by the fields RFC 2131
+// section 4.3.2 requires in each state: the server identifier marks
+// SELECTING, a requested address without ciaddr INIT-REBOOT, and ciaddr
+// alone RENEWING or REBINDING. Renewals are unicast to the server and
+// rebinds broadcast; the socket cannot see the destination, but a relay
+// only forwards broadcasts, so a relayed renewal is taken as REBINDING.
+// Both are answered alike.
 func determineClientState(packet *protocol.Packet) int {
 	if packet == nil {
 		return InvalidState
 	}
 
-	emptyServer := isZeroIP(packet.SIAddr)
-	hasRequestedIP := packet.GetOption(protocol.OptionRequestedIPAddress) != nil
+	hasServerID := packet.GetOption(protocol.OptionServerIdentifier) != nil
+	hasRequestedIP := len(packet.GetOption(protocol.OptionRequestedIPAddress)) == net.IPv4len
 	clientIPZero := isZeroIP(packet.CIAddr)
-	isBroadcast := packet.IsBroadcast()
 
 	switch {
-	case !emptyServer && hasRequestedIP && clientIPZero:
+	case hasServerID && hasRequestedIP && clientIPZero:
 		return SELECTING
-	case emptyServer && hasRequestedIP && clientIPZero:
+	case !hasServerID && hasRequestedIP && clientIPZero:
 		return INIT_REBOOT
-	case emptyServer && !clientIPZero:
-		if isBroadcast {
+	case !hasServerID && !clientIPZero:
+		if !isZeroIP(packet.GIAddr) {
 			return REBINDING
 		}
 		return RENEWING
 	default:
-		slog.Warn("Unexpected packet state", "SIAddr", packet.SIAddr, "CIAddr", packet.CIAddr, "HasRequestedIP", hasRequestedIP)
 		return InvalidState
 	}
 }
-func MACToUint64(mac net.HardwareAddr) uint64 {
-	return uint64(mac[0])<<40 | uint64(mac[1])<<32 | uint64(mac[2])<<24 | uint64(mac[3])<<16 | uint64(mac[4])<<8 | uint64(mac[5])
+
+// clientKey returns the key of the client's entry in Server.bindings.
+func clientKey(packet *protocol.Packet) string {
+	return string(packet.ClientID())
 }
 
 func IPToUint32(ip net.IP) uint32 {
@@ -1,15 +1,31 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"dhcp/classify"
+	"dhcp/pool"
+	"dhcp/probe"
 	"dhcp/protocol"
-	"fmt"
+	"dhcp/store"
+	"encoding/binary"
+	"errors"
 	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	_ "modernc.org/sqlite"
 )
 
 type mockConn struct {
-	p []byte
+	p      []byte
+	writes int
+	err    error
 }
 
 func (m *mockConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
@@ -18,7 +34,8 @@ func (m *mockConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 
 func (m *mockConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	m.p = p
-	return 0, nil
+	m.writes++
+	return 0, m.err
 }
 
 func (m *mockConn) Close() error {
@@ -49,8 +66,80 @@ func (m *mockConn) sentPacket() *protocol.Packet {
 	return decode
 }
 
+// sendingConn hands every packet written to sent, for tests whose replies
+// are written from several goroutines.
+type sendingConn struct {
+	mockConn
+	sent chan []byte
+}
+
+func (c *sendingConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	c.sent <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+// testClientKey is the binding key of the client used by TestHandleRequest,
+// which sends no client identifier option.
+var testClientKey = string([]byte{1, 0x00, 0x11, 0x22, 0x33, 0x44, 0x55})
+
+// newRequest builds a DHCPREQUEST from the TestHandleRequest client. Nil
+// addresses are left out or zero.
+func newRequest(ciaddr, giaddr, requested, serverID net.IP) *protocol.Packet {
+	p := &protocol.Packet{
+		Op:     protocol.BOOTREQUEST,
+		HType:  1,
+		HLen:   6,
+		XId:    1234,
+		CIAddr: net.IPv4zero,
+		YIAddr: net.IPv4zero,
+		SIAddr: net.IPv4zero,
+		GIAddr: net.IPv4zero,
+		CHAddr: net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+	}
+	if ciaddr != nil {
+		p.CIAddr = ciaddr
+	}
+	if giaddr != nil {
+		p.GIAddr = giaddr
+	}
+	p.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPREQUEST})
+	if requested != nil {
+		p.AddOption(protocol.OptionRequestedIPAddress, requested.To4())
+	}
+	if serverID != nil {
+		p.AddOption(protocol.OptionServerIdentifier, serverID.To4())
+	}
+	return p
+}
+
+func TestDetermineClientState(t *testing.T) {
+	ip := net.ParseIP("192.168.1.100")
+	relay := net.ParseIP("10.0.0.1")
+	serverID := net.ParseIP("192.168.1.2")
+	testCases := []struct {
+		name   string
+		packet *protocol.Packet
+		want   int
+	}{
+		{"server identifier", newRequest(nil, nil, ip, serverID), SELECTING},
+		{"server identifier without siaddr", newRequest(nil, relay, ip, serverID), SELECTING},
+		{"requested address only", newRequest(nil, nil, ip, nil), INIT_REBOOT},
+		{"ciaddr", newRequest(ip, nil, nil, nil), RENEWING},
+		{"relayed ciaddr", newRequest(ip, relay, nil, nil), REBINDING},
+		{"ciaddr with requested address", newRequest(ip, nil, ip, nil), RENEWING},
+		{"server identifier with ciaddr", newRequest(ip, nil, ip, serverID), InvalidState},
+		{"server identifier without requested address", newRequest(nil, nil, nil, serverID), InvalidState},
+		{"nothing", newRequest(nil, nil, nil, nil), InvalidState},
+	}
+	for _, tc := range testCases {
+		if got := determineClientState(tc.packet); got != tc.want {
+			t.Errorf("%s: state = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
 func TestHandleRequest(t *testing.T) {
-	cfg := &Config{
+	cfg := Config{
 		Start:         net.ParseIP("192.168.1.100"),
 		End:           net.ParseIP("192.168.1.200"),
 		Subnet:        net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
@@ -62,251 +151,1995 @@ func TestHandleRequest(t *testing.T) {
 		ServerIP:      net.ParseIP("192.168.1.2"),
 		DomainName:    "example.com",
 	}
+	ip := net.ParseIP("192.168.1.100")
+	otherIP := net.ParseIP("192.168.1.150")
+	offNetwork := net.ParseIP("10.1.1.5")
+	relay := net.ParseIP("10.0.0.1")
 
-	mockAddr := &net.UDPAddr{IP: net.ParseIP("192.168.1.5"), Port: 68}
-
-	createPacket := func(messageType byte, clientIP net.IP, requestedIP net.IP, serverIP net.IP) *protocol.Packet {
-		options := []byte{
-			protocol.OptionDHCPMessageType, 1, messageType,
-		}
-		if !requestedIP.IsUnspecified() {
-			options = append(options, protocol.OptionRequestedIPAddress, 4)
-			options = append(options, requestedIP.To4()...)
-		}
-		if !serverIP.IsUnspecified() {
-			options = append(options, protocol.OptionServerIdentifier, 4)
-			options = append(options, serverIP.To4()...)
-		}
-		return &protocol.Packet{
-			Op:      protocol.BOOTREQUEST,
-			HType:   1,
-			HLen:    6,
-			Hops:    0,
-			XId:     1234,
-			Secs:    0,
-			Flags:   0,
-			CIAddr:  clientIP,
-			YIAddr:  net.IPv4zero,
-			SIAddr:  serverIP,
-			GIAddr:  net.IPv4zero,
-			CHAddr:  net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
-			Options: options,
+	// bindTo gives the client a binding for ip in state, expiring after
+	// ttl. A nil key binds another client.
+	bindTo := func(key []byte, ip net.IP, state LeaseState, ttl time.Duration) func(*Server) {
+		return func(s *Server) {
+			if key == nil {
+				key = []byte{1, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+			}
+			b := &binding{IP: ip.To4(), ClientID: key, State: state, Expiration: time.Now().Add(ttl)}
+			s.bindings[string(key)] = b
+			s.allocated[IPToUint32(ip)] = b
+			s.poolFor(ip).AllocateIP(ip)
+			s.schedule(b)
 		}
 	}
+	client := []byte(testClientKey)
 
+	const (
+		silent = 0
+		ack    = protocol.DHCPACK
+		nak    = protocol.DHCPNAK
+	)
 	testCases := []struct {
-		name            string
-		packet          *protocol.Packet
-		expectedState   int
-		expectResponse  bool
-		setup           func(*Server)
-		additionalCheck func(*testing.T, *protocol.Packet)
+		name          string
+		packet        *protocol.Packet
+		authoritative bool
+		setup         func(*Server)
+		want          byte
+		check         func(*testing.T, *Server)
 	}{
+		// SELECTING: the client names this server, so it always answers.
+		{name: "SELECTING offered", packet: newRequest(nil, nil, ip, cfg.ServerIP), setup: bindTo(client, ip, OFFERED, time.Minute), want: ack},
+		{name: "SELECTING retransmitted after ACK", packet: newRequest(nil, nil, ip, cfg.ServerIP), setup: bindTo(client, ip, BOUND, time.Hour), want: ack},
+		{name: "SELECTING relayed", packet: newRequest(nil, relay, ip, cfg.ServerIP), setup: bindTo(client, ip, OFFERED, time.Minute), want: ack},
+		{name: "SELECTING without offer", packet: newRequest(nil, nil, ip, cfg.ServerIP), want: nak},
+		{name: "SELECTING other address", packet: newRequest(nil, nil, otherIP, cfg.ServerIP), setup: bindTo(client, ip, OFFERED, time.Minute), want: nak},
+		{name: "SELECTING off network", packet: newRequest(nil, nil, offNetwork, cfg.ServerIP), want: nak},
 		{
-			name:           "SELECTING - Valid request",
-			packet:         createPacket(protocol.DHCPREQUEST, net.IPv4zero, net.ParseIP("192.168.1.100"), cfg.ServerIP),
-			expectedState:  SELECTING,
-			expectResponse: true,
-			setup: func(s *Server) {
-				s.bindings[MACToUint64(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55})] = &binding{
-					IP:         net.ParseIP("192.168.1.100"),
-					MAC:        net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
-					Expiration: time.Now().Add(time.Hour),
-				}
-			},
-			additionalCheck: func(t *testing.T, p *protocol.Packet) {
-				if p.DHCPMessageType() != protocol.DHCPACK {
-					t.Errorf("Expected DHCPACK for valid SELECTING request")
-				}
-			},
-		},
-		{
-			name:           "SELECTING - Different server",
-			packet:         createPacket(protocol.DHCPREQUEST, net.IPv4zero, net.ParseIP("192.168.1.100"), net.ParseIP("192.168.1.3")),
-			expectedState:  SELECTING,
-			expectResponse: false,
-		},
-		{
-			name:           "INIT_REBOOT - Valid request",
-			packet:         createPacket(protocol.DHCPREQUEST, net.IPv4zero, net.ParseIP("192.168.1.100"), net.IPv4zero),
-			expectedState:  INIT_REBOOT,
-			expectResponse: true,
-			setup: func(s *Server) {
-				s.bindings[MACToUint64(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55})] = &binding{
-					IP:         net.ParseIP("192.168.1.100"),
-					MAC:        net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
-					Expiration: time.Now().Add(time.Hour),
-				}
-			},
-			additionalCheck: func(t *testing.T, p *protocol.Packet) {
-				if p.DHCPMessageType() != protocol.DHCPACK {
-					t.Errorf("Expected DHCPACK for valid INIT_REBOOT request")
-				}
-			},
-		},
-		{
-			name:           "RENEWING - Valid request",
-			packet:         createPacket(protocol.DHCPREQUEST, net.ParseIP("192.168.1.100"), net.IPv4zero, net.IPv4zero),
-			expectedState:  RENEWING,
-			expectResponse: true,
-			setup: func(s *Server) {
-				s.bindings[MACToUint64(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55})] = &binding{
-					IP:         net.ParseIP("192.168.1.100"),
-					MAC:        net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
-					Expiration: time.Now().Add(time.Hour),
-				}
-			},
-			additionalCheck: func(t *testing.T, p *protocol.Packet) {
-				if p.DHCPMessageType() != protocol.DHCPACK {
-					t.Errorf("Expected DHCPACK for valid RENEWING request")
-				}
-			},
-		},
-		{
-			name:           "REBINDING - Valid request",
-			packet:         createPacket(protocol.DHCPREQUEST, net.ParseIP("192.168.1.100"), net.IPv4zero, net.IPv4zero),
-			expectedState:  REBINDING,
-			expectResponse: true,
-			setup: func(s *Server) {
-				s.bindings[MACToUint64(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55})] = &binding{
-					IP:         net.ParseIP("192.168.1.100"),
-					MAC:        net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
-					Expiration: time.Now().Add(time.Hour),
-				}
-			},
-			additionalCheck: func(t *testing.T, p *protocol.Packet) {
-				if p.DHCPMessageType() != protocol.DHCPACK {
-					t.Errorf("Expected DHCPACK for valid REBINDING request")
-				}
-			},
-		},
-		{
-			name:           "Invalid state",
-			packet:         createPacket(protocol.DHCPREQUEST, net.ParseIP("192.168.1.100"), net.ParseIP("192.168.1.100"), net.ParseIP("192.168.1.2")),
-			expectedState:  -1,
-			expectResponse: false,
-		},
-		{
-			name:           "SELECTING - IP not in server pool",
-			packet:         createPacket(protocol.DHCPREQUEST, net.IPv4zero, net.ParseIP("192.168.2.100"), cfg.ServerIP),
-			expectedState:  SELECTING,
-			expectResponse: true,
-			additionalCheck: func(t *testing.T, p *protocol.Packet) {
-				if p.DHCPMessageType() != protocol.DHCPNAK {
-					t.Errorf("Expected DHCPNAK for IP not in server pool")
-				}
-			},
-		},
-		{
-			name:           "INIT_REBOOT - Unknown client",
-			packet:         createPacket(protocol.DHCPREQUEST, net.IPv4zero, net.ParseIP("192.168.1.150"), net.IPv4zero),
-			expectedState:  INIT_REBOOT,
-			expectResponse: true,
-			additionalCheck: func(t *testing.T, p *protocol.Packet) {
-				if p.DHCPMessageType() != protocol.DHCPNAK {
-					t.Errorf("Expected DHCPNAK for unknown client in INIT_REBOOT")
+			name:   "SELECTING other server",
+			packet: newRequest(nil, nil, ip, net.ParseIP("192.168.1.3")),
+			setup:  bindTo(client, ip, OFFERED, time.Minute),
+			want:   silent,
+			check: func(t *testing.T, s *Server) {
+				if s.bindings[testClientKey] != nil || s.allocated[IPToUint32(ip)] != nil {
+					t.Errorf("offer not withdrawn after the client chose another server")
 				}
 			},
 		},
+
+		// INIT-REBOOT
+		{name: "INIT-REBOOT bound", packet: newRequest(nil, nil, ip, nil), setup: bindTo(client, ip, BOUND, time.Hour), want: ack},
+		{name: "INIT-REBOOT unknown client", packet: newRequest(nil, nil, ip, nil), want: silent},
+		{name: "INIT-REBOOT unknown client, authoritative", packet: newRequest(nil, nil, ip, nil), authoritative: true, want: nak},
+		{name: "INIT-REBOOT off network", packet: newRequest(nil, nil, offNetwork, nil), want: silent},
+		{name: "INIT-REBOOT off network, authoritative", packet: newRequest(nil, nil, offNetwork, nil), authoritative: true, want: nak},
+		{name: "INIT-REBOOT known client off network", packet: newRequest(nil, nil, offNetwork, nil), setup: bindTo(client, ip, BOUND, time.Hour), want: nak},
+		{name: "INIT-REBOOT wrong address", packet: newRequest(nil, nil, otherIP, nil), setup: bindTo(client, ip, BOUND, time.Hour), want: nak},
+		{name: "INIT-REBOOT address of another client", packet: newRequest(nil, nil, ip, nil), setup: bindTo(nil, ip, BOUND, time.Hour), want: silent},
+		{name: "INIT-REBOOT address of another client, authoritative", packet: newRequest(nil, nil, ip, nil), setup: bindTo(nil, ip, BOUND, time.Hour), authoritative: true, want: nak},
+		{name: "INIT-REBOOT only offered", packet: newRequest(nil, nil, ip, nil), setup: bindTo(client, ip, OFFERED, time.Minute), want: nak},
+		{name: "INIT-REBOOT expired", packet: newRequest(nil, nil, ip, nil), setup: bindTo(client, ip, BOUND, -time.Minute), want: nak},
+		{name: "INIT-REBOOT released", packet: newRequest(nil, nil, ip, nil), setup: bindTo(client, ip, RELEASED, time.Hour), want: nak},
+		{name: "INIT-REBOOT relayed unknown, authoritative", packet: newRequest(nil, relay, ip, nil), authoritative: true, want: nak},
+
+		// RENEWING
+		{name: "RENEWING bound", packet: newRequest(ip, nil, nil, nil), setup: bindTo(client, ip, BOUND, time.Minute), want: ack},
+		{name: "RENEWING expired", packet: newRequest(ip, nil, nil, nil), setup: bindTo(client, ip, BOUND, -time.Minute), want: nak},
+		{name: "RENEWING wrong address", packet: newRequest(otherIP, nil, nil, nil), setup: bindTo(client, ip, BOUND, time.Hour), want: nak},
+		{name: "RENEWING unknown client", packet: newRequest(ip, nil, nil, nil), want: silent},
+		{name: "RENEWING unknown client, authoritative", packet: newRequest(ip, nil, nil, nil), authoritative: true, want: nak},
 		{
-			name:           "RENEWING - Expired lease",
-			packet:         createPacket(protocol.DHCPREQUEST, net.ParseIP("192.168.1.100"), net.IPv4zero, net.IPv4zero),
-			expectedState:  RENEWING,
-			expectResponse: true,
+			name:   "RENEWING out of range after reload",
+			packet: newRequest(ip, nil, nil, nil),
 			setup: func(s *Server) {
-				s.bindings[MACToUint64(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55})] = &binding{
-					IP:         net.ParseIP("192.168.1.100"),
-					MAC:        net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
-					Expiration: time.Now().Add(-time.Hour),
-				}
-			},
-			additionalCheck: func(t *testing.T, p *protocol.Packet) {
-				if p.DHCPMessageType() != protocol.DHCPNAK {
-					t.Errorf("Expected DHCPNAK for expired lease in RENEWING")
-				}
+				bindTo(client, ip, BOUND, time.Hour)(s)
+				s.bindings[testClientKey].outOfRange = true
 			},
+			want: nak,
 		},
-		{
-			name:           "REBINDING - IP conflict",
-			packet:         createPacket(protocol.DHCPREQUEST, net.ParseIP("192.168.1.100"), net.IPv4zero, net.IPv4zero),
-			expectedState:  REBINDING,
-			expectResponse: true,
-			setup: func(s *Server) {
-				s.bindings[MACToUint64(net.HardwareAddr{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF})] = &binding{
-					IP:         net.ParseIP("192.168.1.100"),
-					MAC:        net.HardwareAddr{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF},
-					Expiration: time.Now().Add(time.Hour),
+
+		// REBINDING
+		{name: "REBINDING bound", packet: newRequest(ip, relay, nil, nil), setup: bindTo(client, ip, BOUND, time.Minute), want: ack},
+		{name: "REBINDING expired", packet: newRequest(ip, relay, nil, nil), setup: bindTo(client, ip, BOUND, -time.Minute), want: nak},
+		{name: "REBINDING address of another client", packet: newRequest(ip, relay, nil, nil), setup: bindTo(nil, ip, BOUND, time.Hour), want: silent},
+		{name: "REBINDING unknown client, authoritative", packet: newRequest(ip, relay, nil, nil), authoritative: true, want: nak},
+
+		// Malformed requests fit no state and are dropped.
+		{name: "server identifier with ciaddr", packet: newRequest(ip, nil, ip, cfg.ServerIP), setup: bindTo(client, ip, BOUND, time.Hour), want: silent},
+		{name: "server identifier without requested address", packet: newRequest(nil, nil, nil, cfg.ServerIP), setup: bindTo(client, ip, OFFERED, time.Minute), want: silent},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := cfg
+			cfg.Authoritative = tc.authoritative
+			server, err := newServer(&cfg)
+			if err != nil {
+				t.Fatalf("newServer: %v", err)
+			}
+			conn := &mockConn{}
+			server.conn = conn
+			if tc.setup != nil {
+				tc.setup(server)
+			}
+
+			server.handleRequest(tc.packet, &net.UDPAddr{IP: net.IPv4bcast, Port: 68})
+			reply := conn.sentPacket()
+
+			switch {
+			case tc.want == silent && reply != nil:
+				t.Fatalf("sent %d, want no reply", reply.DHCPMessageType())
+			case tc.want == silent:
+			case reply == nil:
+				t.Fatalf("no reply, want %d", tc.want)
+			case reply.DHCPMessageType() != tc.want:
+				t.Fatalf("reply %d, want %d", reply.DHCPMessageType(), tc.want)
+			case tc.want == ack:
+				if !reply.YIAddr.Equal(ip) {
+					t.Errorf("ACK for %v, want %v", reply.YIAddr, ip)
 				}
-			},
-			additionalCheck: func(t *testing.T, p *protocol.Packet) {
-				if p.DHCPMessageType() != protocol.DHCPNAK {
-					t.Errorf("Expected DHCPNAK for IP conflict in REBINDING")
+				if b := server.bindings[testClientKey]; b == nil || b.State != BOUND || time.Until(b.Expiration) < 59*time.Minute {
+					t.Errorf("binding not bound for a full lease: %+v", b)
 				}
-			},
-		},
-		{
-			name:           "SELECTING - Full IP pool",
-			packet:         createPacket(protocol.DHCPREQUEST, net.IPv4zero, net.ParseIP("192.168.1.150"), cfg.ServerIP),
-			expectedState:  SELECTING,
-			expectResponse: true,
-			setup: func(s *Server) {
-				for i := 100; i <= 200; i++ {
-					ip := net.ParseIP(fmt.Sprintf("192.168.1.%d", i))
-					s.bindings[uint64(i)] = &binding{
-						IP:         ip,
-						MAC:        net.HardwareAddr{0x00, 0x00, 0x00, 0x00, 0x00, byte(i)},
-						Expiration: time.Now().Add(time.Hour),
-					}
+			case tc.want == nak:
+				if len(reply.GetOption(protocol.OptionMessage)) == 0 {
+					t.Errorf("NAK without a message")
 				}
-			},
-			additionalCheck: func(t *testing.T, p *protocol.Packet) {
-				if p.DHCPMessageType() != protocol.DHCPNAK {
-					t.Errorf("Expected DHCPNAK when IP pool is full")
+				if !reply.GIAddr.Equal(net.IPv4zero) && !reply.IsBroadcast() {
+					t.Errorf("relayed NAK without the broadcast flag")
 				}
-			},
+			}
+			if tc.check != nil {
+				tc.check(t, server)
+			}
+		})
+	}
+}
+
+func TestClassOptionsAndPools(t *testing.T) {
+	cfg := &Config{
+		Subnet:        net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Lease:         time.Hour,
+		RenewalTime:   30 * time.Minute,
+		RebindingTime: 45 * time.Minute,
+		Router:        net.ParseIP("192.168.1.1"),
+		ServerIP:      net.ParseIP("192.168.1.2"),
+		Pools: []PoolConfig{
+			{Name: "general", Start: net.ParseIP("192.168.1.100"), End: net.ParseIP("192.168.1.149")},
+			{Name: "phones", Start: net.ParseIP("192.168.1.150"), End: net.ParseIP("192.168.1.199")},
 		},
-		{
-			name:           "INIT_REBOOT - Requested IP doesn't match binding",
-			packet:         createPacket(protocol.DHCPREQUEST, net.IPv4zero, net.ParseIP("192.168.1.150"), net.IPv4zero),
-			expectedState:  INIT_REBOOT,
-			expectResponse: true,
-			setup: func(s *Server) {
-				s.bindings[MACToUint64(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55})] = &binding{
-					IP:         net.ParseIP("192.168.1.100"), // Different from requested IP
-					MAC:        net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
-					Expiration: time.Now().Add(time.Hour),
-				}
-			},
-			additionalCheck: func(t *testing.T, p *protocol.Packet) {
-				if p.DHCPMessageType() != protocol.DHCPNAK {
-					t.Errorf("Expected DHCPNAK when requested IP doesn't match binding")
-				}
+		Classes: []classify.Class{{
+			Name:      "voip",
+			Test:      "substring(pkt4.mac, 0, 3) == 0x0004f2",
+			Options:   map[byte][]byte{protocol.OptionTFTPServerName: []byte("prov.example.com")},
+			Pools:     []string{"phones"},
+			LeaseTime: 10 * time.Minute,
+		}},
+	}
+
+	discover := func(mac net.HardwareAddr) *protocol.Packet {
+		p := &protocol.Packet{
+			Op:     protocol.BOOTREQUEST,
+			HType:  1,
+			HLen:   6,
+			XId:    1234,
+			CIAddr: net.IPv4zero,
+			YIAddr: net.IPv4zero,
+			SIAddr: net.IPv4zero,
+			GIAddr: net.IPv4zero,
+			CHAddr: mac,
+		}
+		p.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+		return p
+	}
+
+	server, err := newServer(cfg)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+
+	phone := server.createOffer(discover(net.HardwareAddr{0x00, 0x04, 0xf2, 0x01, 0x02, 0x03}))
+	if phone == nil {
+		t.Fatal("expected an offer for the phone")
+	}
+	if !phone.YIAddr.Equal(net.ParseIP("192.168.1.150")) {
+		t.Errorf("phone offered %v, want an address from the phones pool", phone.YIAddr)
+	}
+	if got := string(phone.GetOption(protocol.OptionTFTPServerName)); got != "prov.example.com" {
+		t.Errorf("phone option 66 = %q", got)
+	}
+	if got := phone.GetOption(protocol.OptionIPAddressLeaseTime); binary.BigEndian.Uint32(got) != 600 {
+		t.Errorf("phone lease time = %v, want 600", got)
+	}
+
+	laptop := server.createOffer(discover(net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}))
+	if laptop == nil {
+		t.Fatal("expected an offer for the laptop")
+	}
+	if !laptop.YIAddr.Equal(net.ParseIP("192.168.1.100")) {
+		t.Errorf("laptop offered %v, want the first general address", laptop.YIAddr)
+	}
+	if laptop.GetOption(protocol.OptionTFTPServerName) != nil {
+		t.Error("laptop must not receive class options")
+	}
+}
+
+func TestBindingFollowsClientIdentifier(t *testing.T) {
+	cfg := &Config{
+		Start:    net.ParseIP("192.168.1.100"),
+		End:      net.ParseIP("192.168.1.200"),
+		Subnet:   net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Lease:    time.Hour,
+		Router:   net.ParseIP("192.168.1.1"),
+		ServerIP: net.ParseIP("192.168.1.2"),
+	}
+	server, err := newServer(cfg)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	conn := &mockConn{}
+	server.conn = conn
+
+	clientID := []byte{0, 'l', 'a', 'p', 't', 'o', 'p'}
+	newPacket := func(messageType byte, mac net.HardwareAddr) *protocol.Packet {
+		p := &protocol.Packet{
+			Op:     protocol.BOOTREQUEST,
+			HType:  1,
+			HLen:   6,
+			XId:    42,
+			CIAddr: net.IPv4zero,
+			YIAddr: net.IPv4zero,
+			SIAddr: net.IPv4zero,
+			GIAddr: net.IPv4zero,
+			CHAddr: mac,
+		}
+		p.AddOption(protocol.OptionDHCPMessageType, []byte{messageType})
+		p.AddOption(protocol.OptionClientIdentifier, clientID)
+		return p
+	}
+
+	offer := server.createOffer(newPacket(protocol.DHCPDISCOVER, net.HardwareAddr{0x02, 0, 0, 0, 0, 1}))
+	if offer == nil {
+		t.Fatal("expected an offer")
+	}
+
+	// The client re-randomizes its MAC before requesting the address.
+	request := newPacket(protocol.DHCPREQUEST, net.HardwareAddr{0x02, 0, 0, 0, 0, 2})
+	request.AddOption(protocol.OptionRequestedIPAddress, offer.YIAddr.To4())
+	request.AddOption(protocol.OptionServerIdentifier, cfg.ServerIP.To4())
+	request.SIAddr = cfg.ServerIP
+	server.handleRequest(request, &net.UDPAddr{IP: net.IPv4bcast, Port: 68})
+
+	ack := conn.sentPacket()
+	if ack == nil || ack.DHCPMessageType() != protocol.DHCPACK {
+		t.Fatalf("expected DHCPACK, got %v", ack)
+	}
+	if !ack.YIAddr.Equal(offer.YIAddr) {
+		t.Errorf("ACK for %v, want offered %v", ack.YIAddr, offer.YIAddr)
+	}
+	if got := ack.GetOption(protocol.OptionClientIdentifier); string(got) != string(clientID) {
+		t.Errorf("ACK client identifier = %v, want %v", got, clientID)
+	}
+}
+
+func TestLeaseTransitions(t *testing.T) {
+	testCases := []struct {
+		from, to LeaseState
+		valid    bool
+	}{
+		{FREE, OFFERED, true},
+		{OFFERED, BOUND, true},
+		{OFFERED, FREE, true},
+		{BOUND, BOUND, true},
+		{BOUND, EXPIRED, true},
+		{BOUND, RELEASED, true},
+		{EXPIRED, BOUND, true},
+		{DECLINED, FREE, true},
+		{FREE, EXPIRED, false},
+		{EXPIRED, RELEASED, false},
+		{DECLINED, BOUND, false},
+		{ABANDONED, OFFERED, false},
+		{RELEASED, EXPIRED, false},
+	}
+	for _, tc := range testCases {
+		b := &binding{State: tc.from, IP: net.ParseIP("192.168.1.100")}
+		err := b.transition(tc.to)
+		if tc.valid && err != nil {
+			t.Errorf("%s -> %s: unexpected error %v", tc.from, tc.to, err)
+		}
+		if !tc.valid && (err == nil || b.State != tc.from) {
+			t.Errorf("%s -> %s: expected rejection", tc.from, tc.to)
+		}
+	}
+
+	for _, from := range []LeaseState{BOUND, OFFERED, EXPIRED} {
+		b := &binding{State: from, IP: net.ParseIP("192.168.1.100")}
+		err := b.rollback()
+		if valid := from == BOUND; valid != (err == nil) || valid != (b.State == FREE) {
+			t.Errorf("rollback from %s: state %s, error %v", from, b.State, err)
+		}
+	}
+}
+
+func TestExpireLeases(t *testing.T) {
+	cfg := &Config{
+		Start:         net.ParseIP("192.168.1.100"),
+		End:           net.ParseIP("192.168.1.101"),
+		Subnet:        net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Lease:         time.Hour,
+		OfferHoldTime: 10 * time.Second,
+		ServerIP:      net.ParseIP("192.168.1.2"),
+	}
+	server, err := newServer(cfg)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+
+	discover := func(last byte) *protocol.Packet {
+		p := &protocol.Packet{HType: 1, HLen: 6, CHAddr: net.HardwareAddr{0, 0, 0, 0, 0, last}}
+		p.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+		return p
+	}
+
+	offered, bound := discover(1), discover(2)
+	server.createOffer(offered)
+	server.createOffer(bound)
+	if server.createOffer(discover(3)) != nil {
+		t.Fatal("expected pool to be exhausted")
+	}
+	server.bindings[clientKey(bound)].State = BOUND
+	server.bindings[clientKey(bound)].Expiration = time.Now().Add(time.Hour)
+	server.schedule(server.bindings[clientKey(bound)])
+
+	// The unanswered offer is reclaimed after the hold time, not the lease.
+	server.expireLeases(time.Now().Add(time.Minute))
+	if _, exists := server.bindings[clientKey(offered)]; exists {
+		t.Error("expected unanswered offer to be freed")
+	}
+	if got := server.bindings[clientKey(bound)].State; got != BOUND {
+		t.Errorf("bound lease state = %s, want BOUND", got)
+	}
+	if server.createOffer(discover(3)) == nil {
+		t.Fatal("expected the reclaimed address to be offered again")
+	}
+
+	server.expireLeases(time.Now().Add(2 * time.Hour))
+	if got := server.bindings[clientKey(bound)].State; got != EXPIRED {
+		t.Errorf("lease state after expiry = %s, want EXPIRED", got)
+	}
+	expiredIP := server.bindings[clientKey(bound)].IP
+	if server.allocated[IPToUint32(expiredIP)] == nil {
+		t.Error("expected expired address to stay reserved for its last owner")
+	}
+
+	server.expireLeases(time.Now().Add(4 * time.Hour))
+	if _, exists := server.bindings[clientKey(bound)]; exists {
+		t.Error("expected expired record to be forgotten after the affinity time")
+	}
+	if server.allocated[IPToUint32(expiredIP)] != nil {
+		t.Error("expected address to return to the pool after the affinity time")
+	}
+}
+
+func TestStickyAllocation(t *testing.T) {
+	cfg := &Config{
+		Start:    net.ParseIP("192.168.1.100"),
+		End:      net.ParseIP("192.168.1.103"),
+		Subnet:   net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Lease:    time.Hour,
+		ServerIP: net.ParseIP("192.168.1.2"),
+	}
+	server, err := newServer(cfg)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+
+	discover := func(last byte, requested net.IP) *protocol.Packet {
+		p := &protocol.Packet{HType: 1, HLen: 6, CHAddr: net.HardwareAddr{0, 0, 0, 0, 0, last}}
+		p.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+		if requested != nil {
+			p.AddOption(protocol.OptionRequestedIPAddress, requested.To4())
+		}
+		return p
+	}
+	offerIP := func(p *protocol.Packet) net.IP {
+		t.Helper()
+		offer := server.createOffer(p)
+		if offer == nil {
+			t.Fatal("expected an offer")
+		}
+		return offer.YIAddr
+	}
+
+	// A valid, free requested address is honored.
+	first := offerIP(discover(1, net.ParseIP("192.168.1.102")))
+	if !first.Equal(net.ParseIP("192.168.1.102")) {
+		t.Errorf("offered %v, want the requested 192.168.1.102", first)
+	}
+	// A repeated DISCOVER gets the same offer even when asking for another.
+	if got := offerIP(discover(1, net.ParseIP("192.168.1.103"))); !got.Equal(first) {
+		t.Errorf("re-offered %v, want %v", got, first)
+	}
+	// Requests for foreign addresses fall back to a fresh one.
+	if got := offerIP(discover(2, net.ParseIP("10.0.0.1"))); !got.Equal(net.ParseIP("192.168.1.100")) {
+		t.Errorf("offered %v, want 192.168.1.100", got)
+	}
+
+	b := server.bindings[clientKey(discover(1, nil))]
+	_ = b.transition(BOUND)
+	b.Expiration = time.Now().Add(-time.Second)
+	server.schedule(b)
+	server.expireLeases(time.Now())
+
+	// Another client may not take the expired but affine address.
+	if got := offerIP(discover(3, first)); got.Equal(first) {
+		t.Errorf("affine address %v was offered to another client", got)
+	}
+	// The returning client gets its previous address back.
+	if got := offerIP(discover(1, nil)); !got.Equal(first) {
+		t.Errorf("returning client offered %v, want %v", got, first)
+	}
+}
+
+func TestReclaimAffineAddressWhenExhausted(t *testing.T) {
+	cfg := &Config{
+		Start:    net.ParseIP("192.168.1.100"),
+		End:      net.ParseIP("192.168.1.100"),
+		Subnet:   net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Lease:    time.Hour,
+		ServerIP: net.ParseIP("192.168.1.2"),
+	}
+	server, err := newServer(cfg)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	old := &binding{IP: net.ParseIP("192.168.1.100"), ClientID: []byte("old"), State: RELEASED, Expiration: time.Now().Add(time.Hour)}
+	server.bindings["old"] = old
+	server.allocated[IPToUint32(old.IP)] = old
+	if !server.pools[0].AllocateIP(net.ParseIP("192.168.1.100")) {
+		t.Fatal("failed to reserve address")
+	}
+
+	p := &protocol.Packet{HType: 1, HLen: 6, CHAddr: net.HardwareAddr{0, 0, 0, 0, 0, 9}}
+	offer := server.createOffer(p)
+	if offer == nil || !offer.YIAddr.Equal(net.ParseIP("192.168.1.100")) {
+		t.Fatalf("expected the affine address to be reclaimed, got %v", offer)
+	}
+	if _, exists := server.bindings["old"]; exists {
+		t.Error("expected the previous owner's record to be dropped")
+	}
+}
+
+func TestExcludedAddressesAreNeverOffered(t *testing.T) {
+	_, gateway, _ := net.ParseCIDR("192.168.1.101/32")
+	_, vips, _ := net.ParseCIDR("192.168.1.102/31")
+	cfg := &Config{
+		Subnet:   net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Lease:    time.Hour,
+		ServerIP: net.ParseIP("192.168.1.2"),
+		Exclude:  []net.IPNet{*gateway},
+		Pools: []PoolConfig{{
+			Ranges: []pool.Range{
+				{Start: net.ParseIP("192.168.1.100"), End: net.ParseIP("192.168.1.103")},
+				{Start: net.ParseIP("192.168.1.150"), End: net.ParseIP("192.168.1.150")},
 			},
+			Exclude: []net.IPNet{*vips},
+		}},
+	}
+	server, err := newServer(cfg)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+
+	var offered []string
+	for i := byte(1); i <= 3; i++ {
+		p := &protocol.Packet{HType: 1, HLen: 6, CHAddr: net.HardwareAddr{0, 0, 0, 0, 0, i}}
+		p.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+		p.AddOption(protocol.OptionRequestedIPAddress, net.ParseIP("192.168.1.101").To4())
+		if offer := server.createOffer(p); offer != nil {
+			offered = append(offered, offer.YIAddr.String())
+		}
+	}
+	if len(offered) != 2 || offered[0] != "192.168.1.100" || offered[1] != "192.168.1.150" {
+		t.Errorf("offered %v, want [192.168.1.100 192.168.1.150]", offered)
+	}
+}
+
+func TestOverlappingPoolsAreRejected(t *testing.T) {
+	cfg := &Config{
+		Subnet:   net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Lease:    time.Hour,
+		ServerIP: net.ParseIP("192.168.1.2"),
+		Pools: []PoolConfig{
+			{Name: "a", Start: net.ParseIP("192.168.1.10"), End: net.ParseIP("192.168.1.99")},
+			{Name: "b", Start: net.ParseIP("192.168.1.50"), End: net.ParseIP("192.168.1.150")},
 		},
 	}
+	if _, err := newServer(cfg); err == nil {
+		t.Error("expected overlapping pools to be rejected")
+	}
+}
 
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			server, _ := NewServer(cfg)
-			server.conn.Close()
-			server.conn = &mockConn{}
+func TestConflictingAddressIsAbandoned(t *testing.T) {
+	cfg := &Config{
+		Subnet:   net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Start:    net.ParseIP("192.168.1.100"),
+		End:      net.ParseIP("192.168.1.110"),
+		Lease:    time.Hour,
+		ServerIP: net.ParseIP("192.168.1.2"),
+	}
+	server, err := newServer(cfg)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	var probed []string
+	server.localProber = probe.Func(func(_ context.Context, ip net.IP) (bool, error) {
+		probed = append(probed, ip.String())
+		return ip.Equal(net.ParseIP("192.168.1.100")), nil
+	})
 
-			if tc.setup != nil {
-				tc.setup(server)
-			}
+	p := &protocol.Packet{HType: 1, HLen: 6, CIAddr: net.IPv4zero, GIAddr: net.IPv4zero, CHAddr: net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}}
+	p.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+	offer := server.createOffer(p)
+	if offer == nil || !offer.YIAddr.Equal(net.ParseIP("192.168.1.101")) {
+		t.Fatalf("offer = %v, want 192.168.1.101", offer)
+	}
+	if len(probed) != 2 {
+		t.Errorf("probed %v, want two addresses", probed)
+	}
+
+	abandoned := server.allocated[IPToUint32(net.ParseIP("192.168.1.100"))]
+	if abandoned == nil || abandoned.State != ABANDONED {
+		t.Fatalf("conflicting address not abandoned: %+v", abandoned)
+	}
+	if b := server.bindings[testClientKey]; b == nil || b.State != OFFERED || b == abandoned {
+		t.Errorf("client binding = %+v, want OFFERED 192.168.1.101", b)
+	}
+
+	// Repeating the DISCOVER reuses the offer without probing again.
+	probed = nil
+	if offer := server.createOffer(p); offer == nil || !offer.YIAddr.Equal(net.ParseIP("192.168.1.101")) {
+		t.Errorf("repeated offer = %v, want 192.168.1.101", offer)
+	}
+	if len(probed) != 0 {
+		t.Errorf("repeated offer probed %v", probed)
+	}
 
-			server.handleRequest(tc.packet, mockAddr)
-			sentPacket := server.conn.(*mockConn).sentPacket()
+	server.expireLeases(time.Now().Add(server.abandonTime() + time.Second))
+	if server.allocated[IPToUint32(net.ParseIP("192.168.1.100"))] != nil {
+		t.Errorf("abandoned address not returned after the abandon time")
+	}
+}
 
-			if tc.expectResponse && sentPacket == nil {
-				t.Errorf("Expected a response packet, but none was sent")
-			} else if !tc.expectResponse && sentPacket != nil {
-				t.Errorf("Did not expect a response packet, but one was sent")
-			}
+func TestProbeDoesNotBlockWorker(t *testing.T) {
+	server, err := newServer(&Config{
+		Subnet:   net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Start:    net.ParseIP("192.168.1.100"),
+		End:      net.ParseIP("192.168.1.110"),
+		Lease:    time.Hour,
+		ServerIP: net.ParseIP("192.168.1.2"),
+		Workers:  1,
+	})
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	// The probe of the first address hangs until released.
+	probing, release := make(chan struct{}), make(chan struct{})
+	server.localProber = probe.Func(func(_ context.Context, ip net.IP) (bool, error) {
+		if ip.Equal(net.ParseIP("192.168.1.100")) {
+			close(probing)
+			<-release
+		}
+		return false, nil
+	})
+	conn := &sendingConn{sent: make(chan []byte, 4)}
+	server.conn = conn
+	var workers sync.WaitGroup
+	server.pipeline.start(&workers, server.processPacket)
 
-			if sentPacket != nil && tc.additionalCheck != nil {
-				tc.additionalCheck(t, sentPacket)
+	discover := func(client byte) *input {
+		p := &protocol.Packet{Op: protocol.BOOTREQUEST, HType: 1, HLen: 6, CIAddr: net.IPv4zero, YIAddr: net.IPv4zero,
+			SIAddr: net.IPv4zero, GIAddr: net.IPv4zero, CHAddr: make(net.HardwareAddr, 16), SName: make([]byte, 64), File: make([]byte, 128)}
+		copy(p.CHAddr, []byte{0, 0x22, 0, 0, 0, client})
+		p.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+		buf := make([]byte, 1500)
+		n := copy(buf, p.Encode())
+		return &input{data: buf[:n], addr: &net.UDPAddr{IP: net.IPv4bcast, Port: 68}, buf: buf}
+	}
+	offer := func() *protocol.Packet {
+		t.Helper()
+		select {
+		case data := <-conn.sent:
+			p, err := protocol.Decode(data)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
 			}
-		})
+			return p
+		case <-time.After(5 * time.Second):
+			t.Fatal("no offer sent")
+			return nil
+		}
+	}
+
+	server.pipeline.dispatch(discover(1))
+	select {
+	case <-probing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first address was not probed")
+	}
+	// Both go to the only worker while the first client's probe is
+	// pending; the retransmission is ignored and the second client
+	// answered.
+	server.pipeline.dispatch(discover(1))
+	server.pipeline.dispatch(discover(2))
+	if p := offer(); p.HardwareAddr()[5] != 2 || !p.YIAddr.Equal(net.ParseIP("192.168.1.101")) {
+		t.Errorf("first reply = %v for client %d, want 192.168.1.101 for client 2", p.YIAddr, p.HardwareAddr()[5])
+	}
+
+	close(release)
+	if p := offer(); p.HardwareAddr()[5] != 1 || !p.YIAddr.Equal(net.ParseIP("192.168.1.100")) {
+		t.Errorf("reply after probe = %v for client %d, want 192.168.1.100 for client 1", p.YIAddr, p.HardwareAddr()[5])
+	}
+	server.pipeline.close()
+	workers.Wait()
+	server.wg.Wait()
+	if len(conn.sent) != 0 {
+		t.Errorf("%d more replies sent, want the retransmitted DISCOVER ignored", len(conn.sent))
+	}
+}
+
+func TestDeclineQuarantinesAddress(t *testing.T) {
+	cfg := &Config{
+		Subnet:      net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Start:       net.ParseIP("192.168.1.100"),
+		End:         net.ParseIP("192.168.1.110"),
+		Lease:       time.Hour,
+		ServerIP:    net.ParseIP("192.168.1.2"),
+		DeclineTime: 2 * time.Hour,
+	}
+	server, err := newServer(cfg)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	mac := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	discover := &protocol.Packet{HType: 1, HLen: 6, CIAddr: net.IPv4zero, GIAddr: net.IPv4zero, CHAddr: mac}
+	discover.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+	offered := server.createOffer(discover).YIAddr
+
+	decline := func(ciaddr, requested net.IP) {
+		p := &protocol.Packet{HType: 1, HLen: 6, CIAddr: ciaddr, GIAddr: net.IPv4zero, CHAddr: mac}
+		p.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDECLINE})
+		p.AddOption(protocol.OptionServerIdentifier, cfg.ServerIP.To4())
+		if requested != nil {
+			p.AddOption(protocol.OptionRequestedIPAddress, requested.To4())
+		}
+		server.handleDecline(p)
+	}
+
+	decline(offered, nil)
+	decline(net.IPv4zero, net.ParseIP("192.168.1.105"))
+	if b := server.bindings[testClientKey]; b == nil || b.State != OFFERED {
+		t.Fatalf("invalid declines changed the binding: %+v", b)
+	}
+
+	decline(net.IPv4zero, offered)
+	if _, exists := server.bindings[testClientKey]; exists {
+		t.Errorf("declined binding still attached to the client")
+	}
+	b := server.allocated[IPToUint32(offered)]
+	if b == nil || b.State != DECLINED {
+		t.Fatalf("declined address not quarantined: %+v", b)
+	}
+	conflicts := server.Conflicts()
+	if len(conflicts) != 1 || !conflicts[0].IP.Equal(offered) || conflicts[0].Reason != ConflictDeclined {
+		t.Errorf("conflicts = %+v, want one decline of %v", conflicts, offered)
+	}
+
+	if next := server.createOffer(discover).YIAddr; next.Equal(offered) {
+		t.Errorf("declined address %v offered again", offered)
+	}
+
+	server.expireLeases(time.Now().Add(time.Hour))
+	if server.allocated[IPToUint32(offered)] == nil {
+		t.Errorf("address released before the decline time")
+	}
+	server.expireLeases(time.Now().Add(3 * time.Hour))
+	if server.allocated[IPToUint32(offered)] != nil {
+		t.Errorf("address still quarantined after the decline time")
+	}
+}
+
+func TestLeasesSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.journal")
+	newStoredServer := func() *Server {
+		journal, err := store.OpenJournal(path)
+		if err != nil {
+			t.Fatalf("OpenJournal: %v", err)
+		}
+		t.Cleanup(func() { journal.Close() })
+		server, err := newServer(&Config{
+			Subnet:   net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+			Start:    net.ParseIP("192.168.1.100"),
+			End:      net.ParseIP("192.168.1.110"),
+			Lease:    time.Hour,
+			ServerIP: net.ParseIP("192.168.1.2"),
+			Store:    journal,
+			Classes:  []classify.Class{{Name: "ethernet", Test: "pkt4.htype == 0x01"}},
+		})
+		if err != nil {
+			t.Fatalf("newServer: %v", err)
+		}
+		return server
+	}
+
+	server := newStoredServer()
+	mac := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	discover := &protocol.Packet{HType: 1, HLen: 6, CIAddr: net.IPv4zero, GIAddr: net.IPv4zero, CHAddr: mac}
+	discover.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+	ip := server.createOffer(discover).YIAddr
+
+	relayAgentInfo := append([]byte{protocol.RelayAgentRemoteID, 5}, "sub-1"...)
+	request := newRequest(nil, nil, ip, net.ParseIP("192.168.1.2"))
+	request.AddOption(protocol.OptionDHCPAgentOptions, relayAgentInfo)
+	request.AddOption(protocol.OptionForceRenewCapable, []byte{1})
+	ack := server.createRequestReply(request)
+	if ack.GetOption(protocol.OptionDHCPMessageType)[0] != protocol.DHCPACK {
+		t.Fatalf("expected ACK for %v", ip)
+	}
+	key := ack.ForceRenewNonce()
+	if key == nil {
+		t.Fatalf("ACK carries no FORCERENEW nonce")
+	}
+
+	// An offer that has already run out is not restored.
+	other := &protocol.Packet{HType: 1, HLen: 6, CIAddr: net.IPv4zero, GIAddr: net.IPv4zero, CHAddr: net.HardwareAddr{0, 0, 0, 0, 0, 1}}
+	other.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+	stale := server.createOffer(other).YIAddr
+	b := server.allocated[IPToUint32(stale)]
+	b.Expiration = time.Now().Add(-time.Minute)
+	server.schedule(b)
+	server.persist(b)
+
+	restarted := newStoredServer()
+	b = restarted.bindings[testClientKey]
+	if b == nil || b.State != BOUND || !b.IP.Equal(ip) {
+		t.Fatalf("restored binding = %+v, want BOUND %v", b, ip)
+	}
+	if b.HType != 1 || !slices.Equal(b.classes, []string{"ethernet"}) || !bytes.Equal(b.relayAgentInfo, relayAgentInfo) {
+		t.Errorf("restored binding has htype %d, classes %v and option 82 %x, want the acknowledged ones", b.HType, b.classes, b.relayAgentInfo)
+	}
+	if restarted.allocated[IPToUint32(ip)] != b || !restarted.pools[0].InUse(ip) {
+		t.Errorf("restored address %v not marked in use", ip)
+	}
+	if restarted.allocated[IPToUint32(stale)] != nil || restarted.pools[0].InUse(stale) {
+		t.Errorf("expired offer of %v was restored", stale)
+	}
+
+	// The client can be forced to renew without waiting for T1.
+	conn := &mockConn{}
+	restarted.conn = conn
+	if n, err := restarted.ForceRenewClass("ethernet"); err != nil || n != 1 {
+		t.Fatalf("ForceRenewClass after restart = %d, %v, want 1", n, err)
+	}
+	if !protocol.VerifyForceRenew(conn.p, key) {
+		t.Errorf("FORCERENEW after restart does not verify with the client's nonce")
+	}
+	if offer := restarted.createOffer(discover); offer == nil || !offer.YIAddr.Equal(ip) {
+		t.Errorf("client offered %v after restart, want %v", offer, ip)
+	}
+}
+
+func TestServersSharingSQLStoreDoNotReuseAddresses(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "leases.db"))
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+	leases, err := store.OpenSQL(db, "sqlite")
+	if err != nil {
+		t.Fatalf("OpenSQL: %v", err)
+	}
+	newSharedServer := func() *Server {
+		server, err := newServer(&Config{
+			Subnet:   net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+			Start:    net.ParseIP("192.168.1.100"),
+			End:      net.ParseIP("192.168.1.110"),
+			Lease:    time.Hour,
+			ServerIP: net.ParseIP("192.168.1.2"),
+			Store:    leases,
+		})
+		if err != nil {
+			t.Fatalf("newServer: %v", err)
+		}
+		return server
+	}
+	first, second := newSharedServer(), newSharedServer()
+
+	discover := func(last byte) *protocol.Packet {
+		p := &protocol.Packet{HType: 1, HLen: 6, CIAddr: net.IPv4zero, GIAddr: net.IPv4zero, CHAddr: net.HardwareAddr{0, 0, 0, 0, 0, last}}
+		p.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+		return p
+	}
+	a := first.createOffer(discover(1)).YIAddr
+	b := second.createOffer(discover(2)).YIAddr
+	if a.Equal(b) {
+		t.Fatalf("both servers offered %v", a)
+	}
+	if adopted := second.allocated[IPToUint32(a)]; adopted == nil || adopted.State != OFFERED {
+		t.Errorf("second server did not mirror the first server's offer of %v: %+v", a, adopted)
+	}
+
+	stored, err := leases.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(stored) != 2 {
+		t.Errorf("store holds %d leases, want 2", len(stored))
+	}
+
+	// A store that cannot bind stops the offer: going ahead could hand
+	// out an address another server holds.
+	broken := newSharedServer()
+	broken.store = failingStore{LeaseStore: leases, err: errors.New("connection reset")}
+	if offer := broken.createOffer(discover(3)); offer != nil {
+		t.Errorf("offered %v although the store failed", offer.YIAddr)
+	}
+	if len(broken.allocated) != 2 {
+		t.Errorf("server holds %d addresses after a failed bind, want the 2 restored", len(broken.allocated))
+	}
+}
+
+// failingStore fails every Bind with err.
+type failingStore struct {
+	store.LeaseStore
+	err error
+}
+
+func (f failingStore) Bind(*store.Lease) (*store.Lease, error) {
+	return nil, f.err
+}
+
+func TestImportLeases(t *testing.T) {
+	server, err := newServer(&Config{
+		Subnet:   net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Start:    net.ParseIP("192.168.1.100"),
+		End:      net.ParseIP("192.168.1.110"),
+		Lease:    time.Hour,
+		ServerIP: net.ParseIP("192.168.1.2"),
+	})
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	mac := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	discover := &protocol.Packet{HType: 1, HLen: 6, CIAddr: net.IPv4zero, GIAddr: net.IPv4zero, CHAddr: mac}
+	discover.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+	offered := server.createOffer(discover).YIAddr
+
+	now := time.Now()
+	lease := func(ip string, client byte, state LeaseState, expiration time.Time) *store.Lease {
+		return &store.Lease{
+			IP:         net.ParseIP(ip).To4(),
+			ClientID:   []byte{1, 0, 0, 0, 0, 0, client},
+			MAC:        net.HardwareAddr{0, 0, 0, 0, 0, client},
+			State:      state,
+			Start:      now.Add(-time.Minute),
+			Expiration: expiration,
+		}
+	}
+	imported, err := server.ImportLeases([]*store.Lease{
+		lease("192.168.1.105", 1, BOUND, now.Add(time.Hour)),
+		lease("192.168.1.106", 2, DECLINED, now.Add(time.Hour)),
+		lease(offered.String(), 3, BOUND, now.Add(time.Hour)),
+		lease("192.168.1.107", 1, BOUND, now.Add(time.Hour)),
+		lease("192.168.1.108", 4, BOUND, now.Add(-time.Hour)),
+		lease("10.0.0.1", 5, BOUND, now.Add(time.Hour)),
+	}, now)
+	if imported != 2 {
+		t.Errorf("imported %d leases, want 2", imported)
+	}
+	if err == nil || len(strings.Split(err.Error(), "\n")) != 4 {
+		t.Errorf("expected four skipped leases, got %v", err)
+	}
+
+	if b := server.bindings[string([]byte{1, 0, 0, 0, 0, 0, 1})]; b == nil || !b.IP.Equal(net.ParseIP("192.168.1.105")) || b.State != BOUND {
+		t.Errorf("imported binding = %+v", b)
+	}
+	if !server.pools[0].InUse(net.ParseIP("192.168.1.106")) {
+		t.Errorf("imported declined address not marked in use")
+	}
+
+	exported := server.Leases()
+	if len(exported) != 3 {
+		t.Fatalf("exported %d leases, want 3", len(exported))
+	}
+	for i, ip := range []string{offered.String(), "192.168.1.105", "192.168.1.106"} {
+		if !exported[i].IP.Equal(net.ParseIP(ip)) {
+			t.Errorf("exported lease %d = %v, want %v", i, exported[i].IP, ip)
+		}
+	}
+}
+
+func TestExpirySchedulerFiresOnTime(t *testing.T) {
+	const lease = 200 * time.Millisecond
+	server, err := newServer(&Config{
+		Subnet:       net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Start:        net.ParseIP("192.168.1.100"),
+		End:          net.ParseIP("192.168.1.110"),
+		Lease:        lease,
+		AffinityTime: time.Hour,
+		ServerIP:     net.ParseIP("192.168.1.2"),
+	})
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	expired := make(chan *store.Lease, 1)
+	server.OnExpire(func(l *store.Lease) {
+		// The hook runs without locks held and may call into the server.
+		_ = server.Leases()
+		expired <- l
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.runExpiry(ctx)
+
+	mac := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	discover := &protocol.Packet{HType: 1, HLen: 6, CIAddr: net.IPv4zero, GIAddr: net.IPv4zero, CHAddr: mac}
+	discover.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+	ip := server.createOffer(discover).YIAddr
+	ack := func(selecting bool) {
+		if selecting {
+			server.createRequestReply(newRequest(nil, nil, ip, server.config.ServerIP))
+		} else {
+			server.createRequestReply(newRequest(ip, nil, nil, nil))
+		}
+	}
+	ack(true)
+	bound := time.Now()
+
+	// Renewing halfway re-keys the lease, so it must not fire at the
+	// original expiration.
+	time.Sleep(lease / 2)
+	ack(false)
+	renewed := time.Now()
+
+	select {
+	case l := <-expired:
+		if elapsed := time.Since(bound); elapsed < lease+lease/2-20*time.Millisecond {
+			t.Errorf("lease expired after %v, before its renewed expiration", elapsed)
+		}
+		if elapsed := time.Since(renewed); elapsed > lease+500*time.Millisecond {
+			t.Errorf("lease expired %v after renewal, want about %v", elapsed, lease)
+		}
+		if !l.IP.Equal(ip) || l.State != EXPIRED {
+			t.Errorf("hook got %+v, want EXPIRED %v", l, ip)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lease did not expire")
+	}
+
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+	if len(server.expiry) != len(server.allocated) {
+		t.Errorf("expiry heap holds %d bindings, allocated %d", len(server.expiry), len(server.allocated))
+	}
+	if b := server.allocated[IPToUint32(ip)]; b == nil || b.State != EXPIRED || b.heapIndex == 0 {
+		t.Errorf("expired binding = %+v, want EXPIRED and rescheduled for the affinity time", b)
+	}
+}
+
+func TestPipelineOrderingAndBackpressure(t *testing.T) {
+	raw := func(client byte, seq uint32) *input {
+		data := make([]byte, 240)
+		data[hlenOffset] = 6
+		binary.BigEndian.PutUint32(data[4:], seq)
+		copy(data[chaddrOffset:], []byte{0, 0, 0, 0, 0, client})
+		return &input{data: data}
+	}
+
+	p := newPipeline(4, 8)
+	gate := make(chan struct{})
+	var mu sync.Mutex
+	seen := make(map[byte][]uint32)
+	var wg sync.WaitGroup
+	p.start(&wg, func(in *input) {
+		<-gate
+		mu.Lock()
+		defer mu.Unlock()
+		client := in.data[chaddrOffset+5]
+		seen[client] = append(seen[client], binary.BigEndian.Uint32(in.data[4:]))
+	})
+
+	// With the workers blocked, one client can queue one packet in the
+	// worker plus the queue depth; the rest are dropped, not blocked on.
+	var accepted int
+	for seq := uint32(0); seq < 20; seq++ {
+		if p.dispatch(raw(1, seq)) {
+			accepted++
+		}
+	}
+	if accepted < 8 || accepted > 9 {
+		t.Errorf("accepted %d packets for one blocked worker, want 8 or 9", accepted)
+	}
+	for seq := uint32(0); seq < 5; seq++ {
+		p.dispatch(raw(2, seq))
+	}
+
+	// Closing drains everything already queued, in order.
+	p.close()
+	close(gate)
+	wg.Wait()
+
+	stats := p.stats()
+	if stats.Received != 25 || stats.Dropped != uint64(20-accepted) || stats.Processed != stats.Received-stats.Dropped {
+		t.Errorf("stats = %+v, accepted %d", stats, accepted)
+	}
+	for client, seqs := range seen {
+		for i := 1; i < len(seqs); i++ {
+			if seqs[i] <= seqs[i-1] {
+				t.Errorf("client %d processed out of order: %v", client, seqs)
+				break
+			}
+		}
+	}
+	if len(seen[1]) != accepted {
+		t.Errorf("processed %d packets for client 1, want %d", len(seen[1]), accepted)
+	}
+}
+
+func TestServeAndShutdown(t *testing.T) {
+	start := func() (*Server, net.Addr, chan error) {
+		t.Helper()
+		server, err := newServer(&Config{
+			Subnet:   net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+			Start:    net.ParseIP("192.168.1.100"),
+			End:      net.ParseIP("192.168.1.110"),
+			Lease:    time.Hour,
+			ServerIP: net.ParseIP("192.168.1.2"),
+		})
+		if err != nil {
+			t.Fatalf("newServer: %v", err)
+		}
+		server.conn, err = net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("ListenPacket: %v", err)
+		}
+		served := make(chan error, 1)
+		go func() { served <- server.Serve(context.Background()) }()
+		select {
+		case <-server.Ready():
+		case <-time.After(5 * time.Second):
+			t.Fatal("server did not become ready")
+		}
+		return server, server.conn.LocalAddr(), served
+	}
+
+	// Several servers can run side by side in one process.
+	first, firstAddr, firstServed := start()
+	second, _, secondServed := start()
+
+	if err := first.Serve(context.Background()); !errors.Is(err, ErrServerStarted) {
+		t.Errorf("second Serve = %v, want ErrServerStarted", err)
+	}
+
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	defer client.Close()
+	discover := &protocol.Packet{Op: protocol.BOOTREQUEST, HType: 1, HLen: 6, CIAddr: net.IPv4zero, YIAddr: net.IPv4zero,
+		SIAddr: net.IPv4zero, GIAddr: net.IPv4zero, CHAddr: make(net.HardwareAddr, 16), SName: make([]byte, 64), File: make([]byte, 128)}
+	copy(discover.CHAddr, []byte{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+	discover.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+	if _, err := client.WriteTo(discover.Encode(), firstAddr); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for first.Stats().Received == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := first.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if err := <-firstServed; err != nil {
+		t.Errorf("Serve returned %v after Shutdown", err)
+	}
+	if stats := first.Stats(); stats.Received != 1 || stats.Processed != 1 {
+		t.Errorf("stats after shutdown = %+v, want the packet drained", stats)
+	}
+
+	// Cancelling a server's context stops only that server.
+	select {
+	case err := <-secondServed:
+		t.Fatalf("second server stopped with the first: %v", err)
+	default:
+	}
+	if err := second.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if err := <-secondServed; err != nil {
+		t.Errorf("Serve returned %v", err)
+	}
+}
+
+func TestReloadConfiguration(t *testing.T) {
+	cfg := &Config{
+		Subnet:   net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Start:    net.ParseIP("192.168.1.100"),
+		End:      net.ParseIP("192.168.1.110"),
+		Lease:    time.Hour,
+		DNS:      []net.IP{net.ParseIP("8.8.8.8")},
+		ServerIP: net.ParseIP("192.168.1.2"),
+	}
+	server, err := newServer(cfg)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	mac := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	discover := &protocol.Packet{HType: 1, HLen: 6, CIAddr: net.IPv4zero, GIAddr: net.IPv4zero, CHAddr: mac}
+	discover.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+	offered := server.createOffer(discover).YIAddr
+
+	ack := server.createRequestReply(newRequest(nil, nil, offered, cfg.ServerIP))
+	if ack.DHCPMessageType() != protocol.DHCPACK {
+		t.Fatalf("request for %v not acknowledged", offered)
+	}
+
+	invalid := *cfg
+	invalid.Lease = 0
+	if err := server.Reload(&invalid); err == nil {
+		t.Errorf("Reload accepted a zero lease time")
+	}
+	if server.config.Lease != time.Hour {
+		t.Errorf("rejected reload changed the configuration")
+	}
+
+	shrunk := *cfg
+	shrunk.Start = net.ParseIP("192.168.1.105")
+	shrunk.DNS = []net.IP{net.ParseIP("1.1.1.1")}
+	if err := server.Reload(&shrunk); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+
+	if b := server.allocated[IPToUint32(offered)]; b == nil || b.State != BOUND {
+		t.Fatalf("reload dropped the binding for %v: %+v", offered, b)
+	}
+	out := server.OutOfRangeLeases()
+	if len(out) != 1 || !out[0].IP.Equal(offered) {
+		t.Errorf("OutOfRangeLeases = %+v, want %v", out, offered)
+	}
+
+	nak := server.createRequestReply(newRequest(offered, nil, nil, nil))
+	if nak.DHCPMessageType() != protocol.DHCPNAK {
+		t.Errorf("renewal of an out-of-range lease got %d, want NAK", nak.DHCPMessageType())
+	}
+
+	reply := server.createOffer(discover)
+	if reply == nil {
+		t.Fatalf("no offer after reload")
+	}
+	if ip := IPToUint32(reply.YIAddr); ip < IPToUint32(shrunk.Start) || ip > IPToUint32(shrunk.End) {
+		t.Errorf("offered %v outside the reloaded range", reply.YIAddr)
+	}
+	if dns := reply.GetOption(protocol.OptionDomainNameServer); !net.IP(dns).Equal(net.ParseIP("1.1.1.1")) {
+		t.Errorf("DNS = %v, want the reloaded server", net.IP(dns))
+	}
+	if server.allocated[IPToUint32(offered)] != nil || len(server.OutOfRangeLeases()) != 0 {
+		t.Errorf("out-of-range address still held after the client moved")
+	}
+}
+
+func TestInformReplyCarriesConfigurationOnly(t *testing.T) {
+	cfg := &Config{
+		Subnet:     net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Start:      net.ParseIP("192.168.1.100"),
+		End:        net.ParseIP("192.168.1.110"),
+		Lease:      time.Hour,
+		DNS:        []net.IP{net.ParseIP("8.8.8.8")},
+		ServerIP:   net.ParseIP("192.168.1.2"),
+		DomainName: "example.com",
+		Classes: []classify.Class{{
+			Name:    "windows",
+			Test:    "substring(option[60].hex, 0, 4) == 'MSFT'",
+			Options: map[byte][]byte{252: []byte("http://wpad.example.com/wpad.dat")},
+		}},
+	}
+	server, err := newServer(cfg)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	inform := func(ciaddr, giaddr string) *protocol.Packet {
+		p := &protocol.Packet{
+			HType:  1,
+			HLen:   6,
+			CIAddr: net.ParseIP(ciaddr).To4(),
+			GIAddr: net.ParseIP(giaddr).To4(),
+			CHAddr: net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+		}
+		p.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPINFORM})
+		p.AddOption(protocol.OptionClassIdentifier, []byte("MSFT 5.0"))
+		return p
+	}
+
+	ack := server.createInformAck(inform("192.168.1.50", "0.0.0.0"))
+	if ack == nil || ack.DHCPMessageType() != protocol.DHCPACK {
+		t.Fatalf("no ACK for an INFORM from the served subnet")
+	}
+	if !ack.YIAddr.Equal(net.IPv4zero) || !ack.CIAddr.Equal(net.ParseIP("192.168.1.50")) {
+		t.Errorf("yiaddr = %v, ciaddr = %v; want 0.0.0.0 and the client's address", ack.YIAddr, ack.CIAddr)
+	}
+	if ack.GetOption(protocol.OptionIPAddressLeaseTime) != nil {
+		t.Errorf("inform reply carries a lease time")
+	}
+	if got := string(ack.GetOption(protocol.OptionDomainName)); got != "example.com" {
+		t.Errorf("domain name = %q, want example.com", got)
+	}
+	if got := string(ack.GetOption(252)); got != "http://wpad.example.com/wpad.dat" {
+		t.Errorf("WPAD option = %q, want the class value", got)
+	}
+	if len(server.allocated) != 0 || len(server.bindings) != 0 {
+		t.Errorf("INFORM created a binding")
+	}
+
+	if server.createInformAck(inform("10.1.1.5", "192.168.1.1")) == nil {
+		t.Errorf("no ACK for an INFORM relayed from the served subnet")
+	}
+	if server.createInformAck(inform("10.1.1.5", "0.0.0.0")) != nil {
+		t.Errorf("answered an INFORM from outside the served subnet")
+	}
+	if server.createInformAck(inform("0.0.0.0", "0.0.0.0")) != nil {
+		t.Errorf("answered an INFORM without ciaddr")
+	}
+}
+
+func TestClientRequestedLeaseTime(t *testing.T) {
+	cfg := &Config{
+		Subnet:        net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Start:         net.ParseIP("192.168.1.100"),
+		End:           net.ParseIP("192.168.1.110"),
+		Lease:         time.Hour,
+		MinLease:      10 * time.Minute,
+		MaxLease:      4 * time.Hour,
+		RenewalTime:   30 * time.Minute,
+		RebindingTime: 45 * time.Minute,
+		ServerIP:      net.ParseIP("192.168.1.2"),
+	}
+	server, err := newServer(cfg)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	withLease := func(p *protocol.Packet, lease time.Duration) *protocol.Packet {
+		if lease > 0 {
+			seconds := make([]byte, 4)
+			binary.BigEndian.PutUint32(seconds, uint32(lease.Seconds()))
+			p.AddOption(protocol.OptionIPAddressLeaseTime, seconds)
+		}
+		return p
+	}
+	seconds := func(p *protocol.Packet, code byte) time.Duration {
+		return time.Duration(binary.BigEndian.Uint32(p.GetOption(code))) * time.Second
+	}
+	checkTimes := func(name string, p *protocol.Packet, lease time.Duration) {
+		t.Helper()
+		if p == nil {
+			t.Fatalf("%s: no reply", name)
+		}
+		if got := seconds(p, protocol.OptionIPAddressLeaseTime); got != lease {
+			t.Errorf("%s: lease = %v, want %v", name, got, lease)
+		}
+		if got := seconds(p, protocol.OptionRenewalTime); got != lease/2 {
+			t.Errorf("%s: T1 = %v, want %v", name, got, lease/2)
+		}
+		if got := seconds(p, protocol.OptionRebindingTime); got != lease*3/4 {
+			t.Errorf("%s: T2 = %v, want %v", name, got, lease*3/4)
+		}
+	}
+
+	discover := &protocol.Packet{HType: 1, HLen: 6, CIAddr: net.IPv4zero, GIAddr: net.IPv4zero, CHAddr: net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}}
+	discover.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+	offer := server.createOffer(withLease(discover, 2*time.Hour))
+	checkTimes("offer", offer, 2*time.Hour)
+	ip := offer.YIAddr
+
+	// The ACK grants what was offered even if the REQUEST asks again.
+	checkTimes("selecting", server.createRequestReply(withLease(newRequest(nil, nil, ip, cfg.ServerIP), 3*time.Hour)), 2*time.Hour)
+	if b := server.bindings[testClientKey]; time.Until(b.Expiration) < 119*time.Minute {
+		t.Errorf("binding expires at %v, want in 2h", b.Expiration)
+	}
+
+	checkTimes("renew above maximum", server.createRequestReply(withLease(newRequest(ip, nil, nil, nil), 10*time.Hour)), 4*time.Hour)
+	checkTimes("renew below minimum", server.createRequestReply(withLease(newRequest(ip, nil, nil, nil), time.Minute)), 10*time.Minute)
+	checkTimes("renew without request", server.createRequestReply(newRequest(ip, nil, nil, nil)), time.Hour)
+
+	for name, bounds := range map[string][2]time.Duration{
+		"minimum above default": {2 * time.Hour, 0},
+		"maximum below default": {0, 30 * time.Minute},
+	} {
+		bad := *cfg
+		bad.MinLease, bad.MaxLease = bounds[0], bounds[1]
+		if err := bad.Validate(); err == nil {
+			t.Errorf("%s: Validate accepted the configuration", name)
+		}
+	}
+}
+
+func TestClassLeaseBounds(t *testing.T) {
+	cfg := &Config{
+		Subnet:   net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Start:    net.ParseIP("192.168.1.100"),
+		End:      net.ParseIP("192.168.1.110"),
+		Lease:    time.Hour,
+		MinLease: 10 * time.Minute,
+		MaxLease: 4 * time.Hour,
+		ServerIP: net.ParseIP("192.168.1.2"),
+	}
+	server, err := newServer(cfg)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	long := &classify.Class{Name: "long", LeaseTime: 8 * time.Hour}
+	bounded := &classify.Class{Name: "bounded", MinLease: time.Hour, MaxLease: 12 * time.Hour}
+	for _, tc := range []struct {
+		name      string
+		classes   []*classify.Class
+		requested time.Duration
+		want      time.Duration
+	}{
+		{"scope", nil, 10 * time.Hour, 4 * time.Hour},
+		{"class default above scope maximum", []*classify.Class{long}, 10 * time.Hour, 8 * time.Hour},
+		{"class default admits shorter", []*classify.Class{long}, 2 * time.Hour, 2 * time.Hour},
+		{"class maximum", []*classify.Class{bounded}, 24 * time.Hour, 12 * time.Hour},
+		{"class minimum", []*classify.Class{bounded}, 20 * time.Minute, time.Hour},
+		{"first class wins", []*classify.Class{bounded, long}, 24 * time.Hour, 12 * time.Hour},
+	} {
+		options := server.replyOptions(tc.classes)
+		server.grantLease(options, tc.classes, tc.requested)
+		if options.LeaseTime != tc.want {
+			t.Errorf("%s: lease = %v, want %v", tc.name, options.LeaseTime, tc.want)
+		}
+	}
+
+	bad := *cfg
+	bad.Classes = []classify.Class{{Name: "inverted", MinLease: 2 * time.Hour, MaxLease: time.Hour}}
+	if err := bad.Validate(); err == nil {
+		t.Error("Validate accepted a class whose minimum lease exceeds its maximum")
+	}
+}
+
+func TestBOOTP(t *testing.T) {
+	reserved := net.HardwareAddr{0x00, 0xaa, 0, 0, 0, 1}
+	cfg := &Config{
+		Subnet:   net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Lease:    time.Hour,
+		ServerIP: net.ParseIP("192.168.1.2"),
+		Pools: []PoolConfig{
+			{Name: "dhcp", Start: net.ParseIP("192.168.1.100"), End: net.ParseIP("192.168.1.100")},
+			{Name: "bootp", Start: net.ParseIP("192.168.1.120"), End: net.ParseIP("192.168.1.125")},
+		},
+		BOOTP: BOOTPConfig{
+			Enabled:     true,
+			Hosts:       []BOOTPHost{{MAC: reserved, IP: net.ParseIP("192.168.1.50"), Hostname: "plc-1", File: "plc.bin"}},
+			DynamicPool: "bootp",
+			ServerName:  "boot",
+			File:        "default.bin",
+		},
+	}
+	server, err := newServer(cfg)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	bootRequest := func(mac net.HardwareAddr) *protocol.Packet {
+		return &protocol.Packet{Op: protocol.BOOTREQUEST, HType: 1, HLen: 6, CIAddr: net.IPv4zero, GIAddr: net.IPv4zero, CHAddr: mac}
+	}
+
+	reply := server.createBOOTPReply(bootRequest(reserved))
+	if reply == nil || !reply.YIAddr.Equal(net.ParseIP("192.168.1.50")) {
+		t.Fatalf("reserved host reply = %+v, want 192.168.1.50", reply)
+	}
+	if string(reply.File) != "plc.bin" || string(reply.SName) != "boot" || string(reply.GetOption(protocol.OptionHostname)) != "plc-1" {
+		t.Errorf("reserved host reply file %q sname %q hostname %q", reply.File, reply.SName, reply.GetOption(protocol.OptionHostname))
+	}
+
+	dynamic := net.HardwareAddr{0x00, 0xbb, 0, 0, 0, 1}
+	reply = server.createBOOTPReply(bootRequest(dynamic))
+	if reply == nil || string(reply.File) != "default.bin" {
+		t.Fatalf("dynamic reply = %+v, want default.bin", reply)
+	}
+	ip := reply.YIAddr
+	if !server.namedPool("bootp").Contains(ip) {
+		t.Fatalf("dynamic BOOTP address %v outside the BOOTP pool", ip)
+	}
+	b := server.allocated[IPToUint32(ip)]
+	if b == nil || b.State != BOUND || !b.Expiration.IsZero() || b.heapIndex != 0 {
+		t.Fatalf("dynamic BOOTP binding = %+v, want an infinite lease", b)
+	}
+	server.expireLeases(time.Now().Add(100 * 365 * 24 * time.Hour))
+	if again := server.createBOOTPReply(bootRequest(dynamic)); again == nil || !again.YIAddr.Equal(ip) {
+		t.Errorf("dynamic BOOTP client moved from %v", ip)
+	}
+
+	// DHCP clients never get addresses from the BOOTP pool.
+	for i := byte(1); i <= 2; i++ {
+		discover := &protocol.Packet{HType: 1, HLen: 6, CIAddr: net.IPv4zero, GIAddr: net.IPv4zero, CHAddr: net.HardwareAddr{0x00, 0xcc, 0, 0, 0, i}}
+		discover.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+		offer := server.createOffer(discover)
+		if i == 1 && (offer == nil || !offer.YIAddr.Equal(net.ParseIP("192.168.1.100"))) {
+			t.Errorf("first DHCP offer = %+v, want 192.168.1.100", offer)
+		}
+		if i == 2 && offer != nil {
+			t.Errorf("DHCP client offered %v from the BOOTP pool", offer.YIAddr)
+		}
+	}
+
+	disabled := *cfg
+	disabled.BOOTP.Enabled = false
+	if err := server.Reload(&disabled); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if server.createBOOTPReply(bootRequest(reserved)) != nil {
+		t.Errorf("answered BOOTP while disabled")
+	}
+
+	inPool := *cfg
+	inPool.BOOTP.Hosts = []BOOTPHost{{MAC: reserved, IP: net.ParseIP("192.168.1.121")}}
+	if _, err := newServer(&inPool); err == nil {
+		t.Errorf("accepted a BOOTP reservation inside a pool")
+	}
+}
+
+func TestPXEBoot(t *testing.T) {
+	cfg := &Config{
+		Start:    net.ParseIP("192.168.1.100"),
+		End:      net.ParseIP("192.168.1.150"),
+		Subnet:   net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Lease:    time.Hour,
+		ServerIP: net.ParseIP("192.168.1.2"),
+		PXE: PXEConfig{
+			Enabled:    true,
+			NextServer: net.ParseIP("192.168.1.5"),
+			BIOS:       "undionly.kpxe",
+			UEFI:       "ipxe.efi",
+			ARM64:      "ipxe-arm64.efi",
+			HTTP:       "http://192.168.1.5/ipxe.efi",
+			IPXEScript: "http://192.168.1.5/boot.ipxe",
+		},
+	}
+	server, err := newServer(cfg)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+
+	guid := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	tests := []struct {
+		name     string
+		vendor   string
+		arch     []byte
+		ipxe     bool
+		wantFile string
+		wantTFTP bool
+	}{
+		{"bios without arch", "PXEClient:Arch:00000:UNDI:002001", nil, false, "undionly.kpxe", true},
+		{"bios", "PXEClient:Arch:00000:UNDI:002001", []byte{0, 0}, false, "undionly.kpxe", true},
+		{"uefi x64", "PXEClient:Arch:00007:UNDI:003016", []byte{0, 7}, false, "ipxe.efi", true},
+		{"uefi x64 arch 9", "PXEClient:Arch:00009:UNDI:003016", []byte{0, 9}, false, "ipxe.efi", true},
+		{"uefi arm64", "PXEClient:Arch:00011:UNDI:003000", []byte{0, 11}, false, "ipxe-arm64.efi", true},
+		{"uefi http", "HTTPClient:Arch:00016:UNDI:003001", []byte{0, 16}, false, "http://192.168.1.5/ipxe.efi", false},
+		{"ipxe", "PXEClient:Arch:00007:UNDI:003016", []byte{0, 7}, true, "http://192.168.1.5/boot.ipxe", true},
+		{"not pxe", "MSFT 5.0", nil, false, "", false},
+		{"unknown arch", "PXEClient:Arch:00002:UNDI:003016", []byte{0, 2}, false, "", false},
+		{"uefi http arm64", "HTTPClient:Arch:00019:UNDI:003001", []byte{0, 19}, false, "", false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			discover := &protocol.Packet{HType: 1, HLen: 6, CIAddr: net.IPv4zero, GIAddr: net.IPv4zero, CHAddr: net.HardwareAddr{0x00, 0xdd, 0, 0, 0, byte(i)}}
+			discover.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+			discover.AddOption(protocol.OptionClassIdentifier, []byte(tt.vendor))
+			if tt.arch != nil {
+				discover.AddOption(protocol.OptionClientSystemArch, tt.arch)
+				discover.AddOption(protocol.OptionClientNDI, []byte{1, 3, 16})
+				discover.AddOption(protocol.OptionClientMachineID, guid)
+			}
+			if tt.ipxe {
+				discover.AddOption(protocol.OptionUserClass, []byte("iPXE"))
+			}
+			offer := server.createOffer(discover)
+			if offer == nil {
+				t.Fatalf("no offer")
+			}
+			if string(offer.File) != tt.wantFile && !(tt.wantFile == "" && len(offer.File) == 0) {
+				t.Errorf("file = %q, want %q", offer.File, tt.wantFile)
+			}
+			if got := string(offer.GetOption(protocol.OptionBootfileName)); got != tt.wantFile {
+				t.Errorf("option 67 = %q, want %q", got, tt.wantFile)
+			}
+			if tt.wantFile == "" {
+				if !offer.SIAddr.Equal(cfg.ServerIP) {
+					t.Errorf("siaddr = %v, want %v", offer.SIAddr, cfg.ServerIP)
+				}
+				return
+			}
+			if !offer.SIAddr.Equal(cfg.PXE.NextServer) {
+				t.Errorf("siaddr = %v, want %v", offer.SIAddr, cfg.PXE.NextServer)
+			}
+			if got := string(offer.GetOption(protocol.OptionTFTPServerName)); (got == "192.168.1.5") != tt.wantTFTP {
+				t.Errorf("option 66 = %q", got)
+			}
+			if got := string(offer.GetOption(protocol.OptionClassIdentifier)); got != strings.SplitN(tt.vendor, ":", 2)[0] {
+				t.Errorf("option 60 = %q", got)
+			}
+			if tt.arch != nil {
+				if !bytes.Equal(offer.GetOption(protocol.OptionClientMachineID), guid) || !bytes.Equal(offer.GetOption(protocol.OptionClientNDI), []byte{1, 3, 16}) {
+					t.Errorf("options 97/94 not echoed: %x %x", offer.GetOption(protocol.OptionClientMachineID), offer.GetOption(protocol.OptionClientNDI))
+				}
+			}
+		})
+	}
+}
+
+func TestRapidCommit(t *testing.T) {
+	cfg := &Config{
+		Start:       net.ParseIP("192.168.1.100"),
+		End:         net.ParseIP("192.168.1.150"),
+		Subnet:      net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Lease:       time.Hour,
+		ServerIP:    net.ParseIP("192.168.1.2"),
+		RapidCommit: true,
+	}
+	server, err := newServer(cfg)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	discover := func(mac byte, rapid bool) *protocol.Packet {
+		p := &protocol.Packet{HType: 1, HLen: 6, CIAddr: net.IPv4zero, GIAddr: net.IPv4zero, CHAddr: net.HardwareAddr{0x00, 0xee, 0, 0, 0, mac}}
+		p.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+		if rapid {
+			p.AddOption(protocol.OptionRapidCommit, nil)
+		}
+		return p
+	}
+
+	ack := server.createOffer(discover(1, true))
+	if ack == nil || ack.DHCPMessageType() != protocol.DHCPACK || ack.GetOption(protocol.OptionRapidCommit) == nil {
+		t.Fatalf("rapid commit reply = %+v, want DHCPACK with option 80", ack)
+	}
+	b := server.allocated[IPToUint32(ack.YIAddr)]
+	if b == nil || b.State != BOUND || time.Until(b.Expiration) < 59*time.Minute {
+		t.Errorf("binding after rapid commit = %+v, want bound for the lease time", b)
+	}
+
+	offer := server.createOffer(discover(2, false))
+	if offer == nil || offer.DHCPMessageType() != protocol.DHCPOFFER || offer.GetOption(protocol.OptionRapidCommit) != nil {
+		t.Fatalf("reply without option 80 = %+v, want a plain DHCPOFFER", offer)
+	}
+	if b := server.allocated[IPToUint32(offer.YIAddr)]; b == nil || b.State != OFFERED {
+		t.Errorf("binding after offer = %+v, want offered", b)
+	}
+
+	disabled := *cfg
+	disabled.RapidCommit = false
+	if err := server.Reload(&disabled); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if offer := server.createOffer(discover(3, true)); offer == nil || offer.DHCPMessageType() != protocol.DHCPOFFER {
+		t.Errorf("reply with rapid commit disabled = %+v, want DHCPOFFER", offer)
+	}
+}
+
+func TestDropsPacketWithoutClientID(t *testing.T) {
+	server, err := newServer(&Config{
+		Start:    net.ParseIP("192.168.1.100"),
+		End:      net.ParseIP("192.168.1.150"),
+		Subnet:   net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Lease:    time.Hour,
+		ServerIP: net.ParseIP("192.168.1.2"),
+	})
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	conn := &mockConn{}
+	server.conn = conn
+
+	// An InfiniBand client with no chaddr and no option 61.
+	discover := &protocol.Packet{HType: 32, HLen: 0, CIAddr: net.IPv4zero, GIAddr: net.IPv4zero, CHAddr: make(net.HardwareAddr, 16)}
+	discover.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+	server.handlePacket(discover, &net.UDPAddr{IP: net.IPv4bcast, Port: 68})
+	if conn.writes != 0 || len(server.bindings) != 0 || len(server.allocated) != 0 {
+		t.Errorf("answered a client without an identity: %d writes, bindings %v", conn.writes, server.bindings)
+	}
+}
+
+func TestRapidCommitSendFailure(t *testing.T) {
+	journal, err := store.OpenJournal(filepath.Join(t.TempDir(), "leases.journal"))
+	if err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+	defer journal.Close()
+	server, err := newServer(&Config{
+		Start:       net.ParseIP("192.168.1.100"),
+		End:         net.ParseIP("192.168.1.100"),
+		Subnet:      net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Lease:       time.Hour,
+		ServerIP:    net.ParseIP("192.168.1.2"),
+		RapidCommit: true,
+		Store:       journal,
+	})
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	server.conn = &mockConn{err: errors.New("network is down")}
+
+	discover := &protocol.Packet{HType: 1, HLen: 6, CIAddr: net.IPv4zero, GIAddr: net.IPv4zero, CHAddr: net.HardwareAddr{0x00, 0xee, 0, 0, 0, 1}}
+	discover.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+	discover.AddOption(protocol.OptionRapidCommit, nil)
+	server.handleDiscover(discover, &net.UDPAddr{IP: net.IPv4bcast, Port: 68})
+
+	ip := net.ParseIP("192.168.1.100")
+	if b := server.allocated[IPToUint32(ip)]; b != nil {
+		t.Errorf("binding after failed ACK = %+v, want none", b)
+	}
+	if _, exists := server.bindings[clientKey(discover)]; exists || server.pools[0].InUse(ip) {
+		t.Errorf("address %v still held after failed ACK", ip)
+	}
+	if len(server.expiry) != 0 {
+		t.Errorf("expiry heap holds %d bindings after failed ACK, want none", len(server.expiry))
+	}
+	leases, err := journal.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(leases) != 0 {
+		t.Errorf("stored leases after failed ACK = %+v, want none", leases)
+	}
+}
+
+func TestForceRenew(t *testing.T) {
+	cfg := &Config{
+		Subnet:      net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Lease:       time.Hour,
+		ServerIP:    net.ParseIP("192.168.1.2"),
+		RapidCommit: true,
+		Pools: []PoolConfig{
+			{Name: "lab", Start: net.ParseIP("192.168.1.100"), End: net.ParseIP("192.168.1.109")},
+			{Name: "office", Start: net.ParseIP("192.168.1.110"), End: net.ParseIP("192.168.1.119")},
+		},
+		Classes: []classify.Class{
+			{Name: "lab", Test: "substring(option[60].hex, 0, 3) == 'lab'", Pools: []string{"lab"}},
+			{Name: "office", Test: "substring(option[60].hex, 0, 6) == 'office'", Pools: []string{"office"}},
+		},
+	}
+	server, err := newServer(cfg)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	conn := &mockConn{}
+	server.conn = conn
+
+	// bind acknowledges a client at once with rapid commit.
+	bind := func(mac byte, vendor string, capable bool) *protocol.Packet {
+		t.Helper()
+		discover := &protocol.Packet{HType: 1, HLen: 6, CIAddr: net.IPv4zero, GIAddr: net.IPv4zero, CHAddr: net.HardwareAddr{0x00, 0xff, 0, 0, 0, mac}}
+		discover.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+		discover.AddOption(protocol.OptionRapidCommit, nil)
+		discover.AddOption(protocol.OptionClassIdentifier, []byte(vendor))
+		if capable {
+			discover.AddOption(protocol.OptionForceRenewCapable, []byte{1})
+		}
+		ack := server.createOffer(discover)
+		if ack == nil || ack.DHCPMessageType() != protocol.DHCPACK {
+			t.Fatalf("client %d: reply = %+v, want DHCPACK", mac, ack)
+		}
+		return ack
+	}
+	lab := bind(1, "lab", true)
+	office := bind(2, "office", true)
+	legacy := bind(3, "office", false)
+
+	key := lab.ForceRenewNonce()
+	if len(key) != protocol.ForceRenewKeySize {
+		t.Fatalf("nonce = %x, want %d bytes", key, protocol.ForceRenewKeySize)
+	}
+	if legacy.GetOption(protocol.OptionAuthentication) != nil {
+		t.Errorf("client without option 145 was given a nonce")
+	}
+	// Renewals keep the nonce the client already holds.
+	renew := newRequest(lab.YIAddr, nil, nil, nil)
+	renew.CHAddr = lab.CHAddr
+	renew.AddOption(protocol.OptionForceRenewCapable, []byte{1})
+	renew.AddOption(protocol.OptionClassIdentifier, []byte("lab"))
+	if ack := server.createRequestReply(renew); ack == nil || !bytes.Equal(ack.ForceRenewNonce(), key) {
+		t.Errorf("renewal nonce changed")
+	}
+
+	if err := server.ForceRenew(lab.YIAddr); err != nil {
+		t.Fatalf("ForceRenew: %v", err)
+	}
+	sent := conn.sentPacket()
+	if sent == nil || sent.DHCPMessageType() != protocol.DHCPFORCERENEW || !sent.CIAddr.Equal(lab.YIAddr) {
+		t.Fatalf("sent %+v, want DHCPFORCERENEW to %v", sent, lab.YIAddr)
+	}
+	if sent.HType != 1 {
+		t.Errorf("FORCERENEW htype = %d, want the client's 1", sent.HType)
+	}
+	if !protocol.VerifyForceRenew(conn.p, key) {
+		t.Errorf("FORCERENEW does not verify with the client's nonce")
+	}
+	if protocol.VerifyForceRenew(conn.p, office.ForceRenewNonce()) {
+		t.Errorf("FORCERENEW verifies with another client's nonce")
+	}
+	if err := server.ForceRenew(legacy.YIAddr); err == nil {
+		t.Errorf("ForceRenew sent to a client without a nonce")
+	}
+	if err := server.ForceRenew(net.ParseIP("192.168.1.150")); err == nil {
+		t.Errorf("ForceRenew succeeded for an unbound address")
+	}
+
+	conn.writes = 0
+	if n, err := server.ForceRenewPool("office"); err != nil || n != 1 || conn.writes != 1 {
+		t.Errorf("ForceRenewPool = %d, %v with %d writes, want 1", n, err, conn.writes)
+	}
+	if sent := conn.sentPacket(); sent == nil || !sent.CIAddr.Equal(office.YIAddr) {
+		t.Errorf("pool FORCERENEW went to %+v, want %v", sent, office.YIAddr)
+	}
+	if n, err := server.ForceRenewClass("lab"); err != nil || n != 1 {
+		t.Errorf("ForceRenewClass = %d, %v, want 1", n, err)
+	}
+	if _, err := server.ForceRenewPool("missing"); err == nil {
+		t.Errorf("ForceRenewPool accepted an unknown pool")
+	}
+	if _, err := server.ForceRenewClass("missing"); err == nil {
+		t.Errorf("ForceRenewClass accepted an unknown class")
+	}
+}
+
+func TestLeaseQuery(t *testing.T) {
+	cfg := &Config{
+		Start:      net.ParseIP("192.168.1.100"),
+		End:        net.ParseIP("192.168.1.150"),
+		Subnet:     net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Lease:      time.Hour,
+		ServerIP:   net.ParseIP("192.168.1.2"),
+		LeaseQuery: LeaseQueryConfig{Enabled: true, Allowed: []net.IPNet{{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(8, 32)}}},
+	}
+	server, err := newServer(cfg)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	mac := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	discover := &protocol.Packet{HType: 1, HLen: 6, CIAddr: net.IPv4zero, GIAddr: net.IPv4zero, CHAddr: mac}
+	discover.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+	ip := server.createOffer(discover).YIAddr
+	if ack := server.createRequestReply(newRequest(nil, nil, ip, cfg.ServerIP)); ack == nil || ack.DHCPMessageType() != protocol.DHCPACK {
+		t.Fatalf("no ACK for %v", ip)
+	}
+	offered := server.createOffer(&protocol.Packet{HType: 1, HLen: 6, CIAddr: net.IPv4zero, GIAddr: net.IPv4zero, CHAddr: net.HardwareAddr{0x00, 0x11, 0, 0, 0, 2},
+		Options: []byte{protocol.OptionDHCPMessageType, 1, protocol.DHCPDISCOVER}}).YIAddr
+
+	relay := net.ParseIP("10.1.1.1")
+	query := func(ciaddr net.IP, chaddr net.HardwareAddr, clientID []byte) *protocol.Packet {
+		p := &protocol.Packet{Op: protocol.BOOTREQUEST, HType: 1, HLen: byte(len(chaddr)), XId: 42, CIAddr: net.IPv4zero, GIAddr: relay, CHAddr: chaddr}
+		if ciaddr != nil {
+			p.CIAddr = ciaddr
+		}
+		p.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPLEASEQUERY})
+		if clientID != nil {
+			p.AddOption(protocol.OptionClientIdentifier, clientID)
+		}
+		return p
+	}
+
+	now := time.Now().Add(10 * time.Minute)
+	tests := []struct {
+		name  string
+		query *protocol.Packet
+		want  byte
+	}{
+		{"bound address", query(ip, nil, nil), protocol.DHCPLEASEACTIVE},
+		{"offered address", query(offered, nil, nil), protocol.DHCPLEASEUNASSIGNED},
+		{"free address in pool", query(net.ParseIP("192.168.1.140"), nil, nil), protocol.DHCPLEASEUNASSIGNED},
+		{"foreign address", query(net.ParseIP("172.16.0.1"), nil, nil), protocol.DHCPLEASEUNKNOWN},
+		{"by mac", query(nil, mac, nil), protocol.DHCPLEASEACTIVE},
+		{"by client id", query(nil, nil, []byte(testClientKey)), protocol.DHCPLEASEACTIVE},
+		{"unknown mac", query(nil, net.HardwareAddr{0x00, 0x99, 0, 0, 0, 1}, nil), protocol.DHCPLEASEUNKNOWN},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := server.createLeaseQueryReply(tt.query, now)
+			if reply == nil || reply.DHCPMessageType() != tt.want {
+				t.Fatalf("reply = %+v, want message type %d", reply, tt.want)
+			}
+			if reply.XId != 42 || !reply.GIAddr.Equal(relay) {
+				t.Errorf("reply xid %d giaddr %v, want the query's", reply.XId, reply.GIAddr)
+			}
+			if tt.want != protocol.DHCPLEASEACTIVE {
+				return
+			}
+			if !reply.CIAddr.Equal(ip) || !bytes.Equal(reply.CHAddr, mac) {
+				t.Errorf("active reply ciaddr %v chaddr %v, want %v %v", reply.CIAddr, reply.CHAddr, ip, mac)
+			}
+			remaining := time.Duration(binary.BigEndian.Uint32(reply.GetOption(protocol.OptionIPAddressLeaseTime))) * time.Second
+			if remaining < 49*time.Minute || remaining > 50*time.Minute {
+				t.Errorf("remaining lease = %v, want about 50m", remaining)
+			}
+			if since := binary.BigEndian.Uint32(reply.GetOption(protocol.OptionLastTransactionTime)); since < 599 || since > 601 {
+				t.Errorf("last transaction = %ds ago, want 600", since)
+			}
+			associated := reply.GetOption(protocol.OptionAssociatedIP)
+			if byIP := tt.query.CIAddr.Equal(ip); byIP != (associated == nil) || !byIP && !net.IP(associated).Equal(ip) {
+				t.Errorf("associated-ip = %v", net.IP(associated))
+			}
+		})
+	}
+
+	// An IEEE 802 (htype 6) client is reported with its own hardware type.
+	ieee802 := net.HardwareAddr{0x00, 0x66, 0, 0, 0, 1}
+	tokenRing := &protocol.Packet{HType: 6, HLen: 6, CIAddr: net.IPv4zero, GIAddr: net.IPv4zero, CHAddr: ieee802}
+	tokenRing.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+	tokenRingIP := server.createOffer(tokenRing).YIAddr
+	request := newRequest(nil, nil, tokenRingIP, cfg.ServerIP)
+	request.HType, request.CHAddr = 6, ieee802
+	if ack := server.createRequestReply(request); ack == nil || ack.DHCPMessageType() != protocol.DHCPACK {
+		t.Fatalf("no ACK for %v", tokenRingIP)
+	}
+	if reply := server.createLeaseQueryReply(query(tokenRingIP, nil, nil), now); reply == nil || reply.HType != 6 || !bytes.Equal(reply.HardwareAddr(), ieee802) {
+		t.Errorf("LEASEACTIVE for an IEEE 802 client = %+v, want htype 6 and chaddr %v", reply, ieee802)
+	}
+
+	denied := query(ip, nil, nil)
+	denied.GIAddr = net.ParseIP("192.168.1.1")
+	if reply := server.createLeaseQueryReply(denied, now); reply != nil {
+		t.Errorf("answered a requester outside the allowed networks")
+	}
+	direct := query(ip, nil, nil)
+	direct.GIAddr = net.IPv4zero
+	if reply := server.createLeaseQueryReply(direct, now); reply != nil {
+		t.Errorf("answered a leasequery without giaddr")
+	}
+}
+
+func TestBulkLeaseQuery(t *testing.T) {
+	cfg := &Config{
+		Start:       net.ParseIP("192.168.1.100"),
+		End:         net.ParseIP("192.168.1.150"),
+		Subnet:      net.IPNet{IP: net.ParseIP("192.168.1.0"), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		Lease:       time.Hour,
+		ServerIP:    net.ParseIP("192.168.1.2"),
+		RapidCommit: true,
+		LeaseQuery:  LeaseQueryConfig{Enabled: true, MaxConnections: 1, Timeout: 500 * time.Millisecond},
+	}
+	server, err := newServer(cfg)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	agentInfo := func(relayID, remoteID string) []byte {
+		info := []byte{protocol.RelayAgentRelayID, byte(len(relayID))}
+		info = append(info, relayID...)
+		info = append(info, protocol.RelayAgentRemoteID, byte(len(remoteID)))
+		return append(info, remoteID...)
+	}
+	for i, info := range [][]byte{agentInfo("relay-1", "sub-1"), agentInfo("relay-1", "sub-2"), agentInfo("relay-2", "sub-3")} {
+		discover := &protocol.Packet{HType: 1, HLen: 6, CIAddr: net.IPv4zero, GIAddr: net.ParseIP("192.168.1.1"), CHAddr: net.HardwareAddr{0x00, 0xbb, 0, 0, 0, byte(i)}}
+		discover.AddOption(protocol.OptionDHCPMessageType, []byte{protocol.DHCPDISCOVER})
+		discover.AddOption(protocol.OptionRapidCommit, nil)
+		discover.AddOption(protocol.OptionDHCPAgentOptions, info)
+		if ack := server.createOffer(discover); ack == nil || ack.DHCPMessageType() != protocol.DHCPACK {
+			t.Fatalf("client %d not bound", i)
+		}
+	}
+
+	server.bulkListener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		server.serveBulkLeaseQuery(ctx)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	dial := func() net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp", server.bulkListener.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+	// ask sends a query and collects the replies up to DHCPLEASEQUERYDONE.
+	ask := func(conn net.Conn, query *protocol.Packet) (active []*protocol.Packet, done *protocol.Packet) {
+		t.Helper()
+		if err := protocol.WriteTCPMessage(conn, query); err != nil {
+			t.Fatalf("WriteTCPMessage: %v", err)
+		}
+		for {
+			reply, err := protocol.ReadTCPMessage(conn)
+			if err != nil {
+				t.Fatalf("ReadTCPMessage: %v", err)
+			}
+			if reply.XId != query.XId {
+				t.Errorf("reply xid %d, want %d", reply.XId, query.XId)
+			}
+			if reply.DHCPMessageType() == protocol.DHCPLEASEQUERYDONE {
+				return active, reply
+			}
+			active = append(active, reply)
+		}
+	}
+	bulkQuery := func(messageType byte, options ...[]byte) *protocol.Packet {
+		p := &protocol.Packet{Op: protocol.BOOTREQUEST, XId: 77, CIAddr: net.IPv4zero, YIAddr: net.IPv4zero, SIAddr: net.IPv4zero, GIAddr: net.IPv4zero}
+		p.AddOption(protocol.OptionDHCPMessageType, []byte{messageType})
+		for _, o := range options {
+			p.AddOption(o[0], o[1:])
+		}
+		return p
+	}
+	status := func(done *protocol.Packet) byte {
+		if code := done.GetOption(protocol.OptionStatusCode); len(code) > 0 {
+			return code[0]
+		}
+		return 0xff
+	}
+	future := make([]byte, 4)
+	binary.BigEndian.PutUint32(future, uint32(time.Now().Add(time.Hour).Unix()))
+
+	conn := dial()
+	defer conn.Close()
+	tests := []struct {
+		name       string
+		query      *protocol.Packet
+		wantLeases int
+		wantStatus byte
+	}{
+		{"all leases", bulkQuery(protocol.DHCPBULKLEASEQUERY), 3, protocol.StatusSuccess},
+		{"by relay-id", bulkQuery(protocol.DHCPBULKLEASEQUERY, append([]byte{protocol.OptionDHCPAgentOptions, protocol.RelayAgentRelayID, 7}, "relay-1"...)), 2, protocol.StatusSuccess},
+		{"by remote-id", bulkQuery(protocol.DHCPBULKLEASEQUERY, append([]byte{protocol.OptionDHCPAgentOptions, protocol.RelayAgentRemoteID, 5}, "sub-3"...)), 1, protocol.StatusSuccess},
+		{"changed after query-start-time", bulkQuery(protocol.DHCPBULKLEASEQUERY, append([]byte{protocol.OptionQueryStartTime}, future...)), 0, protocol.StatusSuccess},
+		{"two query types", bulkQuery(protocol.DHCPBULKLEASEQUERY, []byte{protocol.OptionDHCPAgentOptions, protocol.RelayAgentRelayID, 1, 'x', protocol.RelayAgentRemoteID, 1, 'y'}), 0, protocol.StatusMalformedQuery},
+		{"not a bulk query", bulkQuery(protocol.DHCPLEASEQUERY), 0, protocol.StatusMalformedQuery},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			active, done := ask(conn, tt.query)
+			if len(active) != tt.wantLeases || status(done) != tt.wantStatus {
+				t.Fatalf("got %d leases and status %d, want %d and %d", len(active), status(done), tt.wantLeases, tt.wantStatus)
+			}
+			if done.GetOption(protocol.OptionBaseTime) == nil {
+				t.Errorf("DHCPLEASEQUERYDONE without base-time")
+			}
+			for _, reply := range active {
+				if reply.DHCPMessageType() != protocol.DHCPLEASEACTIVE || reply.GetOption(protocol.OptionBaseTime) == nil ||
+					reply.GetOption(protocol.OptionStartTimeOfState) == nil || reply.GetOption(protocol.OptionDHCPAgentOptions) == nil {
+					t.Errorf("reply %+v lacks the bulk leasequery options", reply)
+				}
+			}
+		})
+	}
+
+	// A second connection is over the limit and closed at once.
+	extra := dial()
+	defer extra.Close()
+	if _, err := protocol.ReadTCPMessage(extra); err == nil {
+		t.Errorf("connection over the limit was kept open")
+	}
+
+	// An idle connection is closed after the timeout.
+	start := time.Now()
+	if _, err := protocol.ReadTCPMessage(conn); err == nil || time.Since(start) > 3*time.Second {
+		t.Errorf("idle connection not closed by the timeout: %v after %v", err, time.Since(start))
+	}
+
+	restricted := *cfg
+	restricted.LeaseQuery.Allowed = []net.IPNet{{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(8, 32)}}
+	if err := server.Reload(&restricted); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	denied := dial()
+	defer denied.Close()
+	if _, done := ask(denied, bulkQuery(protocol.DHCPBULKLEASEQUERY)); status(done) != protocol.StatusNotAllowed {
+		t.Errorf("status for a requester not allowed = %d, want NotAllowed", status(done))
 	}
 }
@@ -0,0 +1,484 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	opPut    = 1
+	opDelete = 2
+
+	// recordHeaderLen is the length and CRC-32 in front of each payload.
+	recordHeaderLen = 8
+	// maxRecordLen guards against reading a corrupt length as a huge
+	// allocation.
+	maxRecordLen = 1 << 16
+	// minCompactRecords keeps small journals from being rewritten on
+	// nearly every change.
+	minCompactRecords = 1024
+)
+
+var errCorruptRecord = errors.New("corrupt journal record")
+
+// Journal is an append-only lease log. Every change is written as one
+// checksummed record and fsync'd before Put or Delete returns. Once dead
+// records outnumber live leases the journal is compacted by rewriting the
+// live leases to a new file and renaming it over the old one; CompactEvery
+// also compacts it periodically.
+type Journal struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	leases map[string]*Lease
+	// owned maps a client ID to the IP key of its client-owned lease.
+	owned   map[string]string
+	records int
+}
+
+// OpenJournal opens or creates the journal at path and replays it. A
+// truncated or corrupt final record, left by a crash mid-write, is cut off.
+func OpenJournal(path string) (*Journal, error) {
+	j := &Journal{path: path, leases: make(map[string]*Lease), owned: make(map[string]string)}
+	if err := j.replay(); err != nil {
+		return nil, err
+	}
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *Journal) replay() error {
+	f, err := os.OpenFile(j.path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open lease journal: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var good int64
+	for {
+		n, err := j.readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// Everything after the last intact record is discarded.
+			if err := f.Truncate(good); err != nil {
+				return fmt.Errorf("failed to truncate lease journal: %w", err)
+			}
+			return nil
+		}
+		good += int64(n)
+		j.records++
+	}
+}
+
+// readRecord applies the next record from r and returns its size.
+func (j *Journal) readRecord(r *bufio.Reader) (int, error) {
+	var header [recordHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		return 0, errCorruptRecord
+	}
+	length := binary.BigEndian.Uint32(header[0:])
+	if length == 0 || length > maxRecordLen {
+		return 0, errCorruptRecord
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, errCorruptRecord
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return 0, errCorruptRecord
+	}
+
+	op, l, err := decodeRecord(payload)
+	if err != nil {
+		return 0, err
+	}
+	switch op {
+	case opPut:
+		j.set(l)
+	case opDelete:
+		j.remove(string(l.IP))
+	}
+	return recordHeaderLen + int(length), nil
+}
+
+// Put appends l to the journal and syncs it to disk.
+func (j *Journal) Put(l *Lease) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	stored := *l
+	stored.IP = l.IP.To4()
+	if err := j.append(encodeRecord(opPut, &stored)); err != nil {
+		return err
+	}
+	j.set(&stored)
+	return j.maybeCompact()
+}
+
+// Bind checks and records l under one lock, so it is atomic with respect
+// to other callers of the same journal.
+func (j *Journal) Bind(l *Lease) (*Lease, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	ip := l.IP.To4()
+	if holder, exists := j.leases[string(ip)]; exists && blocks(holder, l, time.Now()) {
+		copied := *holder
+		return &copied, ErrAddressInUse
+	}
+	if key, exists := j.owned[string(l.ClientID)]; exists && key != string(ip) {
+		if err := j.append(encodeRecord(opDelete, &Lease{IP: net.IP(key)})); err != nil {
+			return nil, err
+		}
+		j.remove(key)
+	}
+
+	stored := *l
+	stored.IP = ip
+	if err := j.append(encodeRecord(opPut, &stored)); err != nil {
+		return nil, err
+	}
+	j.set(&stored)
+	return nil, j.maybeCompact()
+}
+
+// Delete appends a removal of ip to the journal and syncs it to disk.
+func (j *Journal) Delete(ip net.IP) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	ip = ip.To4()
+	if _, exists := j.leases[string(ip)]; !exists {
+		return nil
+	}
+	if err := j.append(encodeRecord(opDelete, &Lease{IP: ip})); err != nil {
+		return err
+	}
+	j.remove(string(ip))
+	return j.maybeCompact()
+}
+
+func (j *Journal) set(l *Lease) {
+	key := string(l.IP)
+	j.remove(key)
+	j.leases[key] = l
+	if ownedByClient(l.State) {
+		j.owned[string(l.ClientID)] = key
+	}
+}
+
+func (j *Journal) remove(key string) {
+	l, exists := j.leases[key]
+	if !exists {
+		return
+	}
+	delete(j.leases, key)
+	if j.owned[string(l.ClientID)] == key {
+		delete(j.owned, string(l.ClientID))
+	}
+}
+
+// Load returns the live leases.
+func (j *Journal) Load() ([]*Lease, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	leases := make([]*Lease, 0, len(j.leases))
+	for _, l := range j.leases {
+		copied := *l
+		leases = append(leases, &copied)
+	}
+	return leases, nil
+}
+
+// Compact rewrites the journal to hold only the live leases.
+func (j *Journal) Compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.compact()
+}
+
+// CompactEvery compacts the journal every interval until ctx is done, so
+// the dead records of a journal that changes too slowly to reach the
+// record threshold do not linger until the next restart. A journal with
+// no dead records is left alone.
+func (j *Journal) CompactEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		j.mu.Lock()
+		var err error
+		if j.file != nil && j.records > len(j.leases) {
+			err = j.compact()
+		}
+		j.mu.Unlock()
+		if err != nil {
+			slog.Error("Failed to compact lease journal", "path", j.path, "error", err)
+		}
+	}
+}
+
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+func (j *Journal) append(record []byte) error {
+	if j.file == nil {
+		return errors.New("lease journal is closed")
+	}
+	if _, err := j.file.Write(record); err != nil {
+		return fmt.Errorf("failed to write lease journal: %w", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync lease journal: %w", err)
+	}
+	j.records++
+	return nil
+}
+
+func (j *Journal) maybeCompact() error {
+	if j.records < minCompactRecords || j.records < 2*len(j.leases) {
+		return nil
+	}
+	return j.compact()
+}
+
+// compact writes the live leases to a temporary file, syncs it and renames
+// it over the journal, so a crash leaves either the old or the new file.
+func (j *Journal) compact() error {
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create compacted journal: %w", err)
+	}
+	w := bufio.NewWriter(tmp)
+	for _, l := range j.leases {
+		if _, err := w.Write(encodeRecord(opPut, l)); err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to write compacted journal: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write compacted journal: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync compacted journal: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close compacted journal: %w", err)
+	}
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return fmt.Errorf("failed to replace lease journal: %w", err)
+	}
+	syncDir(filepath.Dir(j.path))
+
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		j.file = nil
+		return fmt.Errorf("failed to reopen lease journal: %w", err)
+	}
+	j.records = len(j.leases)
+	return nil
+}
+
+// syncDir makes a rename in dir durable. Not every platform supports
+// syncing directories, so failures are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+}
+
+// encodeRecord frames a journal record:
+//
+//	length uint32 | crc32 uint32 | op | ip[4] | expiration int64 | state |
+//	len(clientID) | clientID | len(mac) | mac | start int64 |
+//	len(hostname) | hostname | htype | len(classes) |
+//	{len(class) | class}... | len(relayAgentInfo) uint16 | relayAgentInfo |
+//	len(forceRenewKey) | forceRenewKey
+//
+// Records written before start and hostname were added end after mac,
+// those written before htype and classes end after hostname, those
+// written before relayAgentInfo end after the classes, and those written
+// before forceRenewKey end after relayAgentInfo.
+func encodeRecord(op byte, l *Lease) []byte {
+	hostname := truncate(l.Hostname)
+	classes := l.Classes
+	if len(classes) > 255 {
+		classes = classes[:255]
+	}
+	relayAgentInfo := l.RelayAgentInfo
+	if len(relayAgentInfo) > math.MaxUint16 {
+		relayAgentInfo = relayAgentInfo[:math.MaxUint16]
+	}
+	forceRenewKey := l.ForceRenewKey
+	if len(forceRenewKey) > 255 {
+		forceRenewKey = forceRenewKey[:255]
+	}
+	payload := make([]byte, 0, 30+len(l.ClientID)+len(l.MAC)+len(hostname)+len(relayAgentInfo)+len(forceRenewKey))
+	payload = append(payload, op)
+	payload = append(payload, l.IP.To4()...)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(unixNano(l.Expiration)))
+	payload = append(payload, byte(l.State), byte(len(l.ClientID)))
+	payload = append(payload, l.ClientID...)
+	payload = append(payload, byte(len(l.MAC)))
+	payload = append(payload, l.MAC...)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(unixNano(l.Start)))
+	payload = append(payload, byte(len(hostname)))
+	payload = append(payload, hostname...)
+	payload = append(payload, l.HType, byte(len(classes)))
+	for _, class := range classes {
+		class = truncate(class)
+		payload = append(payload, byte(len(class)))
+		payload = append(payload, class...)
+	}
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(relayAgentInfo)))
+	payload = append(payload, relayAgentInfo...)
+	payload = append(payload, byte(len(forceRenewKey)))
+	payload = append(payload, forceRenewKey...)
+
+	record := make([]byte, recordHeaderLen, recordHeaderLen+len(payload))
+	binary.BigEndian.PutUint32(record[0:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	return append(record, payload...)
+}
+
+func decodeRecord(payload []byte) (byte, *Lease, error) {
+	if len(payload) < 15 {
+		return 0, nil, errCorruptRecord
+	}
+	op := payload[0]
+	if op != opPut && op != opDelete {
+		return 0, nil, errCorruptRecord
+	}
+	l := &Lease{IP: net.IP(append([]byte(nil), payload[1:5]...))}
+	l.Expiration = fromUnixNano(int64(binary.BigEndian.Uint64(payload[5:])))
+	l.State = LeaseState(payload[13])
+
+	rest := payload[14:]
+	n := int(rest[0])
+	if len(rest) < 1+n+1 {
+		return 0, nil, errCorruptRecord
+	}
+	if n > 0 {
+		l.ClientID = append([]byte(nil), rest[1:1+n]...)
+	}
+	rest = rest[1+n:]
+	m := int(rest[0])
+	if len(rest) < 1+m {
+		return 0, nil, errCorruptRecord
+	}
+	if m > 0 {
+		l.MAC = net.HardwareAddr(append([]byte(nil), rest[1:1+m]...))
+	}
+	rest = rest[1+m:]
+	if len(rest) == 0 {
+		return op, l, nil
+	}
+	if len(rest) < 9 || len(rest) < 9+int(rest[8]) {
+		return 0, nil, errCorruptRecord
+	}
+	l.Start = fromUnixNano(int64(binary.BigEndian.Uint64(rest)))
+	h := int(rest[8])
+	l.Hostname = string(rest[9 : 9+h])
+	rest = rest[9+h:]
+	if len(rest) == 0 {
+		return op, l, nil
+	}
+	if len(rest) < 2 {
+		return 0, nil, errCorruptRecord
+	}
+	l.HType = rest[0]
+	count := int(rest[1])
+	rest = rest[2:]
+	for range count {
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return 0, nil, errCorruptRecord
+		}
+		l.Classes = append(l.Classes, string(rest[1:1+int(rest[0])]))
+		rest = rest[1+int(rest[0]):]
+	}
+	if len(rest) == 0 {
+		return op, l, nil
+	}
+	if len(rest) < 2 || len(rest) < 2+int(binary.BigEndian.Uint16(rest)) {
+		return 0, nil, errCorruptRecord
+	}
+	if r := int(binary.BigEndian.Uint16(rest)); r > 0 {
+		l.RelayAgentInfo = append([]byte(nil), rest[2:2+r]...)
+	}
+	rest = rest[2+len(l.RelayAgentInfo):]
+	if len(rest) == 0 {
+		return op, l, nil
+	}
+	if len(rest) != 1+int(rest[0]) {
+		return 0, nil, errCorruptRecord
+	}
+	if len(rest) > 1 {
+		l.ForceRenewKey = append([]byte(nil), rest[1:]...)
+	}
+	return op, l, nil
+}
+
+// truncate cuts s to the 255 bytes a length byte can describe.
+func truncate(s string) string {
+	if len(s) > 255 {
+		return s[:255]
+	}
+	return s
+}
+
+// unixNano is t in Unix nanoseconds, with the zero time stored as 0.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
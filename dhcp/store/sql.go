@@ -0,0 +1,319 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrations bring the schema up to date. Each entry is applied once, in
+// order, and recorded in schema_migrations; append new entries, never edit
+// applied ones. Column types are chosen to work on SQLite, PostgreSQL and
+// MySQL alike, and addresses are stored as text so other tools can query
+// them directly.
+var migrations = [][]string{
+	{
+		`CREATE TABLE leases (
+			ip VARCHAR(15) NOT NULL PRIMARY KEY,
+			client_id VARCHAR(512) NOT NULL,
+			mac VARCHAR(64) NOT NULL,
+			state VARCHAR(16) NOT NULL,
+			expiration BIGINT NOT NULL
+		)`,
+		`CREATE INDEX leases_client_id ON leases (client_id)`,
+		`CREATE INDEX leases_mac ON leases (mac)`,
+	},
+	{
+		`ALTER TABLE leases ADD COLUMN start BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE leases ADD COLUMN hostname VARCHAR(255) NOT NULL DEFAULT ''`,
+	},
+	{
+		`ALTER TABLE leases ADD COLUMN htype SMALLINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE leases ADD COLUMN classes VARCHAR(1024) NOT NULL DEFAULT ''`,
+	},
+	{
+		`ALTER TABLE leases ADD COLUMN relay_agent_info VARCHAR(1024) NOT NULL DEFAULT ''`,
+	},
+	{
+		`ALTER TABLE leases ADD COLUMN force_renew_key VARCHAR(64) NOT NULL DEFAULT ''`,
+	},
+}
+
+// leaseColumns are the columns scanLease reads, in order.
+const leaseColumns = `ip, client_id, mac, state, expiration, start, hostname, htype, classes, relay_agent_info, force_renew_key`
+
+// SQL stores leases in a relational database through database/sql. Bind
+// runs in a serializable transaction, so several servers can share one
+// database without handing out the same address twice.
+type SQL struct {
+	db *sql.DB
+	// dollar selects PostgreSQL-style $n placeholders instead of ?.
+	dollar bool
+}
+
+// OpenSQL migrates the schema in db and returns a store on it. driver is
+// the database/sql driver name and selects the placeholder syntax.
+func OpenSQL(db *sql.DB, driver string) (*SQL, error) {
+	s := &SQL{db: db, dollar: driver == "postgres" || driver == "pgx"}
+	if err := s.migrate(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to migrate lease database: %w", err)
+	}
+	return s, nil
+}
+
+func (s *SQL) migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL PRIMARY KEY)`); err != nil {
+		return err
+	}
+	var current int
+	row := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`)
+	if err := row.Scan(&current); err != nil {
+		return err
+	}
+	for version := current + 1; version <= len(migrations); version++ {
+		err := s.inTx(ctx, func(tx *sql.Tx) error {
+			for _, stmt := range migrations[version-1] {
+				if _, err := tx.ExecContext(ctx, stmt); err != nil {
+					return err
+				}
+			}
+			_, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+func (s *SQL) Put(l *Lease) error {
+	return s.inTx(context.Background(), func(tx *sql.Tx) error {
+		return s.upsert(tx, l)
+	})
+}
+
+// sqlBindAttempts bounds how often Bind retries a transaction that lost
+// a race with another server.
+const sqlBindAttempts = 3
+
+// Bind retries when the transaction conflicts with a concurrent one, which
+// then usually reveals the other server's lease. If the conflict persists
+// it fails with ErrAddressInUse and no holder.
+func (s *SQL) Bind(l *Lease) (*Lease, error) {
+	var err error
+	for attempt := 0; attempt < sqlBindAttempts; attempt++ {
+		var holder *Lease
+		holder, err = s.bind(l)
+		if !isConflict(err) {
+			return holder, err
+		}
+	}
+	return nil, fmt.Errorf("%w: %v", ErrAddressInUse, err)
+}
+
+func (s *SQL) bind(l *Lease) (*Lease, error) {
+	var holder *Lease
+	err := s.inTx(context.Background(), func(tx *sql.Tx) error {
+		ip := l.IP.To4().String()
+		row := tx.QueryRow(s.rebind(`SELECT `+leaseColumns+` FROM leases WHERE ip = ?`), ip)
+		existing, err := scanLease(row)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if existing != nil && blocks(existing, l, time.Now()) {
+			holder = existing
+			return ErrAddressInUse
+		}
+
+		_, err = tx.Exec(s.rebind(`DELETE FROM leases WHERE client_id = ? AND ip <> ? AND state IN (?, ?, ?, ?)`),
+			hex.EncodeToString(l.ClientID), ip, OFFERED.String(), BOUND.String(), EXPIRED.String(), RELEASED.String())
+		if err != nil {
+			return err
+		}
+		return s.upsert(tx, l)
+	})
+	return holder, err
+}
+
+func (s *SQL) Delete(ip net.IP) error {
+	_, err := s.db.Exec(s.rebind(`DELETE FROM leases WHERE ip = ?`), ip.To4().String())
+	return err
+}
+
+func (s *SQL) Load() ([]*Lease, error) {
+	rows, err := s.db.Query(`SELECT ` + leaseColumns + ` FROM leases`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var leases []*Lease
+	for rows.Next() {
+		l, err := scanLease(rows)
+		if err != nil {
+			return nil, err
+		}
+		leases = append(leases, l)
+	}
+	return leases, rows.Err()
+}
+
+// Close does nothing: the caller owns the database handle.
+func (s *SQL) Close() error {
+	return nil
+}
+
+// upsert replaces the lease for l.IP. DELETE followed by INSERT avoids the
+// dialect-specific upsert syntaxes.
+func (s *SQL) upsert(tx *sql.Tx, l *Lease) error {
+	ip := l.IP.To4().String()
+	if _, err := tx.Exec(s.rebind(`DELETE FROM leases WHERE ip = ?`), ip); err != nil {
+		return err
+	}
+	classes, err := encodeClasses(l.Classes)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(s.rebind(`INSERT INTO leases (`+leaseColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		ip, hex.EncodeToString(l.ClientID), l.MAC.String(), l.State.String(), unixNano(l.Expiration), unixNano(l.Start), l.Hostname,
+		int(l.HType), classes, hex.EncodeToString(l.RelayAgentInfo), hex.EncodeToString(l.ForceRenewKey))
+	return err
+}
+
+func (s *SQL) inTx(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// isConflict reports whether err means the transaction raced another:
+// a serialization failure, deadlock or lock timeout, or a duplicate key
+// from a concurrent insert. Drivers that expose SQLSTATE (PostgreSQL) or
+// SQLite result codes are recognised.
+func isConflict(err error) bool {
+	if err == nil {
+		return false
+	}
+	var state interface{ SQLState() string }
+	if errors.As(err, &state) {
+		switch state.SQLState() {
+		case "40001", "40P01", "23505":
+			return true
+		}
+	}
+	var code interface{ Code() int }
+	if errors.As(err, &code) {
+		switch c := code.Code(); {
+		case c&0xff == sqliteBusy, c&0xff == sqliteLocked:
+			return true
+		case c == sqliteConstraintPrimaryKey, c == sqliteConstraintUnique:
+			return true
+		}
+	}
+	return false
+}
+
+// SQLite result codes that isConflict treats as a lost race.
+const (
+	sqliteBusy                 = 5
+	sqliteLocked               = 6
+	sqliteConstraintPrimaryKey = 1555
+	sqliteConstraintUnique     = 2067
+)
+
+// rebind rewrites ? placeholders as $1, $2, ... for PostgreSQL.
+func (s *SQL) rebind(query string) string {
+	if !s.dollar {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanLease(row scanner) (*Lease, error) {
+	var ip, clientID, mac, state, hostname, classes, relayAgentInfo, forceRenewKey string
+	var expiration, start int64
+	var htype int
+	if err := row.Scan(&ip, &clientID, &mac, &state, &expiration, &start, &hostname, &htype, &classes, &relayAgentInfo, &forceRenewKey); err != nil {
+		return nil, err
+	}
+
+	l := &Lease{IP: net.ParseIP(ip).To4()}
+	if l.IP == nil {
+		return nil, fmt.Errorf("invalid lease address %q", ip)
+	}
+	var err error
+	if l.ClientID, err = hex.DecodeString(clientID); err != nil {
+		return nil, fmt.Errorf("lease %s: invalid client ID: %w", ip, err)
+	}
+	if len(l.ClientID) == 0 {
+		l.ClientID = nil
+	}
+	if mac != "" {
+		hw, err := hex.DecodeString(strings.ReplaceAll(mac, ":", ""))
+		if err != nil {
+			return nil, fmt.Errorf("lease %s: invalid MAC: %w", ip, err)
+		}
+		l.MAC = hw
+	}
+	if l.State, err = ParseLeaseState(state); err != nil {
+		return nil, fmt.Errorf("lease %s: %w", ip, err)
+	}
+	l.Expiration = fromUnixNano(expiration)
+	l.Start = fromUnixNano(start)
+	l.Hostname = hostname
+	l.HType = byte(htype)
+	if classes != "" {
+		if err := json.Unmarshal([]byte(classes), &l.Classes); err != nil {
+			return nil, fmt.Errorf("lease %s: invalid classes: %w", ip, err)
+		}
+	}
+	if relayAgentInfo != "" {
+		if l.RelayAgentInfo, err = hex.DecodeString(relayAgentInfo); err != nil {
+			return nil, fmt.Errorf("lease %s: invalid relay agent information: %w", ip, err)
+		}
+	}
+	if forceRenewKey != "" {
+		if l.ForceRenewKey, err = hex.DecodeString(forceRenewKey); err != nil {
+			return nil, fmt.Errorf("lease %s: invalid FORCERENEW key: %w", ip, err)
+		}
+	}
+	return l, nil
+}
+
+// encodeClasses stores class names as a JSON array, since names may hold
+// any character. No classes is stored as the empty string.
+func encodeClasses(classes []string) (string, error) {
+	if len(classes) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(classes)
+	return string(b), err
+}
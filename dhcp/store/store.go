@@ -0,0 +1,126 @@
+// Package store persists leases so that bindings survive server restarts.
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ErrAddressInUse is returned by Bind when another client holds the address.
+var ErrAddressInUse = errors.New("address in use")
+
+// LeaseState is the state of an address binding.
+type LeaseState uint8
+
+const (
+	FREE LeaseState = iota
+	OFFERED
+	BOUND
+	EXPIRED
+	RELEASED
+	DECLINED
+	ABANDONED
+)
+
+func (s LeaseState) String() string {
+	switch s {
+	case FREE:
+		return "FREE"
+	case OFFERED:
+		return "OFFERED"
+	case BOUND:
+		return "BOUND"
+	case EXPIRED:
+		return "EXPIRED"
+	case RELEASED:
+		return "RELEASED"
+	case DECLINED:
+		return "DECLINED"
+	case ABANDONED:
+		return "ABANDONED"
+	}
+	return fmt.Sprintf("LeaseState(%d)", int(s))
+}
+
+// ParseLeaseState is the inverse of LeaseState.String.
+func ParseLeaseState(s string) (LeaseState, error) {
+	for state := FREE; state <= ABANDONED; state++ {
+		if state.String() == s {
+			return state, nil
+		}
+	}
+	return FREE, fmt.Errorf("unknown lease state %q", s)
+}
+
+// Lease is the persisted form of a binding. Leases are keyed by IP: at
+// most one lease exists per address.
+type Lease struct {
+	IP         net.IP
+	ClientID   []byte
+	MAC        net.HardwareAddr
+	State      LeaseState
+	Expiration time.Time
+	// Start is the client's last transaction: when the lease was last
+	// offered, granted or renewed.
+	Start    time.Time
+	Hostname string
+	// HType is the hardware type of MAC (htype), zero if unknown.
+	HType byte
+	// Classes names the client classes the client was in when last
+	// acknowledged.
+	Classes []string
+	// RelayAgentInfo is option 82 from the client's last request.
+	RelayAgentInfo []byte
+	// ForceRenewKey is the client's DHCPFORCERENEW nonce (RFC 6704), or
+	// nil.
+	ForceRenewKey []byte
+}
+
+// LeaseStore is durable storage for leases. Put and Delete must be durable
+// when they return, since the server answers clients right after.
+type LeaseStore interface {
+	// Put stores l, replacing any lease for the same IP.
+	Put(l *Lease) error
+	// Bind atomically allocates l.IP to l's client and records l. It
+	// fails with ErrAddressInUse, returning the holder's lease, if the
+	// address is actively held by another client or quarantined. The
+	// client's other OFFERED, BOUND, EXPIRED or RELEASED lease is removed,
+	// since a client holds one address at a time.
+	Bind(l *Lease) (*Lease, error)
+	// Delete removes the lease for ip, if any.
+	Delete(ip net.IP) error
+	// Load returns every stored lease.
+	Load() ([]*Lease, error)
+	Close() error
+}
+
+// ownedByClient reports whether a lease in state s belongs to its client.
+// DECLINED and ABANDONED leases only keep the address out of use.
+func ownedByClient(s LeaseState) bool {
+	return s == OFFERED || s == BOUND || s == EXPIRED || s == RELEASED
+}
+
+// Expired reports whether l has run out by now. A lease with a zero
+// Expiration, such as a dynamic BOOTP lease, never runs out.
+func (l *Lease) Expired(now time.Time) bool {
+	return !l.Expiration.IsZero() && !l.Expiration.After(now)
+}
+
+// blocks reports whether holder keeps l from binding the same address.
+// EXPIRED and RELEASED leases only give their last owner affinity, and
+// leases that have run out hold nothing.
+func blocks(holder, l *Lease, now time.Time) bool {
+	if holder.Expired(now) {
+		return false
+	}
+	switch holder.State {
+	case DECLINED, ABANDONED:
+		return true
+	case OFFERED, BOUND:
+		return !bytes.Equal(holder.ClientID, l.ClientID)
+	}
+	return false
+}
@@ -0,0 +1,427 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+func testLease(last byte) *Lease {
+	return &Lease{
+		IP:         net.IP{192, 168, 1, last},
+		ClientID:   []byte{1, 0, 0x11, 0x22, 0x33, 0x44, last},
+		MAC:        net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, last},
+		State:      BOUND,
+		Expiration: time.Unix(1700000000, int64(last)),
+		Start:      time.Unix(1699990000, 0),
+		Hostname:   "host-" + string('0'+last),
+		HType:      1,
+		Classes:    []string{"lab", "pxe, uefi"},
+		// Option 82 with circuit ID "eth0/<last>".
+		RelayAgentInfo: []byte{1, 6, 'e', 't', 'h', '0', '/', '0' + last},
+		ForceRenewKey:  bytes.Repeat([]byte{last}, 16),
+	}
+}
+
+func openJournal(t *testing.T, path string) *Journal {
+	t.Helper()
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+	t.Cleanup(func() { j.Close() })
+	return j
+}
+
+func loadByIP(t *testing.T, s LeaseStore) map[string]*Lease {
+	t.Helper()
+	leases, err := s.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	m := make(map[string]*Lease, len(leases))
+	for _, l := range leases {
+		m[l.IP.String()] = l
+	}
+	return m
+}
+
+func equalLease(a, b *Lease) bool {
+	return a.IP.Equal(b.IP) && bytes.Equal(a.ClientID, b.ClientID) && bytes.Equal(a.MAC, b.MAC) &&
+		a.State == b.State && a.Expiration.Equal(b.Expiration) && a.Start.Equal(b.Start) && a.Hostname == b.Hostname &&
+		a.HType == b.HType && slices.Equal(a.Classes, b.Classes) && bytes.Equal(a.RelayAgentInfo, b.RelayAgentInfo) &&
+		bytes.Equal(a.ForceRenewKey, b.ForceRenewKey)
+}
+
+func TestJournalReadsOlderRecords(t *testing.T) {
+	l := testLease(1)
+	payload := encodeRecord(opPut, l)[recordHeaderLen:]
+	withoutKey := payload[:len(payload)-1-len(l.ForceRenewKey)]
+	withoutRelay := withoutKey[:len(withoutKey)-2-len(l.RelayAgentInfo)]
+	withoutClasses := withoutRelay[:len(withoutRelay)-2-2-len("lab")-len("pxe, uefi")]
+
+	noKey := *l
+	noKey.ForceRenewKey = nil
+	noRelay := noKey
+	noRelay.RelayAgentInfo = nil
+	for _, tc := range []struct {
+		name    string
+		payload []byte
+		want    Lease
+	}{
+		{"before FORCERENEW key", withoutKey, noKey},
+		{"before relay agent information", withoutRelay, noRelay},
+		{"before htype and classes", withoutClasses, Lease{IP: l.IP, ClientID: l.ClientID, MAC: l.MAC, State: l.State,
+			Expiration: l.Expiration, Start: l.Start, Hostname: l.Hostname}},
+	} {
+		op, got, err := decodeRecord(tc.payload)
+		if err != nil || op != opPut {
+			t.Fatalf("%s: decodeRecord = %v, %v", tc.name, op, err)
+		}
+		if !equalLease(got, &tc.want) {
+			t.Errorf("%s: decoded %+v, want %+v", tc.name, got, &tc.want)
+		}
+	}
+	if _, _, err := decodeRecord(payload[:len(payload)-1]); err == nil {
+		t.Errorf("decodeRecord accepted a truncated FORCERENEW key")
+	}
+	if _, _, err := decodeRecord(withoutKey[:len(withoutKey)-1]); err == nil {
+		t.Errorf("decodeRecord accepted truncated relay agent information")
+	}
+	if _, _, err := decodeRecord(withoutRelay[:len(withoutRelay)-1]); err == nil {
+		t.Errorf("decodeRecord accepted a truncated class")
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.journal")
+	j := openJournal(t, path)
+	for i := byte(1); i <= 3; i++ {
+		if err := j.Put(testLease(i)); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	updated := testLease(2)
+	updated.State = RELEASED
+	if err := j.Put(updated); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := j.Delete(net.IP{192, 168, 1, 3}); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	j.Close()
+
+	leases := loadByIP(t, openJournal(t, path))
+	if len(leases) != 2 {
+		t.Fatalf("replayed %d leases, want 2", len(leases))
+	}
+	if l := leases["192.168.1.1"]; l == nil || !equalLease(l, testLease(1)) {
+		t.Errorf("lease 1 = %+v", l)
+	}
+	if l := leases["192.168.1.2"]; l == nil || !equalLease(l, updated) {
+		t.Errorf("lease 2 = %+v, want %+v", l, updated)
+	}
+}
+
+func TestJournalRecoversFromTruncatedRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.journal")
+	j := openJournal(t, path)
+	j.Put(testLease(1))
+	j.Put(testLease(2))
+	j.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	j = openJournal(t, path)
+	leases := loadByIP(t, j)
+	if len(leases) != 1 || leases["192.168.1.1"] == nil {
+		t.Fatalf("leases after truncation = %v, want only 192.168.1.1", leases)
+	}
+	if err := j.Put(testLease(3)); err != nil {
+		t.Fatalf("Put after recovery: %v", err)
+	}
+	j.Close()
+
+	if leases := loadByIP(t, openJournal(t, path)); len(leases) != 2 || leases["192.168.1.3"] == nil {
+		t.Errorf("leases after reopening = %v, want 192.168.1.1 and 192.168.1.3", leases)
+	}
+}
+
+func TestJournalDropsCorruptTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.journal")
+	j := openJournal(t, path)
+	j.Put(testLease(1))
+	j.Put(testLease(2))
+	j.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if leases := loadByIP(t, openJournal(t, path)); len(leases) != 1 {
+		t.Errorf("replayed %d leases from corrupt journal, want 1", len(leases))
+	}
+}
+
+func TestJournalCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.journal")
+	j := openJournal(t, path)
+	l := testLease(1)
+	for i := 0; i < 3*minCompactRecords; i++ {
+		l.Expiration = l.Expiration.Add(time.Second)
+		if err := j.Put(l); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if j.records >= minCompactRecords {
+		t.Errorf("journal holds %d records for one lease, want compaction", j.records)
+	}
+	j.Close()
+
+	leases := loadByIP(t, openJournal(t, path))
+	if got := leases["192.168.1.1"]; len(leases) != 1 || !equalLease(got, l) {
+		t.Errorf("lease after compaction = %+v, want %+v", got, l)
+	}
+}
+
+func TestJournalCompactEvery(t *testing.T) {
+	j := openJournal(t, filepath.Join(t.TempDir(), "leases.journal"))
+	l := testLease(1)
+	for i := 0; i < 10; i++ {
+		if err := j.Put(l); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		j.CompactEvery(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		j.mu.Lock()
+		records := j.records
+		j.mu.Unlock()
+		if records == 1 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("journal still holds %d records, want periodic compaction to 1", records)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func openSQLite(t *testing.T, path string) *SQL {
+	t.Helper()
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	s, err := OpenSQL(db, "sqlite")
+	if err != nil {
+		t.Fatalf("OpenSQL: %v", err)
+	}
+	return s
+}
+
+// forEachStore runs f against every LeaseStore implementation.
+func forEachStore(t *testing.T, f func(t *testing.T, s LeaseStore)) {
+	t.Run("journal", func(t *testing.T) {
+		f(t, openJournal(t, filepath.Join(t.TempDir(), "leases.journal")))
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		f(t, openSQLite(t, filepath.Join(t.TempDir(), "leases.db")))
+	})
+}
+
+func TestStorePutLoadDelete(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s LeaseStore) {
+		for i := byte(1); i <= 3; i++ {
+			if err := s.Put(testLease(i)); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+		}
+		noClient := &Lease{IP: net.IP{192, 168, 1, 9}, State: ABANDONED, Expiration: time.Unix(1700000000, 0)}
+		if err := s.Put(noClient); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if err := s.Delete(net.IP{192, 168, 1, 2}); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if err := s.Delete(net.IP{192, 168, 1, 200}); err != nil {
+			t.Fatalf("Delete of unknown lease: %v", err)
+		}
+
+		leases := loadByIP(t, s)
+		if len(leases) != 3 {
+			t.Fatalf("loaded %d leases, want 3", len(leases))
+		}
+		for _, want := range []*Lease{testLease(1), testLease(3), noClient} {
+			if got := leases[want.IP.String()]; got == nil || !equalLease(got, want) {
+				t.Errorf("lease %v = %+v, want %+v", want.IP, got, want)
+			}
+		}
+	})
+}
+
+func TestStoreBind(t *testing.T) {
+	now := time.Now()
+	lease := func(last byte, client byte, state LeaseState, expiration time.Time) *Lease {
+		return &Lease{
+			IP:         net.IP{192, 168, 1, last},
+			ClientID:   []byte{1, 0, 0, 0, 0, 0, client},
+			MAC:        net.HardwareAddr{0, 0, 0, 0, 0, client},
+			State:      state,
+			Expiration: expiration,
+		}
+	}
+	later := now.Add(time.Hour)
+
+	forEachStore(t, func(t *testing.T, s LeaseStore) {
+		bind := func(l *Lease) (*Lease, error) {
+			t.Helper()
+			holder, err := s.Bind(l)
+			if err != nil && !errors.Is(err, ErrAddressInUse) {
+				t.Fatalf("Bind: %v", err)
+			}
+			return holder, err
+		}
+
+		if _, err := bind(lease(10, 'a', OFFERED, later)); err != nil {
+			t.Fatalf("binding a free address: %v", err)
+		}
+		holder, err := bind(lease(10, 'b', OFFERED, later))
+		if err == nil || holder == nil || holder.ClientID[6] != 'a' {
+			t.Fatalf("binding an address offered to another client: holder %+v, err %v", holder, err)
+		}
+		if _, err := bind(lease(10, 'a', BOUND, later)); err != nil {
+			t.Errorf("client rebinding its own address: %v", err)
+		}
+
+		// Moving the client releases its previous address.
+		if _, err := bind(lease(11, 'a', OFFERED, later)); err != nil {
+			t.Fatalf("moving client: %v", err)
+		}
+		leases := loadByIP(t, s)
+		if leases["192.168.1.10"] != nil || leases["192.168.1.11"] == nil {
+			t.Errorf("after move leases = %v, want only 192.168.1.11", leases)
+		}
+
+		// Affinity does not block other clients, quarantine blocks everyone,
+		// and leases that ran out block no one.
+		s.Put(lease(12, 'c', RELEASED, later))
+		s.Put(lease(13, 'd', DECLINED, later))
+		s.Put(lease(14, 'e', BOUND, now.Add(-time.Minute)))
+		if _, err := bind(lease(12, 'b', OFFERED, later)); err != nil {
+			t.Errorf("binding a released address: %v", err)
+		}
+		if _, err := bind(lease(13, 'd', OFFERED, later)); err == nil {
+			t.Errorf("binding a declined address succeeded")
+		}
+		if _, err := bind(lease(14, 'f', OFFERED, later)); err != nil {
+			t.Errorf("binding an address whose lease ran out: %v", err)
+		}
+
+		// The declined lease is not the client's, so binding d elsewhere
+		// keeps it.
+		if _, err := bind(lease(15, 'd', OFFERED, later)); err != nil {
+			t.Fatalf("Bind: %v", err)
+		}
+		if loadByIP(t, s)["192.168.1.13"] == nil {
+			t.Errorf("declined lease removed when its client bound another address")
+		}
+	})
+}
+
+func TestSQLMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.db")
+	s := openSQLite(t, path)
+	s.Put(testLease(1))
+
+	// Reopening applies nothing twice and keeps the data.
+	s = openSQLite(t, path)
+	var version int
+	if err := s.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) {
+		t.Errorf("schema version = %d, want %d", version, len(migrations))
+	}
+	if leases := loadByIP(t, s); len(leases) != 1 {
+		t.Errorf("loaded %d leases after reopening, want 1", len(leases))
+	}
+
+	for _, index := range []string{"leases_client_id", "leases_mac"} {
+		var name string
+		err := s.db.QueryRow(`SELECT name FROM sqlite_master WHERE type = 'index' AND name = ?`, index).Scan(&name)
+		if err != nil {
+			t.Errorf("index %s: %v", index, err)
+		}
+	}
+}
+
+func TestRebind(t *testing.T) {
+	s := &SQL{dollar: true}
+	if got := s.rebind(`SELECT a FROM t WHERE b = ? AND c IN (?, ?)`); got != `SELECT a FROM t WHERE b = $1 AND c IN ($2, $3)` {
+		t.Errorf("rebind = %q", got)
+	}
+}
+
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "sql error " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+func TestIsConflict(t *testing.T) {
+	s := openSQLite(t, filepath.Join(t.TempDir(), "leases.db"))
+	insert := `INSERT INTO leases (ip, client_id, mac, state, expiration) VALUES ('192.168.1.1', '', '', 'BOUND', 0)`
+	if _, err := s.db.Exec(insert); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	_, duplicate := s.db.Exec(insert)
+
+	for _, tt := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"sqlite duplicate key", duplicate, true},
+		{"serialization failure", fmt.Errorf("commit: %w", sqlStateError("40001")), true},
+		{"unique violation", sqlStateError("23505"), true},
+		{"syntax error", sqlStateError("42601"), false},
+		{"other", errors.New("connection reset"), false},
+	} {
+		if got := isConflict(tt.err); got != tt.want {
+			t.Errorf("%s: isConflict(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
@@ -49,6 +49,15 @@ func getInterface() (*net.Interface, error) {
 	return iface, nil
 }
 
+// InterfaceName returns the name of the interface the server serves on.
+func InterfaceName() (string, error) {
+	iface, err := getInterface()
+	if err != nil {
+		return "", err
+	}
+	return iface.Name, nil
+}
+
 func GetMTU() (int, error) {
 	iface, err := getInterface()
 	if err != nil {